@@ -1,6 +1,7 @@
 package main
 
 import (
+	"context"
 	"embed"
 	"encoding/json"
 	"fmt"
@@ -22,7 +23,7 @@ var f embed.FS
 type Adventure struct {
 	Parameters novelai_api.NaiGenerateParams
 	Context    string
-	API        novelai_api.NovelAiAPI
+	API        novelai_api.Generator
 	Encoder    *gpt_bpe.GPTEncoder
 	MaxTokens  uint
 }
@@ -36,12 +37,31 @@ func NewAdventure() (adventure Adventure) {
 	contextBytes, _ := f.ReadFile("adventure.txt")
 	adventure.Context = string(contextBytes)
 	adventure.Parameters = parameters
-	adventure.API = novelai_api.NewNovelAiAPI()
+	api, err := novelai_api.NewGeneratorFromEnv()
+	if err != nil {
+		log.Fatal(err)
+	}
+	adventure.API = api
 	adventure.Encoder, _ = gpt_bpe.NewEncoder("gpt2")
 	adventure.MaxTokens = 1024 - *parameters.MaxLength
 	return adventure
 }
 
+// generate continues the context, printing the output as it arrives if the
+// API can stream it; `shown` reports whether it was printed.
+func (adventure *Adventure) generate() (output string, shown bool,
+	err error) {
+	resp, shown, err := novelai_api.GenerateOrStream(context.Background(),
+		adventure.API, &adventure.Context, adventure.Parameters,
+		func(text string) {
+			fmt.Print(text)
+		})
+	if shown {
+		fmt.Println()
+	}
+	return resp.Response, shown, err
+}
+
 func (adventure Adventure) start() {
 	fmt.Println(adventure.Context)
 	adventure.Context = "[Narrative: second-person]\n" + adventure.Context
@@ -70,9 +90,12 @@ func (adventure Adventure) start() {
 			}
 		}
 
-		resp := adventure.API.GenerateWithParams(&adventure.Context,
-			adventure.Parameters)
-		output = resp.Response
+		var shown bool
+		output, shown, err = adventure.generate()
+		if err != nil {
+			log.Println(err)
+			continue
+		}
 		doc, err := prose.NewDocument(output)
 		if err != nil {
 			log.Fatal(err)
@@ -86,9 +109,13 @@ func (adventure Adventure) start() {
 				processed = append(processed, sent.Text)
 			}
 		}
-		output = strings.Join(processed, " ")
-		adventure.Context = adventure.Context + output
-		fmt.Println(output)
+		trimmed := strings.Join(processed, " ")
+		adventure.Context = adventure.Context + trimmed
+		// The incomplete sentence trimmed off the end isn't kept in the
+		// context, so show what is kept if it differs from what streamed.
+		if !shown || trimmed != strings.TrimSpace(output) {
+			fmt.Println(trimmed)
+		}
 	}
 }
 
@@ -0,0 +1,413 @@
+package analysis
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"math"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/wbrown/gpt_bpe"
+	novelai_api "github.com/wbrown/novelai-research-tool/novelai-api"
+)
+
+//
+// Logprob analysis - reads the `logprobs_response` recorded in `nrt`'s JSON
+// output, for tests run with `num_logprobs`, and measures how confident the
+// model was in each generation and how the samplers moved its probabilities.
+//
+
+// outputIteration is the part of a serialized iteration that analysis reads.
+type outputIteration struct {
+	Settings struct {
+		Label *string `json:"label"`
+	} `json:"settings"`
+	Encoded struct {
+		Requests []struct {
+			Request struct {
+				Response string                      `json:"response"`
+				Logprobs *[]novelai_api.LogprobEntry `json:"logprobs_response"`
+			} `json:"requests"`
+		} `json:"requests"`
+	} `json:"encoded"`
+}
+
+// Movement is how the samplers changed the model's probabilities, averaged
+// over the tokens of a generation.
+type Movement struct {
+	// ChosenBefore and ChosenAfter are the mean probabilities of the chosen
+	// token before and after the samplers were applied.
+	ChosenBefore float64
+	ChosenAfter  float64
+	// Survivors is the mean number of candidate tokens the samplers left,
+	// out of the `num_logprobs` returned.
+	Survivors float64
+}
+
+// Stats are the measurements of one or more generations.
+type Stats struct {
+	Tokens int
+	// MeanLogprob is the mean logprob the model gave each chosen token
+	// before sampling, and Perplexity is `exp(-MeanLogprob)`.
+	MeanLogprob float64
+	Perplexity  float64
+	// Entropy is the mean entropy, in nats, of the top `num_logprobs`
+	// candidates before sampling, renormalized to sum to one.
+	Entropy float64
+	// NonArgmaxRate is the fraction of tokens that were not the model's most
+	// likely candidate.
+	NonArgmaxRate float64
+	Movement      Movement
+}
+
+type Generation struct {
+	Label      string
+	Path       string
+	Iteration  int
+	Generation int
+	Response   string
+	Stats
+	sums sums
+}
+
+type Summary struct {
+	Label       string
+	Generations int
+	Stats
+}
+
+// sums accumulates per-token measurements, to be averaged into Stats.
+type sums struct {
+	tokens       int
+	logprob      float64
+	entropy      float64
+	nonArgmax    int
+	chosenBefore float64
+	chosenAfter  float64
+	survivors    int
+}
+
+func (s *sums) add(other sums) {
+	s.tokens += other.tokens
+	s.logprob += other.logprob
+	s.entropy += other.entropy
+	s.nonArgmax += other.nonArgmax
+	s.chosenBefore += other.chosenBefore
+	s.chosenAfter += other.chosenAfter
+	s.survivors += other.survivors
+}
+
+func (s *sums) stats() (stats Stats) {
+	stats.Tokens = s.tokens
+	if s.tokens == 0 {
+		return stats
+	}
+	n := float64(s.tokens)
+	stats.MeanLogprob = s.logprob / n
+	stats.Perplexity = math.Exp(-stats.MeanLogprob)
+	stats.Entropy = s.entropy / n
+	stats.NonArgmaxRate = float64(s.nonArgmax) / n
+	stats.Movement = Movement{
+		ChosenBefore: s.chosenBefore / n,
+		ChosenAfter:  s.chosenAfter / n,
+		Survivors:    float64(s.survivors) / n,
+	}
+	return stats
+}
+
+// logprobBefore returns the logprob before sampling, falling back to the
+// logprob after sampling when only that was recorded.
+func logprobBefore(logprob novelai_api.Logprob) (float64, bool) {
+	if logprob.Logprobs.Before != nil {
+		return float64(*logprob.Logprobs.Before), true
+	} else if logprob.Logprobs.After != nil {
+		return float64(*logprob.Logprobs.After), true
+	}
+	return 0, false
+}
+
+func sameTokens(a gpt_bpe.Tokens, b gpt_bpe.Tokens) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for idx := range a {
+		if a[idx] != b[idx] {
+			return false
+		}
+	}
+	return true
+}
+
+// entropy returns the entropy of the distribution over `candidates`,
+// renormalized to sum to one.
+func entropy(candidates []novelai_api.Logprob) float64 {
+	probs := make([]float64, 0, len(candidates))
+	total := 0.0
+	for _, candidate := range candidates {
+		if logprob, ok := logprobBefore(candidate); ok {
+			probs = append(probs, math.Exp(logprob))
+			total += math.Exp(logprob)
+		}
+	}
+	h := 0.0
+	for _, p := range probs {
+		if p > 0 {
+			h -= (p / total) * math.Log(p/total)
+		}
+	}
+	return h
+}
+
+func analyzeToken(entry novelai_api.LogprobEntry) (s sums, ok bool) {
+	if entry.Chosen == nil || len(*entry.Chosen) == 0 {
+		return s, false
+	}
+	chosen := (*entry.Chosen)[0]
+	before, ok := logprobBefore(chosen)
+	if !ok {
+		return s, false
+	}
+	s.tokens = 1
+	s.logprob = before
+	s.chosenBefore = math.Exp(before)
+	if chosen.Logprobs.After != nil {
+		s.chosenAfter = math.Exp(float64(*chosen.Logprobs.After))
+	}
+	if entry.Before != nil && len(*entry.Before) > 0 {
+		candidates := *entry.Before
+		s.entropy = entropy(candidates)
+		argmax := 0
+		argmaxLogprob := math.Inf(-1)
+		for idx, candidate := range candidates {
+			if logprob, ok := logprobBefore(candidate); ok &&
+				logprob > argmaxLogprob {
+				argmax, argmaxLogprob = idx, logprob
+			}
+		}
+		if !sameTokens(candidates[argmax].Tokens, chosen.Tokens) {
+			s.nonArgmax = 1
+		}
+	}
+	if entry.After != nil {
+		s.survivors = len(*entry.After)
+	}
+	return s, true
+}
+
+func analyzeLogprobs(logprobs []novelai_api.LogprobEntry) sums {
+	var total sums
+	for _, entry := range logprobs {
+		if s, ok := analyzeToken(entry); ok {
+			total.add(s)
+		}
+	}
+	return total
+}
+
+// AnalyzeLogprobs measures a single generation's `logprobs`.
+func AnalyzeLogprobs(logprobs []novelai_api.LogprobEntry) Stats {
+	total := analyzeLogprobs(logprobs)
+	return total.stats()
+}
+
+// ReadOutput returns the serialized iterations of the `nrt` output at
+// `path`, which is either a JSON array or JSON Lines, one iteration per line.
+// If the last line of JSON Lines output was cut short, it is skipped.
+func ReadOutput(path string) (iterations []json.RawMessage, err error) {
+	outputBytes, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	if bytes.HasPrefix(bytes.TrimSpace(outputBytes), []byte("[")) {
+		if err = json.Unmarshal(outputBytes, &iterations); err != nil {
+			return nil, fmt.Errorf("`%s` is not valid `nrt` JSON output, "+
+				"`nrt fix-json` may repair it: %v", path, err)
+		}
+		return iterations, nil
+	}
+	lines := bytes.Split(outputBytes, []byte("\n"))
+	for lineIdx, line := range lines {
+		line = bytes.TrimSpace(line)
+		if len(line) == 0 {
+			continue
+		}
+		if line[0] != '{' || !json.Valid(line) {
+			if lineIdx > 0 && lineIdx == len(lines)-1 {
+				break
+			}
+			return nil, fmt.Errorf("`%s` is not `nrt` JSON output: line %d "+
+				"is not a JSON object", path, lineIdx+1)
+		}
+		iterations = append(iterations, json.RawMessage(line))
+	}
+	return iterations, nil
+}
+
+// OutputPaths returns the `.json` and `.jsonl` files in `dir`, sorted.
+func OutputPaths(dir string) (paths []string, err error) {
+	for _, pattern := range []string{"*.json", "*.jsonl"} {
+		matches, err := filepath.Glob(filepath.Join(dir, pattern))
+		if err != nil {
+			return nil, err
+		}
+		paths = append(paths, matches...)
+	}
+	sort.Strings(paths)
+	return paths, nil
+}
+
+// AnalyzeFile measures every generation with logprobs in the output at
+// `path`. Generations are labelled with their permutation's label, or the
+// file's name if they have none.
+func AnalyzeFile(path string) (generations []Generation, err error) {
+	serialized, err := ReadOutput(path)
+	if err != nil {
+		return nil, err
+	}
+	iterations := make([]outputIteration, len(serialized))
+	for idx := range serialized {
+		if err = json.Unmarshal(serialized[idx], &iterations[idx]); err != nil {
+			return nil, fmt.Errorf("`%s` is not `nrt` JSON output: %v", path,
+				err)
+		}
+	}
+	defaultLabel := strings.TrimSuffix(filepath.Base(path), filepath.Ext(path))
+	for iterationIdx, iteration := range iterations {
+		label := defaultLabel
+		if iteration.Settings.Label != nil && *iteration.Settings.Label != "" {
+			label = *iteration.Settings.Label
+		}
+		for generationIdx, request := range iteration.Encoded.Requests {
+			if request.Request.Logprobs == nil {
+				continue
+			}
+			total := analyzeLogprobs(*request.Request.Logprobs)
+			generations = append(generations, Generation{
+				Label:      label,
+				Path:       path,
+				Iteration:  iterationIdx,
+				Generation: generationIdx,
+				Response:   request.Request.Response,
+				Stats:      total.stats(),
+				sums:       total,
+			})
+		}
+	}
+	return generations, nil
+}
+
+// AnalyzePaths analyzes each of `paths`, reading every `.json` and `.jsonl`
+// file in those that are directories. Files in a directory that aren't `nrt`
+// output, such as test specifications, are skipped.
+func AnalyzePaths(paths []string) (generations []Generation, err error) {
+	for _, path := range paths {
+		info, err := os.Stat(path)
+		if err != nil {
+			return nil, err
+		}
+		if !info.IsDir() {
+			fileGenerations, err := AnalyzeFile(path)
+			if err != nil {
+				return nil, err
+			}
+			generations = append(generations, fileGenerations...)
+			continue
+		}
+		matches, err := OutputPaths(path)
+		if err != nil {
+			return nil, err
+		}
+		for _, match := range matches {
+			if fileGenerations, err := AnalyzeFile(match); err == nil {
+				generations = append(generations, fileGenerations...)
+			}
+		}
+	}
+	return generations, nil
+}
+
+// Summarize combines the generations of each label, weighting each by its
+// number of tokens, sorted by label.
+func Summarize(generations []Generation) (summaries []Summary) {
+	totals := make(map[string]*sums)
+	counts := make(map[string]int)
+	labels := make([]string, 0)
+	for _, generation := range generations {
+		if _, ok := totals[generation.Label]; !ok {
+			totals[generation.Label] = &sums{}
+			labels = append(labels, generation.Label)
+		}
+		totals[generation.Label].add(generation.sums)
+		counts[generation.Label]++
+	}
+	sort.Strings(labels)
+	for _, label := range labels {
+		summaries = append(summaries, Summary{
+			Label:       label,
+			Generations: counts[label],
+			Stats:       totals[label].stats(),
+		})
+	}
+	return summaries
+}
+
+// Metrics are the names SortSummaries accepts.
+var Metrics = []string{"label", "logprob", "perplexity", "entropy",
+	"non_argmax", "chosen_before", "chosen_after", "survivors"}
+
+func (stats Stats) metric(name string) float64 {
+	switch name {
+	case "logprob":
+		return stats.MeanLogprob
+	case "perplexity":
+		return stats.Perplexity
+	case "entropy":
+		return stats.Entropy
+	case "non_argmax":
+		return stats.NonArgmaxRate
+	case "chosen_before":
+		return stats.Movement.ChosenBefore
+	case "chosen_after":
+		return stats.Movement.ChosenAfter
+	case "survivors":
+		return stats.Movement.Survivors
+	}
+	return 0
+}
+
+// SortSummaries ranks `summaries` by `metric`, ascending, to compare
+// permutations.
+func SortSummaries(summaries []Summary, metric string) error {
+	known := false
+	for _, name := range Metrics {
+		known = known || name == metric
+	}
+	if !known {
+		return fmt.Errorf("unknown metric `%s`, expected one of %s", metric,
+			strings.Join(Metrics, ", "))
+	}
+	sort.SliceStable(summaries, func(i, j int) bool {
+		if metric == "label" {
+			return summaries[i].Label < summaries[j].Label
+		}
+		return summaries[i].metric(metric) < summaries[j].metric(metric)
+	})
+	return nil
+}
+
+func (summary Summary) String() string {
+	return fmt.Sprintf("%-40.40s %5d %7d %8.3f %10.3f %7.3f %10.3f "+
+		"%6.3f %6.3f %9.2f", summary.Label, summary.Generations,
+		summary.Tokens, summary.MeanLogprob, summary.Perplexity,
+		summary.Entropy, summary.NonArgmaxRate, summary.Movement.ChosenBefore,
+		summary.Movement.ChosenAfter, summary.Movement.Survivors)
+}
+
+// SummaryHeader is the header of the table Summary.String is a row of.
+var SummaryHeader = fmt.Sprintf("%-40s %5s %7s %8s %10s %7s %10s %6s %6s %9s",
+	"Label", "Gens", "Tokens", "Logprob", "Perplexity", "Entropy",
+	"Non-Argmax", "P(Bef)", "P(Aft)", "Survivors")
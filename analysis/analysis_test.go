@@ -0,0 +1,105 @@
+package analysis
+
+import (
+	"io/ioutil"
+	"math"
+	"path/filepath"
+	"testing"
+)
+
+const testOutput = `[
+{
+  "settings": {"label": "top_p=0_9"},
+  "encoded": {"requests": [{"requests": {
+    "response": " The end.",
+    "logprobs_response": [
+      {"chosen": [[[10], [-0.5, -0.25]]],
+       "before": [[[10], [-0.5, -0.5]], [[11], [-1.5, -1.5]]],
+       "after": [[[10], [-0.5, -0.25]]]},
+      {"chosen": [[[21], [-1.5, -1.0]]],
+       "before": [[[20], [-0.5, -0.5]], [[21], [-1.5, -1.5]]],
+       "after": [[[20], [-0.5, -0.4]], [[21], [-1.5, -1.0]]]}
+    ]}}]}
+},
+{
+  "settings": {"label": "top_p=0_5"},
+  "encoded": {"requests": [{"requests": {
+    "response": " The.",
+    "logprobs_response": [
+      {"chosen": [[[10], [-0.1, 0]]],
+       "before": [[[10], [-0.1, -0.1]], [[11], [-2.5, -2.5]]],
+       "after": [[[10], [-0.1, 0]]]}
+    ]}}, {"requests": {"response": " No logprobs."}}]}
+}
+]`
+
+func TestAnalyzeFile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "output.json")
+	if err := ioutil.WriteFile(path, []byte(testOutput), 0644); err != nil {
+		t.Fatal(err)
+	}
+	generations, err := AnalyzeFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(generations) != 2 {
+		t.Fatalf("expected 2 generations with logprobs, got %d",
+			len(generations))
+	}
+	stats := generations[0].Stats
+	pHigh := math.Exp(-0.5) / (math.Exp(-0.5) + math.Exp(-1.5))
+	entropy := -pHigh*math.Log(pHigh) - (1-pHigh)*math.Log(1-pHigh)
+	if stats.Tokens != 2 || stats.MeanLogprob != -1.0 ||
+		math.Abs(stats.Perplexity-math.E) > 1e-9 ||
+		math.Abs(stats.Entropy-entropy) > 1e-9 ||
+		stats.NonArgmaxRate != 0.5 || stats.Movement.Survivors != 1.5 {
+		t.Errorf("unexpected stats: %+v", stats)
+	}
+	if stats.Movement.ChosenAfter <= stats.Movement.ChosenBefore {
+		t.Errorf("sampling should have raised the chosen probabilities: %+v",
+			stats.Movement)
+	}
+
+	summaries := Summarize(generations)
+	if err = SortSummaries(summaries, "perplexity"); err != nil {
+		t.Fatal(err)
+	}
+	if len(summaries) != 2 || summaries[0].Label != "top_p=0_5" ||
+		summaries[1].Label != "top_p=0_9" {
+		t.Errorf("expected top_p=0_5 to rank first: %+v", summaries)
+	}
+	if err = SortSummaries(summaries, "nonsense"); err == nil {
+		t.Errorf("expected an error for an unknown metric")
+	}
+}
+
+func TestReadOutput(t *testing.T) {
+	dir := t.TempDir()
+	lines := `{"settings": {"label": "a"}}
+{"settings": {"label": "b"}}
+{"settings": {"lab`
+	files := map[string]string{"array.json": testOutput,
+		"lines.jsonl": lines, "spec.json": "{\n  \"prompt\": \"\"\n}"}
+	for name, contents := range files {
+		err := ioutil.WriteFile(filepath.Join(dir, name), []byte(contents),
+			0644)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	for name, expected := range map[string]int{"array.json": 2,
+		"lines.jsonl": 2} {
+		iterations, err := ReadOutput(filepath.Join(dir, name))
+		if err != nil || len(iterations) != expected {
+			t.Errorf("%s: expected %d iterations, got %d (%v)", name,
+				expected, len(iterations), err)
+		}
+	}
+	if _, err := ReadOutput(filepath.Join(dir, "spec.json")); err == nil {
+		t.Errorf("expected an error reading a specification")
+	}
+	paths, err := OutputPaths(dir)
+	if err != nil || len(paths) != 3 {
+		t.Errorf("expected 3 paths, got %v (%v)", paths, err)
+	}
+}
@@ -0,0 +1,45 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"strings"
+
+	"github.com/wbrown/novelai-research-tool/analysis"
+)
+
+func main() {
+	sortBy := flag.String("sort", "label", "metric to rank labels by: "+
+		strings.Join(analysis.Metrics, ", "))
+	flag.Usage = func() {
+		fmt.Fprintf(flag.CommandLine.Output(),
+			"Usage: %s [--sort metric] output.json|dir ...\n", os.Args[0])
+		flag.PrintDefaults()
+	}
+	flag.Parse()
+	if flag.NArg() == 0 {
+		flag.Usage()
+		os.Exit(1)
+	}
+	generations, err := analysis.AnalyzePaths(flag.Args())
+	if err != nil {
+		log.Printf("analysis: %v", err)
+		os.Exit(1)
+	}
+	if len(generations) == 0 {
+		log.Printf("analysis: no logprobs found; run tests with " +
+			"`num_logprobs` set")
+		os.Exit(1)
+	}
+	summaries := analysis.Summarize(generations)
+	if err = analysis.SortSummaries(summaries, *sortBy); err != nil {
+		log.Printf("analysis: %v", err)
+		os.Exit(1)
+	}
+	fmt.Println(analysis.SummaryHeader)
+	for _, summary := range summaries {
+		fmt.Println(summary)
+	}
+}
@@ -1,10 +1,12 @@
 package main
 
 import (
+	gocontext "context"
 	"fmt"
 	"github.com/chzyer/readline"
 	"github.com/inancgumus/screen"
 	"github.com/wbrown/novelai-research-tool/context"
+	novelai_api "github.com/wbrown/novelai-research-tool/novelai-api"
 	"log"
 	"os"
 	"os/exec"
@@ -39,6 +41,17 @@ func BoolPointer(b bool) *bool {
 
 
 
+// generate continues `fulltext`, printing the output as it arrives if the
+// API can stream it.
+func generate(ctx *context.SimpleContext, fulltext *string) (
+	resp novelai_api.NaiGenerateResp, err error) {
+	resp, _, err = novelai_api.GenerateOrStream(gocontext.Background(),
+		ctx.API, fulltext, ctx.Parameters, func(text string) {
+			fmt.Print(colorWhite + text)
+		})
+	return resp, err
+}
+
 func writeText(path string, text string) {
 	if f, err := os.Create(path); err != nil {
 		println("\n\n\n\nError saving file.")
@@ -156,7 +169,12 @@ func start() {
 		}
 		fulltext = strings.TrimRight(fulltext, "\n")
 		writeText("lastinput.txt", fulltext)
-		resp := ctx.API.GenerateWithParams(&fulltext, ctx.Parameters)
+		resp, err := generate(&ctx, &fulltext)
+		if err != nil {
+			fmt.Println(colorWhite + "\nERROR: " + err.Error())
+			ctx.Context = ctx.LastContext
+			continue
+		}
 		output = resp.Response
 
 		var eos_pos int
@@ -179,7 +197,7 @@ func start() {
 				fmt.Println(colorWhite + (resp.NextWordArray)[i][0] + colorGrey + " (" + (resp.NextWordArray)[i][1] + ")")
 			}
 
-			fmt.Println(colorWhite + "\nPRESS ENTER TO CONTINUE...\n")
+			fmt.Print(colorWhite + "\nPRESS ENTER TO CONTINUE...\n\n")
 			pause()
 		}
 
@@ -16,7 +16,7 @@ type SimpleContext struct {
 	FullReturn  bool
 	AuthorsNote string
 	LastContext string
-	API         novelai_api.NovelAiAPI
+	API         novelai_api.Generator
 	Encoder     gpt_bpe.GPTEncoder
 	MaxTokens   uint
 }
@@ -33,7 +33,11 @@ func NewSimpleContext() (context SimpleContext) {
 	context.Context = string(contextBytes)
 	context.LastContext = string(contextBytes)
 	context.Parameters = parameters
-	context.API = novelai_api.NewNovelAiAPI()
+	api, err := novelai_api.NewGeneratorFromEnv()
+	if err != nil {
+		log.Fatal(err)
+	}
+	context.API = api
 	context.Encoder = *novelai_api.GetEncoderByModel(*parameters.Model)
 	context.FullReturn = *parameters.ReturnFullText
 	context.MaxTokens = *parameters.ContextLength - *parameters.MaxLength
@@ -0,0 +1,179 @@
+package nrt
+
+import (
+	"bufio"
+	"encoding/base64"
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io"
+	"sort"
+
+	"github.com/wbrown/novelai-research-tool/analysis"
+)
+
+//
+// Export - flattens outputs into one row per generation, for loading into
+//          pandas, DuckDB and the like.
+//
+
+type ExportFormat string
+
+const (
+	ExportCSV   ExportFormat = "csv"
+	ExportJSONL ExportFormat = "jsonl"
+)
+
+// exportColumns come before the parameter columns; logprob and context
+// columns follow them.
+var exportColumns = []string{"label", "path", "iteration", "generation",
+	"response", "error", "context_tokens", "response_tokens"}
+var exportStatsColumns = []string{"mean_logprob", "perplexity", "entropy",
+	"non_argmax_rate", "context_entries", "context_tokens_inserted",
+	"context_budget_remaining"}
+
+// exportRow holds JSON values by column; missing columns are null.
+type exportRow map[string]json.RawMessage
+
+func (row exportRow) set(column string, value interface{}) {
+	serialized, err := json.Marshal(value)
+	if err != nil {
+		serialized = json.RawMessage("null")
+	}
+	row[column] = serialized
+}
+
+// tokenCount returns the number of tokens in a base64 encoded response.
+func tokenCount(encoded string) int {
+	tokens, err := base64.StdEncoding.DecodeString(encoded)
+	if err != nil {
+		return 0
+	}
+	return len(tokens) / 2
+}
+
+// exportRows flattens `outputs` into a row for each generation, returning the
+// columns in order.
+func exportRows(outputs []OutputFile) (columns []string, rows []exportRow) {
+	parameters := make(map[string]bool)
+	for outputIdx := range outputs {
+		output := &outputs[outputIdx]
+		label := output.Label()
+		for iterationIdx := range output.Iterations {
+			iteration := &output.Iterations[iterationIdx]
+			values := parameterValues(iteration)
+			for name := range values {
+				parameters[name] = true
+			}
+			for requestIdx := range iteration.Encoded.Requests {
+				request := &iteration.Encoded.Requests[requestIdx]
+				resp := &request.Request
+				row := exportRow{}
+				for name, value := range values {
+					row[name] = value
+				}
+				row.set("label", label)
+				row.set("path", output.Path)
+				row.set("iteration", iterationIdx)
+				row.set("generation", requestIdx)
+				row.set("response", resp.Response)
+				row.set("context_tokens", tokenCount(resp.EncodedRequest))
+				row.set("response_tokens", tokenCount(resp.EncodedResponse))
+				if resp.Logprobs != nil {
+					stats := analysis.AnalyzeLogprobs(*resp.Logprobs)
+					row.set("mean_logprob", stats.MeanLogprob)
+					row.set("perplexity", stats.Perplexity)
+					row.set("entropy", stats.Entropy)
+					row.set("non_argmax_rate", stats.NonArgmaxRate)
+				}
+				if len(request.ContextReport) > 0 {
+					inserted, entries := 0, 0
+					for _, entry := range request.ContextReport {
+						if entry.TokensInserted > 0 {
+							inserted += entry.TokensInserted
+							entries++
+						}
+					}
+					last := request.ContextReport[len(request.ContextReport)-1]
+					row.set("context_entries", entries)
+					row.set("context_tokens_inserted", inserted)
+					row.set("context_budget_remaining", last.BudgetRemaining)
+				}
+				rows = append(rows, row)
+			}
+			// An iteration that failed before its first generation still
+			// gets a row, to record the error.
+			if iteration.Error != "" {
+				row := exportRow{}
+				for name, value := range values {
+					row[name] = value
+				}
+				row.set("label", label)
+				row.set("path", output.Path)
+				row.set("iteration", iterationIdx)
+				row.set("generation", len(iteration.Encoded.Requests))
+				row.set("error", iteration.Error)
+				rows = append(rows, row)
+			}
+		}
+	}
+	columns = append(columns, exportColumns...)
+	names := make([]string, 0, len(parameters))
+	for name := range parameters {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	columns = append(columns, names...)
+	columns = append(columns, exportStatsColumns...)
+	return columns, rows
+}
+
+// ExportOutputs writes `outputs` to `w` in `format`, one row per generation.
+func ExportOutputs(w io.Writer, format ExportFormat,
+	outputs []OutputFile) error {
+	columns, rows := exportRows(outputs)
+	switch format {
+	case ExportCSV:
+		writer := csv.NewWriter(w)
+		if err := writer.Write(columns); err != nil {
+			return err
+		}
+		record := make([]string, len(columns))
+		for _, row := range rows {
+			for columnIdx, column := range columns {
+				record[columnIdx] = ""
+				if value, ok := row[column]; ok {
+					record[columnIdx] = rawText(value)
+				}
+			}
+			if err := writer.Write(record); err != nil {
+				return err
+			}
+		}
+		writer.Flush()
+		return writer.Error()
+	case ExportJSONL:
+		writer := bufio.NewWriter(w)
+		for _, row := range rows {
+			// Objects are written by hand to keep the columns in order.
+			writer.WriteString("{")
+			for columnIdx, column := range columns {
+				if columnIdx > 0 {
+					writer.WriteString(",")
+				}
+				value, ok := row[column]
+				if !ok {
+					value = json.RawMessage("null")
+				}
+				name, _ := json.Marshal(column)
+				writer.Write(name)
+				writer.WriteString(":")
+				writer.Write(value)
+			}
+			writer.WriteString("}\n")
+		}
+		return writer.Flush()
+	default:
+		return fmt.Errorf("unknown export format `%s`", format)
+	}
+}
@@ -0,0 +1,163 @@
+package nrt
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+)
+
+//
+// Manifest - records the progress of each permutation in a run, so that an
+//            interrupted run can be resumed where it left off.
+//
+
+type ManifestStatus string
+
+const (
+	ManifestRunning  ManifestStatus = "running"
+	ManifestPartial  ManifestStatus = "partial"
+	ManifestComplete ManifestStatus = "complete"
+)
+
+type ManifestEntry struct {
+	Label      string         `json:"label"`
+	Status     ManifestStatus `json:"status"`
+	Iterations int            `json:"iterations"`
+	// Output is the path of the permutation's outputs, without extension,
+	// relative to the manifest.
+	Output string `json:"output"`
+}
+
+type Manifest struct {
+	path    string
+	mu      sync.Mutex
+	entries map[string]ManifestEntry
+}
+
+type manifestFile struct {
+	Permutations []ManifestEntry `json:"permutations"`
+}
+
+// LoadManifest reads the manifest at `path`, returning an empty manifest if
+// it does not exist yet.
+func LoadManifest(path string) (*Manifest, error) {
+	manifest := &Manifest{
+		path:    path,
+		entries: make(map[string]ManifestEntry),
+	}
+	manifestBytes, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return manifest, nil
+	} else if err != nil {
+		return nil, err
+	}
+	var contents manifestFile
+	if err = json.Unmarshal(manifestBytes, &contents); err != nil {
+		return nil, err
+	}
+	for _, entry := range contents.Permutations {
+		manifest.entries[entry.Label] = entry
+	}
+	return manifest, nil
+}
+
+// Get returns the entry for the permutation `label`, if it has been started.
+func (manifest *Manifest) Get(label string) (entry ManifestEntry, ok bool) {
+	manifest.mu.Lock()
+	defer manifest.mu.Unlock()
+	entry, ok = manifest.entries[label]
+	return entry, ok
+}
+
+// Update records `entry` and writes the manifest out.
+func (manifest *Manifest) Update(entry ManifestEntry) error {
+	manifest.mu.Lock()
+	defer manifest.mu.Unlock()
+	manifest.entries[entry.Label] = entry
+	contents := manifestFile{
+		Permutations: make([]ManifestEntry, 0, len(manifest.entries)),
+	}
+	for _, entry := range manifest.entries {
+		contents.Permutations = append(contents.Permutations, entry)
+	}
+	sort.Slice(contents.Permutations, func(i, j int) bool {
+		return contents.Permutations[i].Label < contents.Permutations[j].Label
+	})
+	serialized, err := json.MarshalIndent(contents, "", "  ")
+	if err != nil {
+		return err
+	}
+	return writeFileAtomic(manifest.path, serialized)
+}
+
+// writeFileAtomic writes `data` to a temporary file alongside `path` and
+// renames it into place, so that readers never see a partial file.
+func writeFileAtomic(path string, data []byte) error {
+	dir := filepath.Dir(path)
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return err
+	}
+	f, err := ioutil.TempFile(dir, filepath.Base(path)+".tmp")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(f.Name())
+	if _, err = f.Write(data); err != nil {
+		f.Close()
+		return err
+	}
+	if err = f.Sync(); err != nil {
+		f.Close()
+		return err
+	}
+	if err = f.Close(); err != nil {
+		return err
+	}
+	if err = os.Chmod(f.Name(), 0644); err != nil {
+		return err
+	}
+	return os.Rename(f.Name(), path)
+}
+
+func (ct *ContentTest) manifestPath() string {
+	return filepath.Join(ct.WorkingDir, ct.OutputPrefix+".manifest")
+}
+
+func (ct *ContentTest) loadManifest() *Manifest {
+	manifest, err := LoadManifest(ct.manifestPath())
+	if err != nil {
+		log.Printf("nrt: Error loading manifest `%s`: %v",
+			ct.manifestPath(), err)
+		os.Exit(1)
+	}
+	return manifest
+}
+
+func (ct *ContentTest) label() string {
+	if ct.Parameters.Label == nil {
+		return ""
+	}
+	return *ct.Parameters.Label
+}
+
+// updateManifest records the progress of the test, if it has a manifest.
+func (ct *ContentTest) updateManifest(status ManifestStatus, outputPath string,
+	iterations int) error {
+	if ct.Manifest == nil {
+		return nil
+	}
+	output, err := filepath.Rel(filepath.Dir(ct.Manifest.path), outputPath)
+	if err != nil {
+		return err
+	}
+	return ct.Manifest.Update(ManifestEntry{
+		Label:      ct.label(),
+		Status:     status,
+		Iterations: iterations,
+		Output:     output,
+	})
+}
@@ -0,0 +1,401 @@
+package nrt
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"math"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"unicode"
+
+	"github.com/jdkato/prose/v2"
+	"github.com/wbrown/gpt_bpe"
+	novelai_api "github.com/wbrown/novelai-research-tool/novelai-api"
+)
+
+//
+// MetricsReporter - measures the diversity, looping and leaks of each
+//                   iteration, and totals them per permutation label.
+//
+
+// repeatedNgramSize is the length of the word n-grams counted as repeats.
+const repeatedNgramSize = 4
+const selfBLEUMaxN = 4
+const endOfText = "<|endoftext|>"
+
+type TextMetrics struct {
+	// Distinct1 and Distinct2 are the unique word unigrams and bigrams in the
+	// iteration's result, over the total.
+	Distinct1 float64 `json:"distinct_1"`
+	Distinct2 float64 `json:"distinct_2"`
+	// SelfBLEU is the mean BLEU of each generation against the iteration's
+	// other generations; higher means less diverse.
+	SelfBLEU float64 `json:"self_bleu"`
+	// RepeatedNgramRate is the fraction of word 4-grams in the result that
+	// already appeared earlier in it.
+	RepeatedNgramRate float64 `json:"repeated_ngram_rate"`
+	// SentenceLength is the mean number of words per sentence.
+	SentenceLength float64 `json:"sentence_length"`
+	Generations    int     `json:"generations"`
+	// BracketLeaks, EndOfTextLeaks and MaxLengthHits count the generations
+	// containing a bracket token banned by `ban_brackets`, containing
+	// `<|endoftext|>`, and generating all of `max_length`.
+	BracketLeaks   int `json:"bracket_leaks"`
+	EndOfTextLeaks int `json:"endoftext_leaks"`
+	MaxLengthHits  int `json:"max_length_hits"`
+}
+
+// words splits `text` into lowercase words, dropping punctuation.
+func words(text string) []string {
+	return strings.FieldsFunc(strings.ToLower(text), func(r rune) bool {
+		return !unicode.IsLetter(r) && !unicode.IsDigit(r) && r != '\''
+	})
+}
+
+func ngrams(words []string, n int) (grams []string) {
+	for idx := 0; idx+n <= len(words); idx++ {
+		grams = append(grams, strings.Join(words[idx:idx+n], " "))
+	}
+	return grams
+}
+
+func distinctN(words []string, n int) float64 {
+	grams := ngrams(words, n)
+	if len(grams) == 0 {
+		return 0
+	}
+	unique := make(map[string]bool, len(grams))
+	for _, gram := range grams {
+		unique[gram] = true
+	}
+	return float64(len(unique)) / float64(len(grams))
+}
+
+func repeatedNgramRate(words []string, n int) float64 {
+	grams := ngrams(words, n)
+	if len(grams) == 0 {
+		return 0
+	}
+	seen := make(map[string]bool, len(grams))
+	repeats := 0
+	for _, gram := range grams {
+		if seen[gram] {
+			repeats++
+		}
+		seen[gram] = true
+	}
+	return float64(repeats) / float64(len(grams))
+}
+
+func countNgrams(words []string, n int) map[string]int {
+	counts := make(map[string]int)
+	for _, gram := range ngrams(words, n) {
+		counts[gram]++
+	}
+	return counts
+}
+
+// bleu scores `candidate` against `references` with up to 4-gram precisions,
+// smoothing n-grams with no matches so that short texts don't score zero.
+func bleu(candidate []string, references [][]string) float64 {
+	if len(candidate) == 0 || len(references) == 0 {
+		return 0
+	}
+	logPrecisions := 0.0
+	for n := 1; n <= selfBLEUMaxN; n++ {
+		candidateCounts := countNgrams(candidate, n)
+		maxRefCounts := make(map[string]int)
+		for _, reference := range references {
+			for gram, count := range countNgrams(reference, n) {
+				if count > maxRefCounts[gram] {
+					maxRefCounts[gram] = count
+				}
+			}
+		}
+		matches, total := 0, 0
+		for gram, count := range candidateCounts {
+			total += count
+			if refCount := maxRefCounts[gram]; refCount < count {
+				matches += refCount
+			} else {
+				matches += count
+			}
+		}
+		if total == 0 {
+			return 0
+		}
+		precision := float64(matches) / float64(total)
+		if matches == 0 {
+			precision = 0.1 / float64(total)
+		}
+		logPrecisions += math.Log(precision) / selfBLEUMaxN
+	}
+	// The brevity penalty uses the reference closest in length.
+	refLength := len(references[0])
+	for _, reference := range references[1:] {
+		if math.Abs(float64(len(reference)-len(candidate))) <
+			math.Abs(float64(refLength-len(candidate))) {
+			refLength = len(reference)
+		}
+	}
+	brevity := 1.0
+	if len(candidate) < refLength {
+		brevity = math.Exp(1 - float64(refLength)/float64(len(candidate)))
+	}
+	return brevity * math.Exp(logPrecisions)
+}
+
+// selfBLEU is the mean BLEU of each of `texts` against the others.
+func selfBLEU(texts []string) float64 {
+	if len(texts) < 2 {
+		return 0
+	}
+	tokenized := make([][]string, 0, len(texts))
+	for _, text := range texts {
+		tokenized = append(tokenized, words(text))
+	}
+	total := 0.0
+	for idx := range tokenized {
+		references := make([][]string, 0, len(tokenized)-1)
+		references = append(references, tokenized[:idx]...)
+		references = append(references, tokenized[idx+1:]...)
+		total += bleu(tokenized[idx], references)
+	}
+	return total / float64(len(tokenized))
+}
+
+func sentenceLength(text string) float64 {
+	doc, err := prose.NewDocument(text, prose.WithTagging(false),
+		prose.WithExtraction(false), prose.WithTokenization(false))
+	if err != nil {
+		return 0
+	}
+	sentences := 0
+	totalWords := 0
+	for _, sentence := range doc.Sentences() {
+		if sentenceWords := len(words(sentence.Text)); sentenceWords > 0 {
+			sentences++
+			totalWords += sentenceWords
+		}
+	}
+	if sentences == 0 {
+		return 0
+	}
+	return float64(totalWords) / float64(sentences)
+}
+
+func containsSequence(tokens gpt_bpe.Tokens, sequence []uint16) bool {
+	for start := 0; start+len(sequence) <= len(tokens); start++ {
+		found := len(sequence) > 0
+		for idx := range sequence {
+			if uint16(tokens[start+idx]) != sequence[idx] {
+				found = false
+				break
+			}
+		}
+		if found {
+			return true
+		}
+	}
+	return false
+}
+
+// MeasureIteration computes the metrics of `result`.
+func MeasureIteration(result *IterationResult) (metrics TextMetrics) {
+	resultWords := words(result.Result)
+	metrics.Distinct1 = distinctN(resultWords, 1)
+	metrics.Distinct2 = distinctN(resultWords, 2)
+	metrics.RepeatedNgramRate = repeatedNgramRate(resultWords,
+		repeatedNgramSize)
+	metrics.SentenceLength = sentenceLength(result.Result)
+	metrics.SelfBLEU = selfBLEU(result.Responses)
+	metrics.Generations = len(result.Encoded.Requests)
+	var brackets [][]uint16
+	if result.Parameters.Model != nil {
+		brackets = novelai_api.BannedBrackets(*result.Parameters.Model)
+	}
+	for _, request := range result.Encoded.Requests {
+		resp := request.Request
+		if strings.Contains(resp.Response, endOfText) {
+			metrics.EndOfTextLeaks++
+		}
+		encoded, err := base64.StdEncoding.DecodeString(resp.EncodedResponse)
+		if err != nil {
+			continue
+		}
+		tokens := *gpt_bpe.TokensFromBin(&encoded)
+		for _, sequence := range brackets {
+			if containsSequence(tokens, sequence) {
+				metrics.BracketLeaks++
+				break
+			}
+		}
+		if result.Parameters.MaxLength != nil &&
+			len(tokens) >= int(*result.Parameters.MaxLength) {
+			metrics.MaxLengthHits++
+		}
+	}
+	return metrics
+}
+
+// MetricsTable totals the metrics of every iteration in a run by
+// permutation label.
+type MetricsTable struct {
+	path   string
+	mu     sync.Mutex
+	labels map[string][]TextMetrics
+}
+
+func NewMetricsTable(path string) *MetricsTable {
+	return &MetricsTable{
+		path:   path,
+		labels: make(map[string][]TextMetrics),
+	}
+}
+
+func (table *MetricsTable) Add(label string, metrics TextMetrics) {
+	table.mu.Lock()
+	defer table.mu.Unlock()
+	table.labels[label] = append(table.labels[label], metrics)
+}
+
+// MetricsSummary is the mean of a label's iteration metrics, with the leaks
+// and `max_length` hits as a fraction of its generations.
+type MetricsSummary struct {
+	Label             string
+	Iterations        int
+	Distinct1         float64
+	Distinct2         float64
+	SelfBLEU          float64
+	RepeatedNgramRate float64
+	SentenceLength    float64
+	BracketLeakRate   float64
+	EndOfTextRate     float64
+	MaxLengthRate     float64
+}
+
+// Summaries returns the summary of each label, sorted by label.
+func (table *MetricsTable) Summaries() []MetricsSummary {
+	table.mu.Lock()
+	defer table.mu.Unlock()
+	return table.summaries()
+}
+
+func (table *MetricsTable) summaries() (summaries []MetricsSummary) {
+	for label, iterations := range table.labels {
+		summary := MetricsSummary{Label: label, Iterations: len(iterations)}
+		generations := 0
+		for _, metrics := range iterations {
+			summary.Distinct1 += metrics.Distinct1
+			summary.Distinct2 += metrics.Distinct2
+			summary.SelfBLEU += metrics.SelfBLEU
+			summary.RepeatedNgramRate += metrics.RepeatedNgramRate
+			summary.SentenceLength += metrics.SentenceLength
+			summary.BracketLeakRate += float64(metrics.BracketLeaks)
+			summary.EndOfTextRate += float64(metrics.EndOfTextLeaks)
+			summary.MaxLengthRate += float64(metrics.MaxLengthHits)
+			generations += metrics.Generations
+		}
+		n := float64(len(iterations))
+		summary.Distinct1 /= n
+		summary.Distinct2 /= n
+		summary.SelfBLEU /= n
+		summary.RepeatedNgramRate /= n
+		summary.SentenceLength /= n
+		if generations > 0 {
+			summary.BracketLeakRate /= float64(generations)
+			summary.EndOfTextRate /= float64(generations)
+			summary.MaxLengthRate /= float64(generations)
+		}
+		summaries = append(summaries, summary)
+	}
+	sort.Slice(summaries, func(i, j int) bool {
+		return summaries[i].Label < summaries[j].Label
+	})
+	return summaries
+}
+
+func (table *MetricsTable) String() string {
+	table.mu.Lock()
+	defer table.mu.Unlock()
+	return table.string()
+}
+
+func (table *MetricsTable) string() string {
+	var sb strings.Builder
+	sb.WriteString(fmt.Sprintf(
+		"%-40s %5s %6s %6s %6s %6s %7s %7s %7s %7s\n", "Label", "Iters",
+		"Dist-1", "Dist-2", "S-BLEU", "Rep-4", "SentLen", "Bracket",
+		"EOT", "MaxLen"))
+	for _, summary := range table.summaries() {
+		sb.WriteString(fmt.Sprintf(
+			"%-40.40s %5d %6.3f %6.3f %6.3f %6.3f %7.2f %7.3f %7.3f %7.3f\n",
+			summary.Label, summary.Iterations, summary.Distinct1,
+			summary.Distinct2, summary.SelfBLEU, summary.RepeatedNgramRate,
+			summary.SentenceLength, summary.BracketLeakRate,
+			summary.EndOfTextRate, summary.MaxLengthRate))
+	}
+	return sb.String()
+}
+
+// Save writes the summary table to the table's path. Iterations aren't
+// added while it is being written, so that saves made while permutations are
+// still running are consistent.
+func (table *MetricsTable) Save() error {
+	table.mu.Lock()
+	defer table.mu.Unlock()
+	return writeFileAtomic(table.path, []byte(table.string()))
+}
+
+type MetricsReporter struct {
+	label string
+	table *MetricsTable
+}
+
+func (ct ContentTest) CreateMetricsReporter() MetricsReporter {
+	return MetricsReporter{label: ct.label(), table: ct.Metrics}
+}
+
+// SerializeIteration records the metrics of a successful iteration in the
+// result, and in the table if there is one.
+func (mr *MetricsReporter) SerializeIteration(result *IterationResult) {
+	if result.Error != "" {
+		return
+	}
+	metrics := MeasureIteration(result)
+	result.Metrics = &metrics
+	if mr.table != nil {
+		mr.table.Add(mr.label, metrics)
+	}
+}
+
+// resumeMetrics adds the metrics of the first `iterations` iterations in the
+// output at `path` to the table.
+func (mr *MetricsReporter) resumeMetrics(path string, iterations int) {
+	if mr.table == nil {
+		return
+	}
+	outputBytes, err := ioutil.ReadFile(path)
+	if err != nil {
+		return
+	}
+	for _, serialized := range recoverIterations(outputBytes, iterations) {
+		var result struct {
+			Metrics *TextMetrics `json:"metrics"`
+		}
+		if err = json.Unmarshal(serialized, &result); err != nil {
+			return
+		}
+		if result.Metrics != nil {
+			mr.table.Add(mr.label, *result.Metrics)
+		}
+	}
+}
+
+func (ct *ContentTest) metricsPath() string {
+	return filepath.Join(ct.WorkingDir, ct.OutputPrefix+".metrics.txt")
+}
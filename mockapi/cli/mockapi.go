@@ -0,0 +1,40 @@
+package main
+
+import (
+	"flag"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/wbrown/novelai-research-tool/mockapi"
+)
+
+func main() {
+	addr := flag.String("addr", "127.0.0.1:8080", "address to listen on")
+	response := flag.String("response", mockapi.DefaultResponse,
+		"text returned by every generation")
+	errors := flag.String("errors", "",
+		"comma separated HTTP status codes to fail the first requests with")
+	tokenDelay := flag.Duration("token-delay", 50*time.Millisecond,
+		"delay between the tokens of a streamed generation")
+	flag.Parse()
+
+	backend := mockapi.NewBackend(mockapi.Options{
+		Response:   *response,
+		TokenDelay: *tokenDelay,
+	})
+	if *errors != "" {
+		for _, code := range strings.Split(*errors, ",") {
+			statusCode, err := strconv.Atoi(strings.TrimSpace(code))
+			if err != nil {
+				log.Fatalf("mockapi: invalid status code `%s`", code)
+			}
+			backend.QueueErrors(statusCode)
+		}
+	}
+	log.Printf("mockapi: listening on http://%s; set NAI_BACKEND to use it",
+		*addr)
+	log.Fatal(http.ListenAndServe(*addr, backend))
+}
@@ -0,0 +1,326 @@
+package mockapi
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/wbrown/gpt_bpe"
+	novelai_api "github.com/wbrown/novelai-research-tool/novelai-api"
+)
+
+//
+// Mock NovelAI backend, for exercising the client and the generation pipeline
+// without credentials or network access.
+//
+
+const DefaultAccessToken = "mock-access-token"
+const DefaultResponse = " The rain had not let up for three days, and the" +
+	" streets were rivers of mud. I pulled my coat tighter and kept walking."
+
+type Options struct {
+	// Response is the text that every generation returns, tokenized with the
+	// requested model's encoder and truncated to `max_length`.
+	Response string
+	// AccessToken is handed out by `/user/login` and required on
+	// `/ai/generate` and `/ai/generate-stream`.
+	AccessToken string
+	// TokenDelay is how long `/ai/generate-stream` waits before sending each
+	// token.
+	TokenDelay time.Duration
+}
+
+type Backend struct {
+	opts     Options
+	mu       sync.Mutex
+	errors   []int
+	requests []novelai_api.NaiGenerateMsg
+}
+
+func NewBackend(opts Options) *Backend {
+	if opts.Response == "" {
+		opts.Response = DefaultResponse
+	}
+	if opts.AccessToken == "" {
+		opts.AccessToken = DefaultAccessToken
+	}
+	return &Backend{opts: opts}
+}
+
+// Server is a Backend listening on a local `httptest` server; point
+// `NAI_BACKEND` at `Server.URL` to use it.
+type Server struct {
+	*httptest.Server
+	*Backend
+}
+
+func NewServer(opts Options) *Server {
+	backend := NewBackend(opts)
+	return &Server{
+		Server:  httptest.NewServer(backend),
+		Backend: backend,
+	}
+}
+
+// QueueErrors makes the next `len(codes)` generate requests fail
+// with the given HTTP status codes, in order.
+func (b *Backend) QueueErrors(codes ...int) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.errors = append(b.errors, codes...)
+}
+
+// Requests returns the generate requests received so far.
+func (b *Backend) Requests() []novelai_api.NaiGenerateMsg {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return append([]novelai_api.NaiGenerateMsg{}, b.requests...)
+}
+
+func (b *Backend) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		writeError(w, http.StatusMethodNotAllowed, "method not allowed")
+		return
+	}
+	switch r.URL.Path {
+	case "/user/login":
+		b.serveLogin(w, r)
+	case "/ai/generate":
+		b.serveGenerate(w, r)
+	case "/ai/generate-stream":
+		b.serveGenerateStream(w, r)
+	default:
+		writeError(w, http.StatusNotFound, "not found")
+	}
+}
+
+func writeJSON(w http.ResponseWriter, statusCode int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(statusCode)
+	json.NewEncoder(w).Encode(v)
+}
+
+func writeError(w http.ResponseWriter, statusCode int, message string) {
+	writeJSON(w, statusCode, map[string]interface{}{
+		"statusCode": statusCode,
+		"message":    message,
+	})
+}
+
+func (b *Backend) serveLogin(w http.ResponseWriter, r *http.Request) {
+	var login map[string]string
+	if err := json.NewDecoder(r.Body).Decode(&login); err != nil ||
+		login["key"] == "" {
+		writeError(w, http.StatusBadRequest, "missing access key")
+		return
+	}
+	writeJSON(w, http.StatusCreated,
+		map[string]string{"accessToken": b.opts.AccessToken})
+}
+
+// nextError pops the next queued error status code, if any.
+func (b *Backend) nextError() int {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if len(b.errors) == 0 {
+		return 0
+	}
+	code := b.errors[0]
+	b.errors = b.errors[1:]
+	return code
+}
+
+// readGenerateMsg authenticates and records a generate request, writing the
+// error response and returning false if it should fail.
+func (b *Backend) readGenerateMsg(w http.ResponseWriter, r *http.Request) (
+	msg novelai_api.NaiGenerateMsg, ok bool) {
+	if r.Header.Get("Authorization") != "Bearer "+b.opts.AccessToken {
+		writeError(w, http.StatusUnauthorized, "invalid access token")
+		return msg, false
+	}
+	body, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err.Error())
+		return msg, false
+	}
+	if err := json.Unmarshal(body, &msg); err != nil {
+		writeError(w, http.StatusBadRequest, err.Error())
+		return msg, false
+	}
+	b.mu.Lock()
+	b.requests = append(b.requests, msg)
+	b.mu.Unlock()
+	if code := b.nextError(); code != 0 {
+		writeError(w, code, http.StatusText(code))
+		return msg, false
+	}
+	return msg, true
+}
+
+func (b *Backend) serveGenerate(w http.ResponseWriter, r *http.Request) {
+	msg, ok := b.readGenerateMsg(w, r)
+	if !ok {
+		return
+	}
+	tokens := b.generate(&msg)
+	params := msg.Parameters
+	if params.NextWord != nil && *params.NextWord {
+		writeJSON(w, http.StatusCreated, b.nextWord(&msg, tokens))
+		return
+	}
+	resp := novelai_api.NaiGenerateHTTPResp{
+		Output: base64.StdEncoding.EncodeToString(*tokens.ToBin()),
+	}
+	if params.NumLogprobs != nil && *params.NumLogprobs > 0 {
+		logprobs := makeLogprobs(tokens, int(*params.NumLogprobs))
+		resp.Logprobs = &logprobs
+	}
+	writeJSON(w, http.StatusCreated, resp)
+}
+
+// serveGenerateStream sends the canned response one token per server-sent
+// event, stopping early if the client goes away.
+func (b *Backend) serveGenerateStream(w http.ResponseWriter,
+	r *http.Request) {
+	msg, ok := b.readGenerateMsg(w, r)
+	if !ok {
+		return
+	}
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		writeError(w, http.StatusInternalServerError,
+			"streaming unsupported")
+		return
+	}
+	tokens := b.generate(&msg)
+	var logprobs []novelai_api.LogprobEntry
+	if msg.Parameters.NumLogprobs != nil && *msg.Parameters.NumLogprobs > 0 {
+		logprobs = makeLogprobs(tokens, int(*msg.Parameters.NumLogprobs))
+	}
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.WriteHeader(http.StatusOK)
+	flusher.Flush()
+	for idx := range tokens {
+		select {
+		case <-r.Context().Done():
+			return
+		case <-time.After(b.opts.TokenDelay):
+		}
+		data := novelai_api.NaiStreamData{
+			Token: novelai_api.EncodeStreamToken(tokens[idx]),
+			Ptr:   idx,
+			Final: idx == len(tokens)-1,
+		}
+		if logprobs != nil {
+			data.Logprobs = &logprobs[idx]
+		}
+		encoded, _ := json.Marshal(data)
+		fmt.Fprintf(w, "event: newToken\nid: %d\ndata: %s\n\n", idx+1,
+			encoded)
+		flusher.Flush()
+	}
+}
+
+// generate returns the canned response for the request's model, truncated to
+// the request's `max_length`.
+func (b *Backend) generate(msg *novelai_api.NaiGenerateMsg) gpt_bpe.Tokens {
+	encoder := novelai_api.GetEncoderByModel(msg.Model)
+	response := b.opts.Response
+	tokens := *encoder.Encode(&response)
+	if msg.Parameters.MaxLength != nil &&
+		int(*msg.Parameters.MaxLength) < len(tokens) {
+		tokens = tokens[:*msg.Parameters.MaxLength]
+	}
+	return tokens
+}
+
+func (b *Backend) nextWord(msg *novelai_api.NaiGenerateMsg,
+	tokens gpt_bpe.Tokens) novelai_api.NextArray {
+	encoder := novelai_api.GetEncoderByModel(msg.Model)
+	next := novelai_api.NextArray{Output: make([][]interface{}, 0)}
+	for idx := range tokens {
+		token := encoder.Decode(&gpt_bpe.Tokens{tokens[idx]})
+		weight := 1.0 / float64(idx+2)
+		next.Output = append(next.Output,
+			[]interface{}{strings.TrimSpace(token), weight})
+	}
+	return next
+}
+
+// makeLogprobs fabricates a plausible `logprobs` array: the chosen token is
+// always the most likely one, followed by `numLogprobs - 1` neighbours with
+// decreasing probability.
+func makeLogprobs(tokens gpt_bpe.Tokens,
+	numLogprobs int) []novelai_api.LogprobEntry {
+	entries := make([]novelai_api.LogprobEntry, 0, len(tokens))
+	for idx := range tokens {
+		chosen := []novelai_api.Logprob{
+			makeLogprob(tokens[idx], -0.5, -0.25)}
+		before := make([]novelai_api.Logprob, 0, numLogprobs)
+		after := make([]novelai_api.Logprob, 0, numLogprobs)
+		for rank := 0; rank < numLogprobs; rank++ {
+			token := tokens[idx] + gpt_bpe.Token(rank)
+			beforeLp := -0.5 - float32(rank)
+			before = append(before, makeLogprob(token, beforeLp, beforeLp))
+			if rank < (numLogprobs+1)/2 {
+				afterLp := -0.25 - float32(rank)
+				after = append(after, makeLogprob(token, beforeLp, afterLp))
+			}
+		}
+		entries = append(entries, novelai_api.LogprobEntry{
+			Chosen: &chosen,
+			Before: &before,
+			After:  &after,
+		})
+	}
+	return entries
+}
+
+func makeLogprob(token gpt_bpe.Token, before float32,
+	after float32) novelai_api.Logprob {
+	return novelai_api.Logprob{
+		Tokens: gpt_bpe.Tokens{token},
+		Logprobs: novelai_api.LogprobPair{
+			Before: &before,
+			After:  &after,
+		},
+	}
+}
+
+// Setenv points the `NAI_*` environment variables used by
+// `novelai_api.NewNovelAiAPI` at the server, and lifts the client's rate
+// limit, returning a function that restores their previous values.
+func (s *Server) Setenv() (restore func()) {
+	vars := map[string]string{
+		"NAI_USERNAME":            "mock@example.com",
+		"NAI_PASSWORD":            "mock-password",
+		"NAI_BACKEND":             s.URL,
+		"NAI_REQUESTS_PER_SECOND": "1000",
+	}
+	previous := make(map[string]*string, len(vars))
+	for k, v := range vars {
+		if old, ok := os.LookupEnv(k); ok {
+			previous[k] = &old
+		} else {
+			previous[k] = nil
+		}
+		os.Setenv(k, v)
+	}
+	return func() {
+		for k, v := range previous {
+			if v == nil {
+				os.Unsetenv(k)
+			} else {
+				os.Setenv(k, *v)
+			}
+		}
+	}
+}
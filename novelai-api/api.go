@@ -2,6 +2,7 @@ package novelai_api
 
 import (
 	"bytes"
+	"context"
 	"encoding/base64"
 	"encoding/json"
 	"errors"
@@ -9,7 +10,6 @@ import (
 	"io/ioutil"
 	"log"
 	"net/http"
-	"os"
 	"reflect"
 	"runtime"
 	"strings"
@@ -19,14 +19,6 @@ import (
 	"github.com/wbrown/novelai-research-tool/structs"
 )
 
-func GetEncoderByModel(id string) *gpt_bpe.GPTEncoder {
-	if strings.HasPrefix(id, "krake") {
-		return &gpt_bpe.PileEncoder
-	} else {
-		return &gpt_bpe.GPT2Encoder
-	}
-}
-
 //
 // Logprob structures
 //
@@ -133,7 +125,7 @@ func (lpr *LogitProcessorRepr) toId() (LogitProcessorID, error) {
 			return lookupIdx, nil
 		}
 	}
-	return 0, errors.New(fmt.Sprintf("Logit `%s` is not valid!", lpr))
+	return 0, errors.New(fmt.Sprintf("Logit `%s` is not valid!", *lpr))
 }
 
 func (lprs *LogitProcessorReprs) toIds() (*LogitProcessorIDs, error) {
@@ -156,9 +148,9 @@ func (id *LogitProcessorID) UnmarshalJSON(buf []byte) error {
 	if err := json.Unmarshal(buf, &tmp); err != nil {
 		return err
 	}
-	if newIntId, ok := tmp.(uint16); ok {
-		logitId := interface{}(newIntId).(LogitProcessorID)
-		id = &logitId
+	if newIntId, ok := tmp.(float64); ok {
+		// Serialized `order`s, such as those in our JSON output, use IDs.
+		*id = LogitProcessorID(newIntId)
 		return nil
 	} else if repr, ok := tmp.(string); ok {
 		logitRepr := LogitProcessorRepr(repr)
@@ -203,9 +195,11 @@ func (id LogitProcessorID) String() string {
 //
 
 type NovelAiAPI struct {
-	backend string
-	keys    NaiKeys
-	client  *http.Client
+	backend  string
+	keys     NaiKeys
+	client   *http.Client
+	cassette *Cassette
+	limiter  *RateLimiter
 }
 
 type NaiGenerateHTTPResp struct {
@@ -213,7 +207,7 @@ type NaiGenerateHTTPResp struct {
 	Error      string          `json:"error"`
 	StatusCode int             `json:"statusCode"`
 	Message    string          `json:"message"`
-	Logprobs   *[]LogprobEntry `json:"logprobs""`
+	Logprobs   *[]LogprobEntry `json:"logprobs"`
 }
 
 type NextArray struct {
@@ -377,15 +371,19 @@ func NewGenerateMsg(input string) NaiGenerateMsg {
 	}
 }
 
-func generateGenRequest(encoded []byte, accessToken string,
-	backendURI string) *http.Request {
-	req, _ := http.NewRequest("POST", backendURI+"/ai/generate",
-		bytes.NewBuffer(encoded))
+func generateGenRequest(ctx context.Context, encoded []byte,
+	accessToken string, backendURI string, endpoint string) (*http.Request,
+	error) {
+	req, err := http.NewRequestWithContext(ctx, "POST",
+		backendURI+endpoint, bytes.NewBuffer(encoded))
+	if err != nil {
+		return nil, err
+	}
 	req.Header.Set("User-Agent",
 		"nrt/0.1 ("+runtime.GOOS+"; "+runtime.GOARCH+")")
 	req.Header.Set("Content-Type", "application/json")
 	req.Header.Set("Authorization", "Bearer "+accessToken)
-	return req
+	return req, nil
 }
 
 func (params *NaiGenerateParams) ResolveSamplingParams() {
@@ -400,14 +398,7 @@ func (params *NaiGenerateParams) ResolveSamplingParams() {
 }
 
 func (params NaiGenerateParams) GetScaledRepPen() float64 {
-	const oldRange = 1 - 8.0
-	const newRange = 1 - 1.525
-	if strings.HasPrefix(*params.Model, "6B") ||
-		strings.HasPrefix(*params.Model, "euterpe") {
-		scaledRepPen := ((*params.RepetitionPenalty-1)*newRange)/oldRange + 1
-		return scaledRepPen
-	}
-	return *params.RepetitionPenalty
+	return GetModel(*params.Model).ScaleRepPen(*params.RepetitionPenalty)
 }
 
 func (params *NaiGenerateParams) ResolveRepetitionParams() {
@@ -423,13 +414,15 @@ func (params *NaiGenerateParams) ResolveRepetitionParams() {
 	}
 }
 
-func (api *NovelAiAPI) naiApiGenerate(params *NaiGenerateMsg) (
-	respDecoded NaiGenerateHTTPResp) {
-
+// resolve resolves the parameters of `params` into what the backend
+// expects, before it is sent.
+func (params *NaiGenerateMsg) resolve() {
 	params.Model = *params.Parameters.Model
-	if *params.Parameters.BanBrackets {
-		newBadWords := append(BannedBrackets(params.Model),
-			*params.Parameters.BadWordsIds...)
+	if params.Parameters.BanBrackets != nil && *params.Parameters.BanBrackets {
+		newBadWords := BannedBrackets(params.Model)
+		if params.Parameters.BadWordsIds != nil {
+			newBadWords = append(newBadWords, *params.Parameters.BadWordsIds...)
+		}
 		params.Parameters.BadWordsIds = &newBadWords
 	}
 	params.Parameters.ResolveRepetitionParams()
@@ -444,137 +437,194 @@ func (api *NovelAiAPI) naiApiGenerate(params *NaiGenerateMsg) (
 	if params.Parameters.RepWhitelistIds != nil && len(*params.Parameters.RepWhitelistIds) == 0 {
 		params.Parameters.RepWhitelistIds = nil
 	}
+}
 
-	cl := http.DefaultClient
-	encoded, _ := json.Marshal(params)
-	req := generateGenRequest(encoded, api.keys.AccessToken, api.backend)
-	// Retry up to 10 times.
-	var resp *http.Response
-	doGenerate := func() (err error) {
-		resp, err = cl.Do(req)
-		if err == nil && resp.StatusCode == 201 {
-			return err
-		} else if resp != nil {
-			body, readErr := ioutil.ReadAll(resp.Body)
-			if readErr != nil {
-				log.Printf("API: Error reading HTTP body of StatusCode: %d, %s\n",
-					resp.StatusCode, readErr)
-				return readErr
-			}
-			errStr := fmt.Sprintf("API: StatusCode: %d, %v, %v\n",
-				resp.StatusCode, err, string(body))
-			log.Print(errStr)
-			return errors.New(errStr)
-		} else {
+func (api *NovelAiAPI) naiApiGenerate(ctx context.Context,
+	params *NaiGenerateMsg) (respDecoded NaiGenerateHTTPResp, err error) {
+	params.resolve()
+	encoded, err := json.Marshal(params)
+	if err != nil {
+		return respDecoded, err
+	}
+	var body []byte
+	if api.cassette != nil && api.cassette.Mode() == CassetteReplay {
+		if body, err = api.cassette.Replay(encoded); err != nil {
+			return respDecoded, err
+		}
+		return decodeGenerateResp(params, body)
+	}
+	// Retry transient failures with exponential backoff; authentication and
+	// other client errors are permanent.
+	doGenerate := func() error {
+		if err := api.limiter.Wait(ctx); err != nil {
+			return backoff.Permanent(err)
+		}
+		req, err := generateGenRequest(ctx, encoded, api.keys.AccessToken,
+			api.backend, "/ai/generate")
+		if err != nil {
+			return backoff.Permanent(err)
+		}
+		resp, err := api.client.Do(req)
+		if err != nil {
 			log.Printf("API: Error: %v\n", err)
+			if ctx.Err() != nil {
+				return backoff.Permanent(ctx.Err())
+			}
+			return err
 		}
-		return err
+		defer resp.Body.Close()
+		respBody, readErr := ioutil.ReadAll(resp.Body)
+		if readErr != nil {
+			log.Printf("API: Error reading HTTP body of StatusCode: %d, %s\n",
+				resp.StatusCode, readErr)
+			return &DecodeError{Err: readErr}
+		}
+		if resp.StatusCode == http.StatusCreated ||
+			resp.StatusCode == http.StatusOK {
+			body = respBody
+			return nil
+		}
+		log.Printf("API: StatusCode: %d, %v\n", resp.StatusCode,
+			string(respBody))
+		statusErr := errorFromStatus(resp.StatusCode, string(respBody))
+		if !isRetryable(resp.StatusCode) {
+			return backoff.Permanent(statusErr)
+		}
+		return statusErr
 	}
-	err := backoff.Retry(doGenerate, backoff.NewExponentialBackOff())
+	err = backoff.Retry(doGenerate,
+		backoff.WithContext(backoff.NewExponentialBackOff(), ctx))
 	if err != nil {
-		log.Printf("API: Error: %v", err)
-		os.Exit(1)
+		return respDecoded, err
 	}
-	body, err := ioutil.ReadAll(resp.Body)
-	if err != nil {
-		log.Printf("API: Error reading HTTP body: %s", err)
-		os.Exit(1)
+	if respDecoded, err = decodeGenerateResp(params, body); err != nil {
+		return respDecoded, err
+	}
+	if api.cassette != nil && api.cassette.Mode() == CassetteRecord {
+		if err = api.cassette.Record(encoded, body); err != nil {
+			log.Printf("API: Error recording to cassette: %v\n", err)
+		}
 	}
+	return respDecoded, nil
+}
+
+func decodeGenerateResp(params *NaiGenerateMsg, body []byte) (
+	respDecoded NaiGenerateHTTPResp, err error) {
 	if params.Parameters.NextWord == nil || *params.Parameters.NextWord == false {
-		err = json.Unmarshal(body, &respDecoded)
-		if err != nil {
-			log.Printf("API: Error unmarshaling JSON response: %s %s",
-				err, string(body))
-			fmt.Scanln()
-			os.Exit(1)
+		if err = json.Unmarshal(body, &respDecoded); err != nil {
+			return respDecoded, &DecodeError{Body: string(body), Err: err}
 		}
 		if len(respDecoded.Error) > 0 {
-			log.Printf((fmt.Sprintf("API: Server error [%d]: %s",
-				respDecoded.StatusCode, respDecoded.Error)))
-			fmt.Scanln()
+			return respDecoded, &ServerError{
+				StatusCode: respDecoded.StatusCode,
+				Message:    respDecoded.Error,
+			}
 		}
-
 	} else {
 		respDecoded.Output = string(body)
 	}
-	return respDecoded
+	return respDecoded, nil
 }
 
-func NewNovelAiAPI() NovelAiAPI {
-	auth := AuthEnv()
-	return NovelAiAPI{
-		backend: auth.Backend,
-		keys:    auth,
-		client:  http.DefaultClient,
+// NewNovelAiAPI authenticates using the `NAI_*` environment variables. If
+// `NAI_CASSETTE` is set, traffic is recorded to or replayed from that
+// cassette; replaying does not require credentials.
+func NewNovelAiAPI() (NovelAiAPI, error) {
+	cassette, err := CassetteFromEnv()
+	if err != nil {
+		return NovelAiAPI{}, err
+	} else if cassette != nil && cassette.Mode() == CassetteReplay {
+		return *NewCassetteReplayer(cassette), nil
 	}
+	auth, err := AuthEnv()
+	if err != nil {
+		return NovelAiAPI{}, err
+	}
+	return NovelAiAPI{
+		backend:  auth.Backend,
+		keys:     auth,
+		client:   http.DefaultClient,
+		cassette: cassette,
+		limiter:  NewRateLimiter(auth.RequestsPerSecond, 1),
+	}, nil
 }
 
-func (api *NovelAiAPI) GenerateWithParams(content *string,
-	params NaiGenerateParams) (resp NaiGenerateResp) {
+// SetRateLimiter replaces the limiter shared by copies of this NovelAiAPI;
+// nil disables rate limiting.
+func (api *NovelAiAPI) SetRateLimiter(limiter *RateLimiter) {
+	api.limiter = limiter
+}
+
+// UseCassette records to, or replays from, `cassette`; nil turns it off.
+func (api *NovelAiAPI) UseCassette(cassette *Cassette) {
+	api.cassette = cassette
+}
+
+func (api *NovelAiAPI) GenerateWithParams(ctx context.Context, content *string,
+	params NaiGenerateParams) (resp NaiGenerateResp, err error) {
 	if params.TrimSpaces == nil || *params.TrimSpaces == true {
 		*content = strings.TrimRight(*content, " \t")
 	}
 	encoder := GetEncoderByModel(*params.Model)
 	var val NextArray
 	encoded := encoder.Encode(content)
+	if err = params.CheckContextLength(len(*encoded)); err != nil {
+		resp.Error = err
+		return resp, err
+	}
 	encodedBytes := encoded.ToBin()
 	encodedBytes64 := base64.StdEncoding.EncodeToString(*encodedBytes)
 	resp.Request = *content
 	resp.EncodedRequest = encodedBytes64
 	msg := NewGenerateMsg(encodedBytes64)
 	msg.Parameters = params
-	apiResp := api.naiApiGenerate(&msg)
+	apiResp, err := api.naiApiGenerate(ctx, &msg)
+	if err != nil {
+		resp.Error = err
+		return resp, err
+	}
 	if params.NextWord == nil || *params.NextWord == false {
-		if binTokens, err := base64.StdEncoding.DecodeString(apiResp.Output); err != nil {
-			log.Println("ERROR:", err)
-			resp.Error = err
-		} else {
-			tokens := gpt_bpe.TokensFromBin(&binTokens)
-			/* if params.TrimResponses != nil && *params.TrimResponses == true {
-				tokens, err = api.encoder.TrimIncompleteSentence(tokens)
-			} */
-			resp.Logprobs = apiResp.Logprobs
-			resp.EncodedResponse = apiResp.Output
-			resp.Response = encoder.Decode(tokens)
+		binTokens, err := base64.StdEncoding.DecodeString(apiResp.Output)
+		if err != nil {
+			resp.Error = &DecodeError{Body: apiResp.Output, Err: err}
+			return resp, resp.Error
 		}
+		tokens := gpt_bpe.TokensFromBin(&binTokens)
+		/* if params.TrimResponses != nil && *params.TrimResponses == true {
+			tokens, err = api.encoder.TrimIncompleteSentence(tokens)
+		} */
+		resp.Logprobs = apiResp.Logprobs
+		resp.EncodedResponse = apiResp.Output
+		resp.Response = encoder.Decode(tokens)
 	}
 
 	if params.NextWord != nil && *params.NextWord == true {
 		err := json.Unmarshal([]byte(apiResp.Output), &val)
 		if err != nil {
-			log.Printf("API: Error unmarshaling JSON NextWord response: %s %s",
-				err, apiResp.Output)
-			fmt.Scanln()
-			os.Exit(1)
+			resp.Error = &DecodeError{Body: apiResp.Output, Err: err}
+			return resp, resp.Error
 		}
 
 		//decode next_word array
-		nextArrayDecode := map[string]interface{}{}
-
-		err = json.Unmarshal([]byte(apiResp.Output), &nextArrayDecode)
-		if err != nil {
-			fmt.Println(err)
-		}
-		get_keys := nextArrayDecode["output"]
-		get_array := reflect.ValueOf(get_keys)
-		//filter them into the NextWordArray
-		for i := 0; i < get_array.Len(); i++ {
-			getEntry := get_array.Index(i).Interface()
-			next_ := reflect.ValueOf(getEntry)
-			nextValueToken := next_.Index(0).Interface()
-			nextValueWeight := next_.Index(1).Interface()
-
+		for i := 0; i < len(val.Output) && i < len(resp.NextWordArray); i++ {
+			if len(val.Output[i]) < 2 {
+				resp.Error = &DecodeError{Body: apiResp.Output,
+					Err: errors.New("malformed next_word entry")}
+				return resp, resp.Error
+			}
 			//add to array
-			(resp.NextWordArray)[i][0] = fmt.Sprintf("%v", nextValueToken)
-			(resp.NextWordArray)[i][1] = fmt.Sprintf("%v", nextValueWeight)
+			(resp.NextWordArray)[i][0] = fmt.Sprintf("%v", val.Output[i][0])
+			(resp.NextWordArray)[i][1] = fmt.Sprintf("%v", val.Output[i][1])
 
 			resp.NextWordReturned++
 		}
 	}
-	return resp
+	return resp, nil
 }
 
-func (api *NovelAiAPI) Generate(content string) (decoded string) {
+func (api *NovelAiAPI) Generate(ctx context.Context, content string) (
+	decoded string, err error) {
 	defaultParams := NewGenerateParams()
-	return api.GenerateWithParams(&content, defaultParams).Response
+	resp, err := api.GenerateWithParams(ctx, &content, defaultParams)
+	return resp.Response, err
 }
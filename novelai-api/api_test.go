@@ -1,6 +1,9 @@
 package novelai_api
 
-import "testing"
+import (
+	"encoding/json"
+	"testing"
+)
 
 type RepPenTest struct {
 	input  float64
@@ -24,3 +27,19 @@ func TestNaiGenerateMsg_GetScaledRepPen(t *testing.T) {
 		}
 	}
 }
+
+func TestLogitProcessorIDs_UnmarshalJSON(t *testing.T) {
+	var byName, byID LogitProcessorIDs
+	if err := json.Unmarshal([]byte(`["Top_P", "Temperature"]`),
+		&byName); err != nil {
+		t.Fatal(err)
+	}
+	serialized, _ := json.Marshal(byName)
+	if err := json.Unmarshal(serialized, &byID); err != nil {
+		t.Fatalf("serialized order %s did not round trip: %v", serialized,
+			err)
+	}
+	if len(byID) != 2 || byID[0] != TopP || byID[1] != Temperature {
+		t.Errorf("expected [Top_P, Temperature], got %v", byID)
+	}
+}
@@ -11,22 +11,23 @@ import (
 	"io/ioutil"
 	"log"
 	"net/http"
-	"os"
 	"runtime"
 	"strings"
 )
 
 type AuthConfig struct {
-	Username   string `envconfig:"NAI_USERNAME"`
-	Password   string `envconfig:"NAI_PASSWORD"`
-	BackendURI string `envconfig:"NAI_BACKEND"`
+	Username          string  `envconfig:"NAI_USERNAME"`
+	Password          string  `envconfig:"NAI_PASSWORD"`
+	BackendURI        string  `envconfig:"NAI_BACKEND"`
+	RequestsPerSecond float64 `envconfig:"NAI_REQUESTS_PER_SECOND" default:"0.9"`
 }
 
 type NaiKeys struct {
-	EncryptionKey []byte
-	AccessKey     string
-	AccessToken   string
-	Backend       string
+	EncryptionKey     []byte
+	AccessKey         string
+	AccessToken       string
+	Backend           string
+	RequestsPerSecond float64
 }
 
 func getAccessToken(access_key string, backendURI string) (accessToken string) {
@@ -119,28 +120,28 @@ func Auth(email string, password string, backendURI string) (keys NaiKeys) {
 	return keys
 }
 
-func AuthEnv() NaiKeys {
+// AuthEnv authenticates with the credentials in the `NAI_*` environment
+// variables, returning an AuthError if they are missing or rejected.
+func AuthEnv() (auth NaiKeys, err error) {
 	var authCfg AuthConfig
-	err := envconfig.Process("", &authCfg)
-	if err != nil {
-		log.Printf("auth: Error processing environment: %v", err)
-		os.Exit(1)
+	if err = envconfig.Process("", &authCfg); err != nil {
+		return auth, fmt.Errorf("auth: error processing environment: %v",
+			err)
 	}
 	if len(authCfg.Username) == 0 || len(authCfg.Password) == 0 {
-		fmt.Fprintf(os.Stderr, "ERROR: %s\n",
-			"Please ensure that NAI_USERNAME and NAI_PASSWORD are set in your environment.")
-		os.Exit(1)
+		return auth, &AuthError{Message: "please ensure that NAI_USERNAME " +
+			"and NAI_PASSWORD are set in your environment"}
 	}
 	if len(authCfg.BackendURI) == 0 {
 		authCfg.BackendURI = "https://api.novelai.net"
 	} else {
 		authCfg.BackendURI = strings.TrimSuffix(authCfg.BackendURI, "/")
 	}
-	auth := Auth(authCfg.Username, authCfg.Password, authCfg.BackendURI)
+	auth = Auth(authCfg.Username, authCfg.Password, authCfg.BackendURI)
 	auth.Backend = authCfg.BackendURI
+	auth.RequestsPerSecond = authCfg.RequestsPerSecond
 	if len(auth.AccessToken) == 0 {
-		log.Printf("auth: failed to obtain AccessToken!")
-		os.Exit(1)
+		return auth, &AuthError{Message: "failed to obtain an access token"}
 	}
-	return auth
+	return auth, nil
 }
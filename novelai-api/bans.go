@@ -458,16 +458,6 @@ var BracketTokens = map[string][][]uint16{"gpt2": {
 	{50260}, //⁂
 }}
 
-var modelTokenizerMap = map[string]string{
-	"6Bv4":       "gpt2",
-	"euterpe-v2": "gpt2",
-	"krake-v1":   "pile",
-}
-
 func BannedBrackets(model string) [][]uint16 {
-	tokenizerMapping, exist := modelTokenizerMap[model]
-	if !exist {
-		tokenizerMapping = "gpt2"
-	}
-	return BracketTokens[tokenizerMapping]
+	return BracketTokens[GetModel(model).BracketBans]
 }
\ No newline at end of file
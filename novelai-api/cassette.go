@@ -0,0 +1,186 @@
+package novelai_api
+
+import (
+	"bufio"
+	"crypto/sha256"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"sync"
+
+	"github.com/kelseyhightower/envconfig"
+)
+
+//
+// Cassettes record `/ai/generate` traffic so that it can be replayed later
+// without network access or API quota.
+//
+
+type CassetteMode string
+
+const (
+	CassetteRecord CassetteMode = "record"
+	CassetteReplay CassetteMode = "replay"
+)
+
+type CassetteConfig struct {
+	Path string       `envconfig:"NAI_CASSETTE"`
+	Mode CassetteMode `envconfig:"NAI_CASSETTE_MODE"`
+}
+
+// CassetteInteraction is a single request and response pair; a cassette file
+// holds one JSON serialized interaction per line.
+type CassetteInteraction struct {
+	Key      string          `json:"key"`
+	Request  json.RawMessage `json:"request"`
+	Response json.RawMessage `json:"response"`
+}
+
+type Cassette struct {
+	path         string
+	mode         CassetteMode
+	mu           sync.Mutex
+	interactions map[string][]CassetteInteraction
+	cursors      map[string]int
+}
+
+// CassetteMissError is returned in replay mode when the cassette has no
+// (further) response recorded for a request.
+type CassetteMissError struct {
+	Key string
+}
+
+func (e *CassetteMissError) Error() string {
+	return fmt.Sprintf("cassette: no recorded response for request %s", e.Key)
+}
+
+// cassetteKey identifies a request by its encoded input and parameters.
+func cassetteKey(encodedMsg []byte) string {
+	return fmt.Sprintf("%x", sha256.Sum256(encodedMsg))
+}
+
+// LoadCassette opens the cassette at `path`. In record mode, new interactions
+// are appended to any that already exist; in replay mode, the file must
+// exist.
+func LoadCassette(path string, mode CassetteMode) (*Cassette, error) {
+	if mode != CassetteRecord && mode != CassetteReplay {
+		return nil, fmt.Errorf("cassette: unknown mode `%s`", mode)
+	}
+	cassette := &Cassette{
+		path:         path,
+		mode:         mode,
+		interactions: make(map[string][]CassetteInteraction),
+		cursors:      make(map[string]int),
+	}
+	f, err := os.Open(path)
+	if os.IsNotExist(err) && mode == CassetteRecord {
+		return cassette, nil
+	} else if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	scanner := bufio.NewScanner(f)
+	scanner.Buffer(make([]byte, 64*1024), 64*1024*1024)
+	for lineNum := 1; scanner.Scan(); lineNum++ {
+		if len(scanner.Bytes()) == 0 {
+			continue
+		}
+		var interaction CassetteInteraction
+		if err := json.Unmarshal(scanner.Bytes(), &interaction); err != nil {
+			return nil, fmt.Errorf("cassette: %s:%d: %v", path, lineNum, err)
+		}
+		cassette.interactions[interaction.Key] = append(
+			cassette.interactions[interaction.Key], interaction)
+	}
+	return cassette, scanner.Err()
+}
+
+// CassetteFromEnv loads the cassette configured by `NAI_CASSETTE` and
+// `NAI_CASSETTE_MODE`, returning nil if none is configured.
+func CassetteFromEnv() (*Cassette, error) {
+	var cfg CassetteConfig
+	if err := envconfig.Process("", &cfg); err != nil {
+		return nil, fmt.Errorf("cassette: error processing environment: %v",
+			err)
+	}
+	if cfg.Path == "" {
+		return nil, nil
+	}
+	if cfg.Mode == "" {
+		cfg.Mode = CassetteReplay
+	}
+	cassette, err := LoadCassette(cfg.Path, cfg.Mode)
+	if err != nil {
+		return nil, fmt.Errorf("cassette: error loading `%s`: %v", cfg.Path,
+			err)
+	}
+	return cassette, nil
+}
+
+func (cassette *Cassette) Mode() CassetteMode {
+	return cassette.mode
+}
+
+// Len returns the number of interactions on the cassette.
+func (cassette *Cassette) Len() (count int) {
+	cassette.mu.Lock()
+	defer cassette.mu.Unlock()
+	for _, interactions := range cassette.interactions {
+		count += len(interactions)
+	}
+	return count
+}
+
+// Replay returns the next recorded response body for `encodedMsg`. Identical
+// requests are answered with their recorded responses in recording order.
+func (cassette *Cassette) Replay(encodedMsg []byte) ([]byte, error) {
+	key := cassetteKey(encodedMsg)
+	cassette.mu.Lock()
+	defer cassette.mu.Unlock()
+	cursor := cassette.cursors[key]
+	if cursor >= len(cassette.interactions[key]) {
+		return nil, &CassetteMissError{Key: key}
+	}
+	cassette.cursors[key] = cursor + 1
+	return cassette.interactions[key][cursor].Response, nil
+}
+
+// Record appends the request and response body pair to the cassette file.
+func (cassette *Cassette) Record(encodedMsg []byte, body []byte) error {
+	interaction := CassetteInteraction{
+		Key:      cassetteKey(encodedMsg),
+		Request:  encodedMsg,
+		Response: body,
+	}
+	if !json.Valid(body) {
+		return fmt.Errorf("cassette: response is not JSON: %s", body)
+	}
+	serialized, err := json.Marshal(interaction)
+	if err != nil {
+		return err
+	}
+	cassette.mu.Lock()
+	defer cassette.mu.Unlock()
+	f, err := os.OpenFile(cassette.path,
+		os.O_APPEND|os.O_WRONLY|os.O_CREATE, 0644)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	if _, err = f.Write(append(serialized, '\n')); err != nil {
+		return err
+	}
+	cassette.interactions[interaction.Key] = append(
+		cassette.interactions[interaction.Key], interaction)
+	return nil
+}
+
+// NewCassetteReplayer returns a Generator that serves every request from
+// `cassette`, without credentials or network access.
+func NewCassetteReplayer(cassette *Cassette) *NovelAiAPI {
+	return &NovelAiAPI{
+		client:   http.DefaultClient,
+		cassette: cassette,
+	}
+}
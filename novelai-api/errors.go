@@ -0,0 +1,76 @@
+package novelai_api
+
+import (
+	"fmt"
+	"net/http"
+)
+
+//
+// Typed errors returned by the NovelAI API client
+//
+
+// AuthError is returned when the backend rejects our credentials or access
+// token.
+type AuthError struct {
+	StatusCode int
+	Message    string
+}
+
+func (e *AuthError) Error() string {
+	return fmt.Sprintf("API: authentication failed [%d]: %s",
+		e.StatusCode, e.Message)
+}
+
+// RateLimitError is returned when the backend keeps refusing requests with
+// `429 Too Many Requests` after we've exhausted our retries.
+type RateLimitError struct {
+	Message string
+}
+
+func (e *RateLimitError) Error() string {
+	return fmt.Sprintf("API: rate limited: %s", e.Message)
+}
+
+// ServerError is returned for any other non-successful response, including
+// errors reported in the body of an otherwise successful response.
+type ServerError struct {
+	StatusCode int
+	Message    string
+}
+
+func (e *ServerError) Error() string {
+	return fmt.Sprintf("API: server error [%d]: %s", e.StatusCode, e.Message)
+}
+
+// DecodeError is returned when the response body cannot be read or decoded.
+type DecodeError struct {
+	Body string
+	Err  error
+}
+
+func (e *DecodeError) Error() string {
+	return fmt.Sprintf("API: error decoding response: %v %s", e.Err, e.Body)
+}
+
+func (e *DecodeError) Unwrap() error {
+	return e.Err
+}
+
+// errorFromStatus maps an unsuccessful HTTP status code to a typed error.
+func errorFromStatus(statusCode int, message string) error {
+	switch statusCode {
+	case http.StatusUnauthorized, http.StatusForbidden:
+		return &AuthError{StatusCode: statusCode, Message: message}
+	case http.StatusTooManyRequests:
+		return &RateLimitError{Message: message}
+	default:
+		return &ServerError{StatusCode: statusCode, Message: message}
+	}
+}
+
+// isRetryable reports whether a request that failed with `statusCode` is
+// worth retrying.
+func isRetryable(statusCode int) bool {
+	return statusCode == http.StatusTooManyRequests ||
+		statusCode >= http.StatusInternalServerError
+}
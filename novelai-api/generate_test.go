@@ -0,0 +1,294 @@
+package novelai_api_test
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/wbrown/novelai-research-tool/mockapi"
+	novelai_api "github.com/wbrown/novelai-research-tool/novelai-api"
+)
+
+func newMockAPI(t *testing.T) (*mockapi.Server, novelai_api.NovelAiAPI) {
+	server := mockapi.NewServer(mockapi.Options{})
+	restore := server.Setenv()
+	t.Cleanup(func() {
+		restore()
+		server.Close()
+	})
+	api, err := novelai_api.NewNovelAiAPI()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return server, api
+}
+
+func TestNewNovelAiAPI_MissingCredentials(t *testing.T) {
+	for _, name := range []string{"NAI_USERNAME", "NAI_PASSWORD",
+		"NAI_CASSETTE"} {
+		if value, ok := os.LookupEnv(name); ok {
+			defer os.Setenv(name, value)
+			os.Unsetenv(name)
+		}
+	}
+	_, err := novelai_api.NewNovelAiAPI()
+	var authErr *novelai_api.AuthError
+	if !errors.As(err, &authErr) {
+		t.Errorf("expected AuthError, got %v", err)
+	}
+}
+
+func TestNovelAiAPI_GenerateWithParams(t *testing.T) {
+	server, api := newMockAPI(t)
+	params := novelai_api.NewGenerateParams()
+	maxLength := uint(10)
+	params.MaxLength = &maxLength
+	content := "It was a dark and stormy night."
+	resp, err := api.GenerateWithParams(context.Background(), &content, params)
+	if err != nil {
+		t.Fatalf("GenerateWithParams: %v", err)
+	}
+	if len(resp.Response) == 0 ||
+		!strings.HasPrefix(mockapi.DefaultResponse, resp.Response) {
+		t.Errorf("unexpected response: %q", resp.Response)
+	}
+	if resp.Logprobs == nil || len(*resp.Logprobs) != int(maxLength) {
+		t.Errorf("expected %d logprob entries, got %v", maxLength,
+			resp.Logprobs)
+	}
+	if len(server.Requests()) != 1 {
+		t.Errorf("expected 1 request, got %d", len(server.Requests()))
+	}
+}
+
+func TestNovelAiAPI_GenerateWithParams_NextWord(t *testing.T) {
+	_, api := newMockAPI(t)
+	params := novelai_api.NewGenerateParams()
+	nextWord := true
+	maxLength := uint(3)
+	params.NextWord = &nextWord
+	params.MaxLength = &maxLength
+	content := "It was a dark and stormy night."
+	resp, err := api.GenerateWithParams(context.Background(), &content, params)
+	if err != nil {
+		t.Fatalf("GenerateWithParams: %v", err)
+	}
+	if resp.NextWordReturned != int(maxLength) {
+		t.Errorf("expected %d next words, got %d", maxLength,
+			resp.NextWordReturned)
+	}
+}
+
+func TestNovelAiAPI_GenerateWithParams_Errors(t *testing.T) {
+	server, api := newMockAPI(t)
+	params := novelai_api.NewGenerateParams()
+	content := "It was a dark and stormy night."
+
+	// Transient errors are retried.
+	server.QueueErrors(http.StatusTooManyRequests,
+		http.StatusInternalServerError)
+	if _, err := api.GenerateWithParams(context.Background(), &content,
+		params); err != nil {
+		t.Errorf("expected transient errors to be retried, got %v", err)
+	}
+
+	server.QueueErrors(http.StatusUnauthorized)
+	_, err := api.GenerateWithParams(context.Background(), &content, params)
+	var authErr *novelai_api.AuthError
+	if !errors.As(err, &authErr) {
+		t.Errorf("expected AuthError, got %v", err)
+	}
+
+	server.QueueErrors(http.StatusBadRequest)
+	_, err = api.GenerateWithParams(context.Background(), &content, params)
+	var serverErr *novelai_api.ServerError
+	if !errors.As(err, &serverErr) ||
+		serverErr.StatusCode != http.StatusBadRequest {
+		t.Errorf("expected ServerError with status 400, got %v", err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if _, err = api.GenerateWithParams(ctx, &content,
+		params); !errors.Is(err, context.Canceled) {
+		t.Errorf("expected context.Canceled, got %v", err)
+	}
+}
+
+func TestNovelAiAPI_GenerateStream(t *testing.T) {
+	server, api := newMockAPI(t)
+	params := novelai_api.NewGenerateParams()
+	maxLength := uint(10)
+	params.MaxLength = &maxLength
+	content := "It was a dark and stormy night."
+	events, err := api.GenerateStream(context.Background(), &content, params,
+		nil)
+	if err != nil {
+		t.Fatalf("GenerateStream: %v", err)
+	}
+	var streamed []string
+	response, err := novelai_api.CollectStream(events, func(text string) {
+		streamed = append(streamed, text)
+	})
+	if err != nil {
+		t.Fatalf("CollectStream: %v", err)
+	}
+	if len(streamed) == 0 || len(streamed) > int(maxLength) ||
+		!strings.HasPrefix(mockapi.DefaultResponse, response) {
+		t.Errorf("unexpected stream of %d events: %q", len(streamed),
+			response)
+	}
+
+	// The stream stops at the first stop sequence.
+	events, err = api.GenerateStream(context.Background(), &content,
+		novelai_api.NewGenerateParams(), []string{"days"})
+	if err != nil {
+		t.Fatalf("GenerateStream: %v", err)
+	}
+	response, err = novelai_api.CollectStream(events, nil)
+	if err != nil || !strings.HasSuffix(response, " days") {
+		t.Errorf("expected the stream to stop at `days`, got %q, %v",
+			response, err)
+	}
+	if len(server.Requests()) != 2 {
+		t.Errorf("expected 2 requests, got %d", len(server.Requests()))
+	}
+
+	server.QueueErrors(http.StatusUnauthorized)
+	_, err = api.GenerateStream(context.Background(), &content, params, nil)
+	var authErr *novelai_api.AuthError
+	if !errors.As(err, &authErr) {
+		t.Errorf("expected AuthError, got %v", err)
+	}
+}
+
+func TestNovelAiAPI_GenerateWithParams_UnknownModel(t *testing.T) {
+	_, api := newMockAPI(t)
+	params := novelai_api.NewGenerateParams()
+	model := "some-newer-model"
+	params.Model = &model
+	content := "It was a dark and stormy night."
+	if _, err := api.GenerateWithParams(context.Background(), &content,
+		params); err != nil {
+		t.Errorf("models missing from the registry should be sent: %v", err)
+	}
+}
+
+func TestNovelAiAPI_Cassette(t *testing.T) {
+	server, api := newMockAPI(t)
+	cassettePath := filepath.Join(t.TempDir(), "generate.cassette")
+	cassette, err := novelai_api.LoadCassette(cassettePath,
+		novelai_api.CassetteRecord)
+	if err != nil {
+		t.Fatal(err)
+	}
+	api.UseCassette(cassette)
+	params := novelai_api.NewGenerateParams()
+	prompts := []string{"It was a dark and stormy night.",
+		"The ship sailed at dawn.", "It was a dark and stormy night."}
+	recorded := make([]novelai_api.NaiGenerateResp, 0)
+	for idx := range prompts {
+		resp, err := api.GenerateWithParams(context.Background(),
+			&prompts[idx], params)
+		if err != nil {
+			t.Fatalf("GenerateWithParams: %v", err)
+		}
+		recorded = append(recorded, resp)
+	}
+	server.Close()
+
+	// Replaying needs neither credentials nor a backend.
+	os.Setenv("NAI_CASSETTE", cassettePath)
+	os.Setenv("NAI_CASSETTE_MODE", string(novelai_api.CassetteReplay))
+	os.Unsetenv("NAI_USERNAME")
+	defer os.Unsetenv("NAI_CASSETTE")
+	defer os.Unsetenv("NAI_CASSETTE_MODE")
+	replayAPI, err := novelai_api.NewNovelAiAPI()
+	if err != nil {
+		t.Fatalf("replaying should not need credentials: %v", err)
+	}
+	for idx := range prompts {
+		resp, err := replayAPI.GenerateWithParams(context.Background(),
+			&prompts[idx], params)
+		if err != nil {
+			t.Fatalf("replay: %v", err)
+		}
+		if resp.EncodedResponse != recorded[idx].EncodedResponse ||
+			resp.Response != recorded[idx].Response {
+			t.Errorf("replayed response %d differs: %q != %q", idx,
+				resp.Response, recorded[idx].Response)
+		}
+	}
+	// The cassette only holds two responses for the repeated prompt.
+	_, err = replayAPI.GenerateWithParams(context.Background(), &prompts[0],
+		params)
+	var missErr *novelai_api.CassetteMissError
+	if !errors.As(err, &missErr) {
+		t.Errorf("expected CassetteMissError, got %v", err)
+	}
+}
+
+func TestGenerateOrStream_Cassette(t *testing.T) {
+	_, api := newMockAPI(t)
+	params := novelai_api.NewGenerateParams()
+	content := "It was a dark and stormy night."
+	streamedText := ""
+	resp, streamed, err := novelai_api.GenerateOrStream(context.Background(),
+		&api, &content, params, func(text string) { streamedText += text })
+	if err != nil {
+		t.Fatalf("GenerateOrStream: %v", err)
+	}
+	if !streamed || streamedText != resp.Response {
+		t.Errorf("expected the response to be streamed, got %q of %q",
+			streamedText, resp.Response)
+	}
+	generated, err := api.GenerateWithParams(context.Background(), &content,
+		params)
+	if err != nil {
+		t.Fatalf("GenerateWithParams: %v", err)
+	}
+	if resp.EncodedRequest != generated.EncodedRequest ||
+		resp.EncodedResponse != generated.EncodedResponse {
+		t.Errorf("the streamed response should be encoded like a generated one")
+	}
+	if resp.Logprobs == nil || generated.Logprobs == nil ||
+		len(*resp.Logprobs) != len(*generated.Logprobs) {
+		t.Errorf("expected the logprobs of each streamed token, got %v",
+			resp.Logprobs)
+	}
+
+	cassettePath := filepath.Join(t.TempDir(), "generate.cassette")
+	cassette, err := novelai_api.LoadCassette(cassettePath,
+		novelai_api.CassetteRecord)
+	if err != nil {
+		t.Fatal(err)
+	}
+	api.UseCassette(cassette)
+	recorded, streamed, err := novelai_api.GenerateOrStream(
+		context.Background(), &api, &content, params, nil)
+	if err != nil || streamed {
+		t.Fatalf("expected recording to fall back to generating, got "+
+			"streamed %v, %v", streamed, err)
+	}
+
+	replayCassette, err := novelai_api.LoadCassette(cassettePath,
+		novelai_api.CassetteReplay)
+	if err != nil {
+		t.Fatal(err)
+	}
+	replayer := novelai_api.NewCassetteReplayer(replayCassette)
+	replayed, streamed, err := novelai_api.GenerateOrStream(
+		context.Background(), replayer, &content, params, nil)
+	if err != nil || streamed {
+		t.Fatalf("expected replaying to fall back to generating, got "+
+			"streamed %v, %v", streamed, err)
+	}
+	if replayed.Response != recorded.Response {
+		t.Errorf("replayed response differs: %q != %q", replayed.Response,
+			recorded.Response)
+	}
+}
@@ -0,0 +1,142 @@
+package novelai_api
+
+import (
+	"context"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"hash/fnv"
+	"strings"
+
+	"github.com/kelseyhightower/envconfig"
+	"github.com/wbrown/gpt_bpe"
+)
+
+// Generator is a backend that can continue a context with the given
+// parameters, returning the generated tokens and their logprobs in a
+// NaiGenerateResp. NovelAiAPI is the canonical implementation.
+type Generator interface {
+	GenerateWithParams(ctx context.Context, content *string,
+		params NaiGenerateParams) (NaiGenerateResp, error)
+}
+
+// StreamGenerator is a Generator that can also send tokens as they are
+// generated; see NovelAiAPI.GenerateStream.
+type StreamGenerator interface {
+	Generator
+	GenerateStream(ctx context.Context, content *string,
+		params NaiGenerateParams, stopSequences []string) (<-chan StreamEvent,
+		error)
+}
+
+type GeneratorConfig struct {
+	Backend           string  `envconfig:"NRT_GENERATOR" default:"novelai"`
+	URL               string  `envconfig:"NRT_GENERATOR_URL"`
+	Model             string  `envconfig:"NRT_GENERATOR_MODEL"`
+	APIKey            string  `envconfig:"NRT_GENERATOR_KEY"`
+	RequestsPerSecond float64 `envconfig:"NRT_GENERATOR_REQUESTS_PER_SECOND"`
+}
+
+// NewGeneratorFromEnv returns the Generator selected by `NRT_GENERATOR`:
+//   - `novelai` - the NovelAI API, configured by the `NAI_*` variables.
+//   - `openai` - an OpenAI compatible completions server at
+//     `NRT_GENERATOR_URL`, such as KoboldAI or a local inference server.
+//   - `fake` - a deterministic generator that needs no backend at all.
+func NewGeneratorFromEnv() (Generator, error) {
+	var cfg GeneratorConfig
+	if err := envconfig.Process("", &cfg); err != nil {
+		return nil, fmt.Errorf("generator: error processing environment: %v",
+			err)
+	}
+	switch strings.ToLower(cfg.Backend) {
+	case "novelai":
+		api, err := NewNovelAiAPI()
+		if err != nil {
+			return nil, err
+		}
+		return &api, nil
+	case "openai":
+		if cfg.URL == "" {
+			return nil, errors.New(
+				"generator: NRT_GENERATOR_URL must be set for `openai`")
+		}
+		gen := NewOpenAIGenerator(cfg.URL, cfg.Model, cfg.APIKey)
+		gen.SetRateLimiter(NewRateLimiter(cfg.RequestsPerSecond, 1))
+		return gen, nil
+	case "fake":
+		return NewFakeGenerator(), nil
+	default:
+		return nil, fmt.Errorf("generator: unknown NRT_GENERATOR `%s`",
+			cfg.Backend)
+	}
+}
+
+// encodeResponse fills in the request and response fields of `resp` that
+// every Generator returns, tokenizing with the encoder for `params.Model`.
+func encodeResponse(resp *NaiGenerateResp, content string,
+	params NaiGenerateParams, tokens *gpt_bpe.Tokens) {
+	encoder := GetEncoderByModel(*params.Model)
+	resp.Request = content
+	resp.EncodedRequest = base64.StdEncoding.EncodeToString(
+		*encoder.Encode(&content).ToBin())
+	resp.EncodedResponse = base64.StdEncoding.EncodeToString(*tokens.ToBin())
+	resp.Response = encoder.Decode(tokens)
+}
+
+//
+// FakeGenerator - a deterministic generator for tests and dry runs
+//
+
+type FakeGenerator struct {
+	Responses []string
+}
+
+var fakeResponses = []string{
+	" The wind rose in the night, rattling the shutters until dawn.",
+	" She laughed, and for a moment the room seemed warmer.",
+	" Nobody spoke. Somewhere below, a door closed softly.",
+	" He counted the coins twice before putting them away.",
+}
+
+func NewFakeGenerator(responses ...string) *FakeGenerator {
+	if len(responses) == 0 {
+		responses = fakeResponses
+	}
+	return &FakeGenerator{Responses: responses}
+}
+
+// GenerateWithParams picks a response based on a hash of `content`, so that
+// the same context always produces the same continuation.
+func (gen *FakeGenerator) GenerateWithParams(ctx context.Context,
+	content *string, params NaiGenerateParams) (resp NaiGenerateResp,
+	err error) {
+	if err = ctx.Err(); err != nil {
+		return resp, err
+	}
+	hasher := fnv.New32a()
+	hasher.Write([]byte(*content))
+	response := gen.Responses[hasher.Sum32()%uint32(len(gen.Responses))]
+	tokens := GetEncoderByModel(*params.Model).Encode(&response)
+	if params.MaxLength != nil && int(*params.MaxLength) < len(*tokens) {
+		truncated := (*tokens)[:*params.MaxLength]
+		tokens = &truncated
+	}
+	encodeResponse(&resp, *content, params, tokens)
+	if params.NumLogprobs != nil && *params.NumLogprobs > 0 {
+		logprobs := make([]LogprobEntry, 0, len(*tokens))
+		for idx := range *tokens {
+			logprob := float32(-1.0) / float32(idx+1)
+			chosen := []Logprob{{
+				Tokens:   gpt_bpe.Tokens{(*tokens)[idx]},
+				Logprobs: LogprobPair{Before: &logprob, After: &logprob},
+			}}
+			logprobs = append(logprobs, LogprobEntry{
+				Chosen: &chosen,
+				Before: &chosen,
+				After:  &chosen,
+			})
+		}
+		resp.Logprobs = &logprobs
+	}
+	return resp, nil
+}
@@ -0,0 +1,105 @@
+package novelai_api_test
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	novelai_api "github.com/wbrown/novelai-research-tool/novelai-api"
+)
+
+func TestFakeGenerator_GenerateWithParams(t *testing.T) {
+	var gen novelai_api.Generator = novelai_api.NewFakeGenerator()
+	params := novelai_api.NewGenerateParams()
+	first, second := "The ship sailed at dawn.", "The ship sailed at dawn."
+	a, err := gen.GenerateWithParams(context.Background(), &first, params)
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, _ := gen.GenerateWithParams(context.Background(), &second, params)
+	if a.Response == "" || a.Response != b.Response ||
+		a.EncodedResponse != b.EncodedResponse {
+		t.Errorf("fake generator is not deterministic: %q != %q",
+			a.Response, b.Response)
+	}
+	if a.Logprobs == nil || len(*a.Logprobs) == 0 {
+		t.Errorf("fake generator did not return logprobs")
+	}
+}
+
+func TestOpenAIGenerator_GenerateWithParams(t *testing.T) {
+	var received map[string]interface{}
+	server := httptest.NewServer(http.HandlerFunc(
+		func(w http.ResponseWriter, r *http.Request) {
+			if r.URL.Path != "/v1/completions" {
+				w.WriteHeader(http.StatusNotFound)
+				return
+			}
+			json.NewDecoder(r.Body).Decode(&received)
+			w.Write([]byte(`{"choices": [{"text": " and it rained.",
+  "logprobs": {"tokens": [" and", " it", " rained", "."],
+    "token_logprobs": [-0.5, -0.25, -1.5, -0.1],
+    "top_logprobs": [{" and": -0.5, " but": -1.0}, {" it": -0.25},
+      {" rained": -1.5, " poured": -1.75}, {".": -0.1}]}}]}`))
+		}))
+	defer server.Close()
+	var gen novelai_api.Generator = novelai_api.NewOpenAIGenerator(
+		server.URL, "local-model", "")
+	params := novelai_api.NewGenerateParams()
+	content := "It was a dark and stormy night,"
+	resp, err := gen.GenerateWithParams(context.Background(), &content,
+		params)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.Response != " and it rained." || resp.EncodedResponse == "" {
+		t.Errorf("unexpected response: %q", resp.Response)
+	}
+	if received["model"] != "local-model" || received["prompt"] != content {
+		t.Errorf("unexpected request: %v", received)
+	}
+	// 6B-v4 takes the default 3.5 scaled onto 1 to 1.525.
+	if repPen, _ := received["repetition_penalty"].(float64); repPen < 1.18 ||
+		repPen > 1.19 {
+		t.Errorf("expected a scaled repetition_penalty, got %v",
+			received["repetition_penalty"])
+	}
+	if resp.Logprobs == nil || len(*resp.Logprobs) != 4 {
+		t.Fatalf("expected 4 logprob entries, got %v", resp.Logprobs)
+	}
+	top := *(*resp.Logprobs)[2].Before
+	if len(top) != 2 || *top[0].Logprobs.Before != -1.5 {
+		t.Errorf("top logprobs not sorted by probability: %v", top)
+	}
+}
+
+func TestOpenAIGenerator_RateLimiter(t *testing.T) {
+	requests := 0
+	server := httptest.NewServer(http.HandlerFunc(
+		func(w http.ResponseWriter, r *http.Request) {
+			requests++
+			w.Write([]byte(`{"choices": [{"text": " and it rained."}]}`))
+		}))
+	defer server.Close()
+	gen := novelai_api.NewOpenAIGenerator(server.URL, "", "")
+	gen.SetRateLimiter(novelai_api.NewRateLimiter(0.001, 1))
+	params := novelai_api.NewGenerateParams()
+	content := "It was a dark and stormy night,"
+	if _, err := gen.GenerateWithParams(context.Background(), &content,
+		params); err != nil {
+		t.Fatal(err)
+	}
+	// The second request has to wait far longer than the deadline.
+	ctx, cancel := context.WithTimeout(context.Background(),
+		50*time.Millisecond)
+	defer cancel()
+	if _, err := gen.GenerateWithParams(ctx, &content, params); err == nil {
+		t.Errorf("expected the rate limited request to time out")
+	}
+	if requests != 1 {
+		t.Errorf("expected 1 request to reach the server, got %d", requests)
+	}
+}
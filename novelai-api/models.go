@@ -0,0 +1,190 @@
+package novelai_api
+
+import (
+	_ "embed"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/wbrown/gpt_bpe"
+)
+
+//
+// Model registry - what each model supports, loaded from `models.json` and
+// optionally extended by the file at `NAI_MODELS`.
+//
+
+//go:embed models.json
+var defaultModelsJSON []byte
+
+// RepPenScale linearly maps a repetition penalty from `[1, Max]` onto
+// `[1, ScaledMax]`, for models that take a smaller range than the UI offers.
+type RepPenScale struct {
+	Max       float64 `json:"max"`
+	ScaledMax float64 `json:"scaled_max"`
+}
+
+type ModelInfo struct {
+	ID        string `json:"id"`
+	Tokenizer string `json:"tokenizer"`
+	// VocabSize is the number of token IDs the model accepts.
+	VocabSize     int      `json:"vocab_size"`
+	ContextLength int      `json:"context_length"`
+	Samplers      []string `json:"samplers"`
+	// RepPenScale is nil if the model takes the repetition penalty as is.
+	RepPenScale     *RepPenScale `json:"rep_pen_scale,omitempty"`
+	SupportsModules bool         `json:"supports_modules"`
+	// BracketBans names the list in `BracketTokens` banned by `ban_brackets`.
+	BracketBans string `json:"bracket_bans"`
+}
+
+type modelsFile struct {
+	Models []ModelInfo `json:"models"`
+}
+
+// defaultModel describes models missing from the registry, such as those of
+// other backends.
+var defaultModel = ModelInfo{
+	Tokenizer:     "gpt2",
+	VocabSize:     50400,
+	ContextLength: 2048,
+	Samplers: []string{"temperature", "top_k", "top_p", "top_a",
+		"typical_p", "tail_free_sampling"},
+	BracketBans: "gpt2",
+}
+
+var encodersByTokenizer = map[string]*gpt_bpe.GPTEncoder{
+	"gpt2": &gpt_bpe.GPT2Encoder,
+	"pile": &gpt_bpe.PileEncoder,
+}
+
+var modelRegistry map[string]ModelInfo
+var modelRegistryOnce sync.Once
+
+// addModels adds the models in `modelsJSON` to `registry`, replacing any with
+// the same ID.
+func addModels(registry map[string]ModelInfo, modelsJSON []byte) error {
+	var models modelsFile
+	if err := json.Unmarshal(modelsJSON, &models); err != nil {
+		return err
+	}
+	for _, model := range models.Models {
+		if model.ID == "" {
+			return fmt.Errorf("a model has no `id`")
+		} else if _, ok := encodersByTokenizer[model.Tokenizer]; !ok {
+			return fmt.Errorf("model `%s` has unknown tokenizer `%s`",
+				model.ID, model.Tokenizer)
+		} else if _, ok := BracketTokens[model.BracketBans]; !ok {
+			return fmt.Errorf("model `%s` has unknown bracket bans `%s`",
+				model.ID, model.BracketBans)
+		}
+		registry[model.ID] = model
+	}
+	return nil
+}
+
+func loadModelRegistry() {
+	modelRegistry = make(map[string]ModelInfo)
+	if err := addModels(modelRegistry, defaultModelsJSON); err != nil {
+		log.Printf("models: Error loading built in models: %v", err)
+		os.Exit(1)
+	}
+	path := os.Getenv("NAI_MODELS")
+	if path == "" {
+		return
+	}
+	modelsJSON, err := ioutil.ReadFile(path)
+	if err == nil {
+		err = addModels(modelRegistry, modelsJSON)
+	}
+	if err != nil {
+		log.Printf("models: Error loading `%s`: %v", path, err)
+		os.Exit(1)
+	}
+}
+
+// LookupModel returns the registry entry for the model `id`.
+func LookupModel(id string) (model ModelInfo, ok bool) {
+	modelRegistryOnce.Do(loadModelRegistry)
+	model, ok = modelRegistry[id]
+	return model, ok
+}
+
+// Models returns every model in the registry.
+func Models() (models []ModelInfo) {
+	modelRegistryOnce.Do(loadModelRegistry)
+	for _, model := range modelRegistry {
+		models = append(models, model)
+	}
+	return models
+}
+
+// GetModel returns the registry entry for the model `id`. A model missing
+// from the registry takes after the first registered model of its family,
+// the part of its ID before the first `-`, so that `krake-v3` is tokenized
+// like the other `krake` models; other models fall back to a GPT-2 tokenized
+// model supporting every sampler.
+func GetModel(id string) ModelInfo {
+	if model, ok := LookupModel(id); ok {
+		return model
+	}
+	model, ok := familyModel(id)
+	if !ok {
+		model = defaultModel
+	}
+	model.ID = id
+	return model
+}
+
+// familyModel returns the registered model, by ID order, of the family of the
+// model `id`.
+func familyModel(id string) (model ModelInfo, ok bool) {
+	family := strings.SplitN(id, "-", 2)[0]
+	if family == "" {
+		return model, false
+	}
+	var ids []string
+	for _, registered := range Models() {
+		if strings.SplitN(registered.ID, "-", 2)[0] == family {
+			ids = append(ids, registered.ID)
+		}
+	}
+	if len(ids) == 0 {
+		return model, false
+	}
+	sort.Strings(ids)
+	return LookupModel(ids[0])
+}
+
+func (model ModelInfo) Encoder() *gpt_bpe.GPTEncoder {
+	return encodersByTokenizer[model.Tokenizer]
+}
+
+// SupportsSampler reports whether the model uses the sampler with the
+// parameter name `name`, such as `typical_p`.
+func (model ModelInfo) SupportsSampler(name string) bool {
+	for _, sampler := range model.Samplers {
+		if sampler == name {
+			return true
+		}
+	}
+	return false
+}
+
+func (model ModelInfo) ScaleRepPen(repPen float64) float64 {
+	if model.RepPenScale == nil {
+		return repPen
+	}
+	oldRange := 1 - model.RepPenScale.Max
+	newRange := 1 - model.RepPenScale.ScaledMax
+	return ((repPen-1)*newRange)/oldRange + 1
+}
+
+func GetEncoderByModel(id string) *gpt_bpe.GPTEncoder {
+	return GetModel(id).Encoder()
+}
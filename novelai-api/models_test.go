@@ -0,0 +1,53 @@
+package novelai_api
+
+import (
+	"testing"
+
+	"github.com/wbrown/gpt_bpe"
+)
+
+func TestLookupModel(t *testing.T) {
+	krake, ok := LookupModel("krake-v1")
+	if !ok || krake.Encoder() != &gpt_bpe.PileEncoder ||
+		krake.RepPenScale != nil {
+		t.Errorf("krake-v1 should use the Pile tokenizer and unscaled rep pen")
+	}
+	if calliope, _ := LookupModel("2.7B"); calliope.SupportsModules ||
+		calliope.SupportsSampler("typical_p") {
+		t.Errorf("2.7B should support neither modules nor typical_p")
+	}
+	if _, ok := LookupModel("nonsense"); ok {
+		t.Errorf("unknown models should not be found")
+	}
+	if GetEncoderByModel("nonsense") != &gpt_bpe.GPT2Encoder {
+		t.Errorf("unknown models should fall back to the GPT-2 tokenizer")
+	}
+	if GetEncoderByModel("krake-v3") != &gpt_bpe.PileEncoder {
+		t.Errorf("unknown models should take after their family's tokenizer")
+	}
+}
+
+func TestAddModels(t *testing.T) {
+	registry := make(map[string]ModelInfo)
+	if err := addModels(registry, defaultModelsJSON); err != nil {
+		t.Fatal(err)
+	}
+	override := []byte(`{"models": [
+  {"id": "6B-v4", "tokenizer": "pile", "context_length": 1024,
+   "bracket_bans": "pile"},
+  {"id": "new-model", "tokenizer": "gpt2", "context_length": 4096,
+   "samplers": ["temperature"], "bracket_bans": "gpt2"}
+]}`)
+	if err := addModels(registry, override); err != nil {
+		t.Fatal(err)
+	}
+	if registry["6B-v4"].ContextLength != 1024 ||
+		registry["new-model"].ContextLength != 4096 ||
+		registry["euterpe-v2"].ContextLength != 2048 {
+		t.Errorf("models were not overridden and added: %v", registry)
+	}
+	bad := []byte(`{"models": [{"id": "bad", "tokenizer": "nonsense"}]}`)
+	if err := addModels(registry, bad); err == nil {
+		t.Errorf("expected an error for an unknown tokenizer")
+	}
+}
@@ -0,0 +1,231 @@
+package novelai_api
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"runtime"
+	"sort"
+	"strings"
+
+	"github.com/cenkalti/backoff/v4"
+	"github.com/wbrown/gpt_bpe"
+)
+
+//
+// OpenAIGenerator - generates against an OpenAI compatible `/v1/completions`
+//                   endpoint, as served by KoboldAI and most local inference
+//                   servers.
+//
+
+type OpenAIGenerator struct {
+	backend string
+	model   string
+	apiKey  string
+	client  *http.Client
+	limiter *RateLimiter
+}
+
+type openAICompletionReq struct {
+	Model             string   `json:"model,omitempty"`
+	Prompt            string   `json:"prompt"`
+	MaxTokens         *uint    `json:"max_tokens,omitempty"`
+	MinTokens         *uint    `json:"min_tokens,omitempty"`
+	Temperature       *float64 `json:"temperature,omitempty"`
+	TopP              *float64 `json:"top_p,omitempty"`
+	TopK              *uint    `json:"top_k,omitempty"`
+	TopA              *float64 `json:"top_a,omitempty"`
+	TypicalP          *float64 `json:"typical_p,omitempty"`
+	TailFreeSampling  *float64 `json:"tfs,omitempty"`
+	RepetitionPenalty *float64 `json:"repetition_penalty,omitempty"`
+	FrequencyPenalty  *float64 `json:"frequency_penalty,omitempty"`
+	PresencePenalty   *float64 `json:"presence_penalty,omitempty"`
+	Logprobs          *uint    `json:"logprobs,omitempty"`
+}
+
+type openAILogprobs struct {
+	Tokens        []string             `json:"tokens"`
+	TokenLogprobs []float32            `json:"token_logprobs"`
+	TopLogprobs   []map[string]float32 `json:"top_logprobs"`
+}
+
+type openAICompletionResp struct {
+	Choices []struct {
+		Text     string          `json:"text"`
+		Logprobs *openAILogprobs `json:"logprobs"`
+	} `json:"choices"`
+	Error *struct {
+		Message string `json:"message"`
+	} `json:"error"`
+}
+
+// NewOpenAIGenerator creates a Generator for the server at `backendURI`. The
+// `model` is passed through as-is; `apiKey` may be empty for local servers.
+// Requests are not rate limited unless a limiter is set.
+func NewOpenAIGenerator(backendURI string, model string,
+	apiKey string) *OpenAIGenerator {
+	return &OpenAIGenerator{
+		backend: strings.TrimSuffix(backendURI, "/"),
+		model:   model,
+		apiKey:  apiKey,
+		client:  http.DefaultClient,
+	}
+}
+
+// SetRateLimiter replaces the limiter shared by the requests of this
+// OpenAIGenerator; nil disables rate limiting.
+func (gen *OpenAIGenerator) SetRateLimiter(limiter *RateLimiter) {
+	gen.limiter = limiter
+}
+
+func (gen *OpenAIGenerator) makeRequest(content string,
+	params NaiGenerateParams) openAICompletionReq {
+	req := openAICompletionReq{
+		Model:            gen.model,
+		Prompt:           content,
+		MaxTokens:        params.MaxLength,
+		MinTokens:        params.MinLength,
+		Temperature:      params.Temperature,
+		TopP:             params.TopP,
+		TopK:             params.TopK,
+		TopA:             params.TopA,
+		TypicalP:         params.TypicalP,
+		TailFreeSampling: params.TailFreeSampling,
+		FrequencyPenalty: params.RepetitionPenaltyFrequency,
+		PresencePenalty:  params.RepetitionPenaltyPresence,
+		Logprobs:         params.NumLogprobs,
+	}
+	// NovelAI's repetition penalty is scaled down for most models; send what
+	// the model would have been given, rather than the UI's wider range.
+	if params.RepetitionPenalty != nil && params.Model != nil {
+		repPen := GetModel(*params.Model).ScaleRepPen(
+			*params.RepetitionPenalty)
+		req.RepetitionPenalty = &repPen
+	}
+	if req.TopK != nil && *req.TopK == 0 {
+		req.TopK = nil
+	}
+	if req.Logprobs != nil && *req.Logprobs == 0 {
+		req.Logprobs = nil
+	}
+	return req
+}
+
+func (gen *OpenAIGenerator) GenerateWithParams(ctx context.Context,
+	content *string, params NaiGenerateParams) (resp NaiGenerateResp,
+	err error) {
+	if params.TrimSpaces == nil || *params.TrimSpaces == true {
+		*content = strings.TrimRight(*content, " \t")
+	}
+	encoded, err := json.Marshal(gen.makeRequest(*content, params))
+	if err != nil {
+		return resp, err
+	}
+	var body []byte
+	doGenerate := func() error {
+		if err := gen.limiter.Wait(ctx); err != nil {
+			return backoff.Permanent(err)
+		}
+		req, err := http.NewRequestWithContext(ctx, "POST",
+			gen.backend+"/v1/completions", bytes.NewBuffer(encoded))
+		if err != nil {
+			return backoff.Permanent(err)
+		}
+		req.Header.Set("User-Agent",
+			"nrt/0.1 ("+runtime.GOOS+"; "+runtime.GOARCH+")")
+		req.Header.Set("Content-Type", "application/json")
+		if gen.apiKey != "" {
+			req.Header.Set("Authorization", "Bearer "+gen.apiKey)
+		}
+		httpResp, err := gen.client.Do(req)
+		if err != nil {
+			if ctx.Err() != nil {
+				return backoff.Permanent(ctx.Err())
+			}
+			return err
+		}
+		defer httpResp.Body.Close()
+		respBody, err := ioutil.ReadAll(httpResp.Body)
+		if err != nil {
+			return &DecodeError{Err: err}
+		}
+		if httpResp.StatusCode/100 == 2 {
+			body = respBody
+			return nil
+		}
+		statusErr := errorFromStatus(httpResp.StatusCode, string(respBody))
+		if !isRetryable(httpResp.StatusCode) {
+			return backoff.Permanent(statusErr)
+		}
+		return statusErr
+	}
+	err = backoff.Retry(doGenerate,
+		backoff.WithContext(backoff.NewExponentialBackOff(), ctx))
+	if err != nil {
+		resp.Error = err
+		return resp, err
+	}
+	var completion openAICompletionResp
+	if err = json.Unmarshal(body, &completion); err != nil {
+		resp.Error = &DecodeError{Body: string(body), Err: err}
+		return resp, resp.Error
+	}
+	if completion.Error != nil {
+		resp.Error = &ServerError{Message: completion.Error.Message}
+		return resp, resp.Error
+	} else if len(completion.Choices) == 0 {
+		resp.Error = &DecodeError{Body: string(body)}
+		return resp, resp.Error
+	}
+	choice := completion.Choices[0]
+	encoder := GetEncoderByModel(*params.Model)
+	tokens := encoder.Encode(&choice.Text)
+	encodeResponse(&resp, *content, params, tokens)
+	// Keep the server's text verbatim rather than our re-tokenized rendering.
+	resp.Response = choice.Text
+	if choice.Logprobs != nil {
+		logprobs := convertOpenAILogprobs(encoder, choice.Logprobs)
+		resp.Logprobs = &logprobs
+	}
+	return resp, nil
+}
+
+// convertOpenAILogprobs maps OpenAI's per-token logprobs onto LogprobEntry.
+// The server only reports the distribution before sampling, so `before` and
+// `after` are the same.
+func convertOpenAILogprobs(encoder *gpt_bpe.GPTEncoder,
+	lps *openAILogprobs) []LogprobEntry {
+	entries := make([]LogprobEntry, 0, len(lps.Tokens))
+	for idx := range lps.Tokens {
+		if idx >= len(lps.TokenLogprobs) {
+			break
+		}
+		logprob := lps.TokenLogprobs[idx]
+		chosen := []Logprob{{
+			Tokens:   *encoder.Encode(&lps.Tokens[idx]),
+			Logprobs: LogprobPair{Before: &logprob, After: &logprob},
+		}}
+		top := make([]Logprob, 0)
+		if idx < len(lps.TopLogprobs) {
+			for token, topLogprob := range lps.TopLogprobs[idx] {
+				token, topLogprob := token, topLogprob
+				top = append(top, Logprob{
+					Tokens: *encoder.Encode(&token),
+					Logprobs: LogprobPair{Before: &topLogprob,
+						After: &topLogprob},
+				})
+			}
+			sort.Slice(top, func(i, j int) bool {
+				return *top[i].Logprobs.Before > *top[j].Logprobs.Before
+			})
+		}
+		entries = append(entries, LogprobEntry{
+			Chosen: &chosen,
+			Before: &top,
+			After:  &top,
+		})
+	}
+	return entries
+}
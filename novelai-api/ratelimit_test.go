@@ -0,0 +1,30 @@
+package novelai_api
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+func TestRateLimiter_Wait(t *testing.T) {
+	limiter := NewRateLimiter(20, 1)
+	start := time.Now()
+	for idx := 0; idx < 5; idx++ {
+		if err := limiter.Wait(context.Background()); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// The first request goes out immediately, the next four at 20/s.
+	if elapsed := time.Since(start); elapsed < 190*time.Millisecond {
+		t.Errorf("5 requests at 20/s took only %v", elapsed)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(),
+		10*time.Millisecond)
+	defer cancel()
+	slow := NewRateLimiter(0.1, 1)
+	slow.Wait(ctx)
+	if err := slow.Wait(ctx); err != context.DeadlineExceeded {
+		t.Errorf("expected DeadlineExceeded, got %v", err)
+	}
+}
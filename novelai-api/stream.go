@@ -0,0 +1,262 @@
+package novelai_api
+
+import (
+	"bufio"
+	"context"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"unicode/utf8"
+
+	"github.com/wbrown/gpt_bpe"
+)
+
+//
+// Streaming generation - `/ai/generate-stream` sends each token as a
+// server-sent event as soon as it is generated.
+//
+
+type StreamEvent struct {
+	Token gpt_bpe.Token
+	// Text is what the token adds to the response so far; a token that ends
+	// partway through a character adds nothing until a later one completes it.
+	Text     string
+	Ptr      int
+	Logprobs *LogprobEntry
+	// Final is set on the last event of a stream that ended normally, or was
+	// stopped at a stop sequence.
+	Final bool
+	// Err is set on the last event of a stream that failed.
+	Err error
+}
+
+// ErrStreamUnsupported is returned by GenerateStream when the API is
+// recording to or replaying from a cassette, which only hold whole responses.
+var ErrStreamUnsupported = errors.New("API: cassettes do not support streaming")
+
+// NaiStreamData is the `data` of each event sent by `/ai/generate-stream`.
+type NaiStreamData struct {
+	Token    string        `json:"token"`
+	Ptr      int           `json:"ptr"`
+	Final    bool          `json:"final"`
+	Logprobs *LogprobEntry `json:"logprobs,omitempty"`
+	Error    string        `json:"error,omitempty"`
+}
+
+// EncodeStreamToken encodes `token` as the `token` of a NaiStreamData.
+func EncodeStreamToken(token gpt_bpe.Token) string {
+	buf := make([]byte, 2)
+	binary.LittleEndian.PutUint16(buf, uint16(token))
+	return base64.StdEncoding.EncodeToString(buf)
+}
+
+func decodeStreamToken(encoded string) (gpt_bpe.Token, error) {
+	buf, err := base64.StdEncoding.DecodeString(encoded)
+	if err != nil {
+		return 0, err
+	} else if len(buf) != 2 {
+		return 0, fmt.Errorf("token is %d bytes, not 2", len(buf))
+	}
+	return gpt_bpe.Token(binary.LittleEndian.Uint16(buf)), nil
+}
+
+// GenerateStream starts generating a continuation of `content`, returning a
+// channel that receives each token as it arrives and is closed when the
+// stream ends. The stream is stopped early once the response contains any of
+// `stopSequences`, or when `ctx` is cancelled.
+func (api *NovelAiAPI) GenerateStream(ctx context.Context, content *string,
+	params NaiGenerateParams, stopSequences []string) (<-chan StreamEvent,
+	error) {
+	if api.cassette != nil {
+		return nil, ErrStreamUnsupported
+	}
+	if params.NextWord != nil && *params.NextWord {
+		return nil, errors.New("API: `next_word` cannot be streamed")
+	}
+	if params.TrimSpaces == nil || *params.TrimSpaces == true {
+		*content = strings.TrimRight(*content, " \t")
+	}
+	encoder := GetEncoderByModel(*params.Model)
+	encoded := encoder.Encode(content)
+	if err := params.CheckContextLength(len(*encoded)); err != nil {
+		return nil, err
+	}
+	msg := NewGenerateMsg(
+		base64.StdEncoding.EncodeToString(*encoded.ToBin()))
+	msg.Parameters = params
+	msg.resolve()
+	body, err := json.Marshal(msg)
+	if err != nil {
+		return nil, err
+	}
+	if err = api.limiter.Wait(ctx); err != nil {
+		return nil, err
+	}
+	streamCtx, cancel := context.WithCancel(ctx)
+	req, err := generateGenRequest(streamCtx, body, api.keys.AccessToken,
+		api.backend, "/ai/generate-stream")
+	if err != nil {
+		cancel()
+		return nil, err
+	}
+	req.Header.Set("Accept", "text/event-stream")
+	resp, err := api.client.Do(req)
+	if err != nil {
+		cancel()
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusOK &&
+		resp.StatusCode != http.StatusCreated {
+		respBody, _ := ioutil.ReadAll(resp.Body)
+		resp.Body.Close()
+		cancel()
+		return nil, errorFromStatus(resp.StatusCode, string(respBody))
+	}
+	events := make(chan StreamEvent)
+	go func() {
+		defer close(events)
+		defer cancel()
+		defer resp.Body.Close()
+		readStream(streamCtx, resp.Body, encoder, stopSequences, events)
+	}()
+	return events, nil
+}
+
+// readStream decodes the server-sent events in `body` onto `events`, until
+// the stream ends, fails, or reaches a stop sequence.
+func readStream(ctx context.Context, body io.Reader,
+	encoder *gpt_bpe.GPTEncoder, stopSequences []string,
+	events chan<- StreamEvent) {
+	send := func(event StreamEvent) bool {
+		select {
+		case events <- event:
+			return true
+		case <-ctx.Done():
+			return false
+		}
+	}
+	var tokens gpt_bpe.Tokens
+	var text string
+	var data []string
+	scanner := bufio.NewScanner(body)
+	for scanner.Scan() {
+		line := scanner.Text()
+		if strings.HasPrefix(line, "data:") {
+			data = append(data,
+				strings.TrimPrefix(strings.TrimPrefix(line, "data:"), " "))
+			continue
+		} else if line != "" || len(data) == 0 {
+			// Event names, IDs and comments carry nothing we need.
+			continue
+		}
+		payload := strings.Join(data, "\n")
+		data = data[:0]
+		var streamData NaiStreamData
+		if err := json.Unmarshal([]byte(payload), &streamData); err != nil {
+			send(StreamEvent{Err: &DecodeError{Body: payload, Err: err}})
+			return
+		} else if streamData.Error != "" {
+			send(StreamEvent{Err: &ServerError{Message: streamData.Error}})
+			return
+		}
+		token, err := decodeStreamToken(streamData.Token)
+		if err != nil {
+			send(StreamEvent{Err: &DecodeError{Body: payload, Err: err}})
+			return
+		}
+		event := StreamEvent{
+			Token:    token,
+			Ptr:      streamData.Ptr,
+			Logprobs: streamData.Logprobs,
+			Final:    streamData.Final,
+		}
+		tokens = append(tokens, token)
+		if decoded := encoder.Decode(&tokens); utf8.ValidString(decoded) &&
+			strings.HasPrefix(decoded, text) {
+			event.Text = decoded[len(text):]
+			text = decoded
+		}
+		for _, stop := range stopSequences {
+			if stop != "" && strings.Contains(text, stop) {
+				event.Final = true
+			}
+		}
+		if !send(event) || event.Final {
+			return
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		if ctx.Err() != nil {
+			err = ctx.Err()
+		}
+		send(StreamEvent{Err: err})
+	} else {
+		send(StreamEvent{Err: errors.New("API: stream ended unexpectedly")})
+	}
+}
+
+// CollectStream reads `events` until the stream ends, passing the text of
+// each token to `onText` as it arrives if it is not nil, and returns the
+// whole response.
+func CollectStream(events <-chan StreamEvent,
+	onText func(text string)) (response string, err error) {
+	response, _, _, err = collectStream(events, onText)
+	return response, err
+}
+
+// collectStream is CollectStream, also returning the tokens of the response
+// and the logprobs sent with them.
+func collectStream(events <-chan StreamEvent, onText func(text string)) (
+	response string, tokens gpt_bpe.Tokens, logprobs []LogprobEntry,
+	err error) {
+	var sb strings.Builder
+	for event := range events {
+		if event.Err != nil {
+			err = event.Err
+			continue
+		}
+		tokens = append(tokens, event.Token)
+		if event.Logprobs != nil {
+			logprobs = append(logprobs, *event.Logprobs)
+		}
+		sb.WriteString(event.Text)
+		if onText != nil && event.Text != "" {
+			onText(event.Text)
+		}
+	}
+	return sb.String(), tokens, logprobs, err
+}
+
+// GenerateOrStream continues `content`, streaming the response to `onText` as
+// it arrives if `gen` can stream it, and otherwise generating it whole with
+// GenerateWithParams. `streamed` reports whether `onText` was given the text;
+// either way, `resp` is filled in as GenerateWithParams would.
+func GenerateOrStream(ctx context.Context, gen Generator, content *string,
+	params NaiGenerateParams, onText func(text string)) (
+	resp NaiGenerateResp, streamed bool, err error) {
+	streamer, ok := gen.(StreamGenerator)
+	if !ok || (params.NextWord != nil && *params.NextWord) {
+		resp, err = gen.GenerateWithParams(ctx, content, params)
+		return resp, false, err
+	}
+	events, err := streamer.GenerateStream(ctx, content, params, nil)
+	if err == ErrStreamUnsupported {
+		resp, err = gen.GenerateWithParams(ctx, content, params)
+		return resp, false, err
+	} else if err != nil {
+		return resp, false, err
+	}
+	response, tokens, logprobs, err := collectStream(events, onText)
+	encodeResponse(&resp, *content, params, &tokens)
+	resp.Response = response
+	if len(logprobs) > 0 {
+		resp.Logprobs = &logprobs
+	}
+	return resp, true, err
+}
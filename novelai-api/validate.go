@@ -0,0 +1,169 @@
+package novelai_api
+
+import (
+	"fmt"
+	"strings"
+)
+
+// ValidationError lists everything wrong with a request, found before it
+// was sent.
+type ValidationError struct {
+	Problems []string
+}
+
+func (e *ValidationError) Error() string {
+	return "invalid request: " + strings.Join(e.Problems, "; ")
+}
+
+type validator struct {
+	problems []string
+}
+
+func (v *validator) fail(format string, args ...interface{}) {
+	v.problems = append(v.problems, fmt.Sprintf(format, args...))
+}
+
+func (v *validator) checkRange(name string, value *float64, min float64,
+	max float64) {
+	if value != nil && (*value < min || *value > max) {
+		v.fail("`%s` %v is outside %v to %v", name, *value, min, max)
+	}
+}
+
+func (v *validator) checkToken(name string, token float64, vocabSize int) {
+	if token < 0 || token != float64(int(token)) ||
+		(vocabSize > 0 && int(token) >= vocabSize) {
+		v.fail("`%s` token %v is not in the model's vocabulary", name, token)
+	}
+}
+
+func (v *validator) err() error {
+	if len(v.problems) == 0 {
+		return nil
+	}
+	return &ValidationError{Problems: v.problems}
+}
+
+// Validate checks the parameters against the limits of their model. Models
+// missing from the registry are not validated against, as their limits
+// aren't known; only the limits that hold for every model are checked.
+func (params *NaiGenerateParams) Validate() error {
+	var v validator
+	params.validate(&v)
+	return v.err()
+}
+
+func (params *NaiGenerateParams) validate(v *validator) {
+	if params.Model == nil {
+		v.fail("`model` is not set")
+		return
+	}
+	model, known := LookupModel(*params.Model)
+	if params.MaxLength != nil {
+		if *params.MaxLength < 1 {
+			v.fail("`max_length` %d is less than 1", *params.MaxLength)
+		} else if known && int(*params.MaxLength) >= model.ContextLength {
+			v.fail("`max_length` %d is outside 1 to %d", *params.MaxLength,
+				model.ContextLength-1)
+		}
+		if params.MinLength != nil && *params.MinLength > *params.MaxLength {
+			v.fail("`min_length` %d is greater than `max_length` %d",
+				*params.MinLength, *params.MaxLength)
+		}
+	}
+	if params.Temperature != nil && *params.Temperature <= 0 {
+		v.fail("`temperature` %v must be positive", *params.Temperature)
+	}
+	v.checkRange("top_p", params.TopP, 0, 1)
+	v.checkRange("top_a", params.TopA, 0, 1)
+	v.checkRange("typical_p", params.TypicalP, 0, 1)
+	v.checkRange("tail_free_sampling", params.TailFreeSampling, 0, 1)
+	if params.RepetitionPenalty != nil {
+		maxRepPen := 100.0
+		if model.RepPenScale != nil {
+			maxRepPen = model.RepPenScale.Max
+		}
+		v.checkRange("repetition_penalty", params.RepetitionPenalty, 1,
+			maxRepPen)
+	}
+	if params.RepetitionPenaltySlope != nil &&
+		*params.RepetitionPenaltySlope < 0 {
+		v.fail("`repetition_penalty_slope` %v is negative",
+			*params.RepetitionPenaltySlope)
+	}
+	if params.Order != nil {
+		if err := params.Order.check(); err != nil {
+			v.fail("%v", err)
+		}
+		for _, id := range *params.Order {
+			if _, ok := LogitProcessorIdMap[id]; !ok {
+				v.fail("unknown logit processor %d in `order`", id)
+			}
+		}
+	}
+	if params.LogitBiasIds != nil {
+		for _, bias := range *params.LogitBiasIds {
+			if len(bias) != 2 {
+				v.fail("`logit_bias` entry %v is not a [token, bias] pair",
+					bias)
+				continue
+			}
+			v.checkToken("logit_bias", float64(bias[0]), model.VocabSize)
+		}
+	}
+	if params.BadWordsIds != nil {
+		for _, sequence := range *params.BadWordsIds {
+			if len(sequence) == 0 {
+				v.fail("`bad_words_ids` has an empty sequence")
+			}
+			for _, token := range sequence {
+				v.checkToken("bad_words_ids", float64(token), model.VocabSize)
+			}
+		}
+	}
+	if params.RepWhitelistIds != nil {
+		for _, token := range *params.RepWhitelistIds {
+			v.checkToken("repetition_penalty_whitelist", float64(token),
+				model.VocabSize)
+		}
+	}
+}
+
+// ValidateContext checks the parameters, and that a context of
+// `contextTokens` tokens leaves room for `max_length` tokens in the model's
+// context.
+func (params *NaiGenerateParams) ValidateContext(contextTokens int) error {
+	var v validator
+	params.validate(&v)
+	params.checkContextLength(&v, contextTokens)
+	return v.err()
+}
+
+// CheckContextLength only checks that a context of `contextTokens` tokens
+// leaves room for `max_length` tokens in the model's context. Models missing
+// from the registry aren't checked, as their context length isn't known.
+func (params *NaiGenerateParams) CheckContextLength(contextTokens int) error {
+	var v validator
+	params.checkContextLength(&v, contextTokens)
+	return v.err()
+}
+
+func (params *NaiGenerateParams) checkContextLength(v *validator,
+	contextTokens int) {
+	if params.Model == nil {
+		return
+	}
+	model, known := LookupModel(*params.Model)
+	if !known {
+		return
+	}
+	maxLength := 0
+	if params.MaxLength != nil {
+		maxLength = int(*params.MaxLength)
+	}
+	if contextTokens+maxLength > model.ContextLength {
+		v.fail("%d context tokens and %d `max_length` exceed the "+
+			"context length of %d", contextTokens, maxLength,
+			model.ContextLength)
+	}
+}
@@ -0,0 +1,63 @@
+package novelai_api
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestNaiGenerateParams_Validate(t *testing.T) {
+	params := NewGenerateParams()
+	if err := params.Validate(); err != nil {
+		t.Fatalf("default parameters should be valid: %v", err)
+	}
+
+	minLength := uint(100)
+	topP := 1.5
+	order := LogitProcessorIDs{Temperature, TopP, Temperature}
+	badWords := [][]uint16{{}, {60000}}
+	logitBias := [][]float32{{50500, -1}, {13}}
+	params.MinLength = &minLength
+	params.TopP = &topP
+	params.Order = &order
+	params.BadWordsIds = &badWords
+	params.LogitBiasIds = &logitBias
+	err := params.Validate()
+	if err == nil {
+		t.Fatalf("expected invalid parameters to be rejected")
+	}
+	for _, problem := range []string{"`min_length`", "`top_p`", "duplicate",
+		"empty sequence", "`bad_words_ids` token 60000", "`logit_bias` token",
+		"[token, bias] pair"} {
+		if !strings.Contains(err.Error(), problem) {
+			t.Errorf("expected %s to be reported: %v", problem, err)
+		}
+	}
+}
+
+func TestNaiGenerateParams_ValidateContext(t *testing.T) {
+	params := NewGenerateParams()
+	if err := params.ValidateContext(2000); err != nil {
+		t.Errorf("2000 context tokens should fit: %v", err)
+	}
+	if err := params.ValidateContext(2010); err == nil ||
+		!strings.Contains(err.Error(), "exceed the context length") {
+		t.Errorf("2010 context tokens should overflow: %v", err)
+	}
+}
+
+func TestNaiGenerateParams_CheckContextLength(t *testing.T) {
+	params := NewGenerateParams()
+	if err := params.CheckContextLength(2010); err == nil ||
+		!strings.Contains(err.Error(), "exceed the context length") {
+		t.Errorf("2010 context tokens should overflow: %v", err)
+	}
+	// Models that aren't in the registry are left to the backend.
+	model := "some-newer-model"
+	params.Model = &model
+	if err := params.CheckContextLength(2010); err != nil {
+		t.Errorf("unknown models should not be rejected: %v", err)
+	}
+	if err := params.ValidateContext(2010); err != nil {
+		t.Errorf("unknown models should not be validated: %v", err)
+	}
+}
@@ -0,0 +1,72 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io"
+	"os"
+
+	nrt "github.com/wbrown/novelai-research-tool"
+)
+
+// readOutputs reads the outputs in each of `paths`, which may be output files
+// or directories of them.
+func readOutputs(binName string, paths []string) (outputs []nrt.OutputFile) {
+	for _, path := range paths {
+		info, err := os.Stat(path)
+		if err != nil {
+			fmt.Printf("%v: %v\n", binName, err)
+			os.Exit(1)
+		}
+		if info.IsDir() {
+			dirOutputs, err := nrt.ReadOutputDir(path)
+			if err != nil {
+				fmt.Printf("%v: error reading `%v`: %v\n", binName, path, err)
+				os.Exit(1)
+			}
+			outputs = append(outputs, dirOutputs...)
+		} else {
+			output, err := nrt.ReadOutputFile(path)
+			if err != nil {
+				fmt.Printf("%v: %v\n", binName, err)
+				os.Exit(1)
+			}
+			outputs = append(outputs, output)
+		}
+	}
+	return outputs
+}
+
+// exportCommand flattens outputs into CSV or JSONL, one row per generation.
+func exportCommand(binName string, args []string) {
+	flags := flag.NewFlagSet("export", flag.ExitOnError)
+	format := flags.String("format", string(nrt.ExportCSV),
+		"format to export: `csv` or `jsonl`")
+	outputPath := flags.String("o", "", "path to write to, stdout by default")
+	flags.Usage = func() {
+		fmt.Printf("%v: %s export [-format csv|jsonl] [-o path] "+
+			"dir|output.json ...\n", binName, os.Args[0])
+		flags.PrintDefaults()
+	}
+	flags.Parse(args)
+	if flags.NArg() == 0 {
+		flags.Usage()
+		os.Exit(1)
+	}
+	outputs := readOutputs(binName, flags.Args())
+	var w io.Writer = os.Stdout
+	if *outputPath != "" {
+		f, err := os.Create(*outputPath)
+		if err != nil {
+			fmt.Printf("%v: %v\n", binName, err)
+			os.Exit(1)
+		}
+		defer f.Close()
+		w = f
+	}
+	if err := nrt.ExportOutputs(w, nrt.ExportFormat(*format),
+		outputs); err != nil {
+		fmt.Fprintf(os.Stderr, "%v: error exporting: %v\n", binName, err)
+		os.Exit(1)
+	}
+}
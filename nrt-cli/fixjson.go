@@ -0,0 +1,41 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+
+	nrt "github.com/wbrown/novelai-research-tool"
+)
+
+// fixJSONCommand repairs outputs left invalid by runs that were cut short.
+func fixJSONCommand(binName string, args []string) {
+	flags := flag.NewFlagSet("fix-json", flag.ExitOnError)
+	flags.Usage = func() {
+		fmt.Printf("%v: %s fix-json output.json ...\n", binName, os.Args[0])
+		flags.PrintDefaults()
+	}
+	flags.Parse(args)
+	if flags.NArg() == 0 {
+		flags.Usage()
+		os.Exit(1)
+	}
+	failed := false
+	for _, path := range flags.Args() {
+		if _, err := nrt.ReadOutputFile(path); err == nil {
+			fmt.Printf("%v: `%v` is already valid\n", binName, path)
+			continue
+		}
+		kept, err := nrt.RepairOutput(path)
+		if err != nil {
+			fmt.Printf("%v: error repairing `%v`: %v\n", binName, path, err)
+			failed = true
+			continue
+		}
+		fmt.Printf("%v: repaired `%v`, keeping %v iterations\n", binName,
+			path, kept)
+	}
+	if failed {
+		os.Exit(1)
+	}
+}
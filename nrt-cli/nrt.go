@@ -1,47 +1,124 @@
 package main
 
 import (
+	"context"
+	"flag"
 	"fmt"
 	nrt "github.com/wbrown/novelai-research-tool"
 	"os"
+	"os/signal"
 	"path/filepath"
 	"sync"
+	"syscall"
 )
 
-func threadWorker(wg *sync.WaitGroup, tests *chan nrt.ContentTest, total int) {
+func threadWorker(ctx context.Context, wg *sync.WaitGroup,
+	tests *chan nrt.ContentTest, total int) {
 	defer wg.Done()
 	for test := range *tests {
+		if ctx.Err() != nil {
+			continue
+		}
 		testIdx := test.Index
 		fmt.Printf("== Performing test %v / %v ==\n", testIdx, total)
-		test.Perform()
+		if err := test.Perform(ctx); err != nil {
+			fmt.Printf("== Test %v / %v failed: %v ==\n", testIdx, total, err)
+		}
 	}
-	wg.Done()
 }
 
 func main() {
 	binName := filepath.Base(os.Args[0])
+	if len(os.Args) > 1 {
+		switch os.Args[1] {
+		case "report":
+			reportCommand(binName, os.Args[2:])
+			return
+		case "export":
+			exportCommand(binName, os.Args[2:])
+			return
+		case "rate":
+			rateCommand(binName, os.Args[2:])
+			return
+		case "fix-json":
+			fixJSONCommand(binName, os.Args[2:])
+			return
+		}
+	}
+	workers := flag.Int("workers", 1,
+		"number of permutations to perform concurrently")
+	dryRun := flag.Bool("dry-run", false,
+		"print the permutations and their contexts without calling the API")
+	flag.Usage = func() {
+		fmt.Printf("%v: %s [--workers N] [--dry-run] dir/test.json\n"+
+			"       %s report dir\n"+
+			"       %s export [-format csv|jsonl] dir\n"+
+			"       %s rate dir\n"+
+			"       %s fix-json output.json\n", binName, os.Args[0],
+			os.Args[0], os.Args[0], os.Args[0], os.Args[0])
+		flag.PrintDefaults()
+	}
+	flag.Parse()
 
-	if len(os.Args) != 2 {
-		fmt.Printf("%v: %s dir/test.json\n", binName, os.Args[0])
+	if flag.NArg() != 1 || *workers < 1 {
+		flag.Usage()
 		os.Exit(1)
 	}
-	inputPath := os.Args[1]
+	inputPath := flag.Arg(0)
 	if _, err := os.Stat(inputPath); os.IsNotExist(err) {
 		fmt.Printf("%v: `%v` does not exist!\n", binName, inputPath)
 		os.Exit(1)
 	}
+	if *dryRun {
+		tests := nrt.LoadTestsFromFile(inputPath)
+		plans, requests, tokens := nrt.PlanTests(tests)
+		for planIdx := range plans {
+			fmt.Printf("== Test %v / %v ==\n%v\n", planIdx, len(plans),
+				plans[planIdx].String())
+		}
+		fmt.Printf("== %v tests, %v requests, up to %v tokens generated ==\n",
+			len(plans), requests, tokens)
+		return
+	}
+	// Cancel in-flight requests on the first interrupt so that the reporters
+	// get flushed and closed; a second interrupt kills us outright.
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt,
+		syscall.SIGTERM)
+	defer stop()
+	go func() {
+		<-ctx.Done()
+		stop()
+	}()
 	tests := nrt.GenerateTestsFromFile(inputPath)
 	fmt.Printf("== %v tests generated from %v ==\n", len(tests), inputPath)
 	workToDo := make(chan nrt.ContentTest, 1)
 	var wg sync.WaitGroup
-	for idx := 0; idx < 1; idx++ {
+	for idx := 0; idx < *workers; idx++ {
 		fmt.Println("nrt: Starting worker", idx)
 		wg.Add(1)
-		go threadWorker(&wg, &workToDo, len(tests))
+		go threadWorker(ctx, &wg, &workToDo, len(tests))
 	}
 	for testIdx := range tests {
 		tests[testIdx].Index = testIdx
-		workToDo <- tests[testIdx]
+		select {
+		case workToDo <- tests[testIdx]:
+		case <-ctx.Done():
+		}
+		if ctx.Err() != nil {
+			break
+		}
 	}
+	close(workToDo)
 	wg.Wait()
+	if ctx.Err() != nil {
+		fmt.Printf("%v: interrupted, outputs have been closed.\n", binName)
+		os.Exit(1)
+	}
+	if len(tests) > 0 {
+		fmt.Printf("== Metrics ==\n%v", tests[0].Metrics)
+		if err := tests[0].Metrics.Save(); err != nil {
+			fmt.Printf("%v: error saving metrics: %v\n", binName, err)
+			os.Exit(1)
+		}
+	}
 }
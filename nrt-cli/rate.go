@@ -0,0 +1,128 @@
+package main
+
+import (
+	"bufio"
+	"flag"
+	"fmt"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	nrt "github.com/wbrown/novelai-research-tool"
+)
+
+// promptTail is how much of the prompt is shown before the continuations.
+const promptTail = 500
+
+// rateCommand shows anonymized pairs of continuations from different
+// permutations and records which of each pair is preferred.
+func rateCommand(binName string, args []string) {
+	flags := flag.NewFlagSet("rate", flag.ExitOnError)
+	ratingsPath := flags.String("ratings", "",
+		"path of the ratings file, `ratings.ndjson` beside the outputs by default")
+	scoresOnly := flags.Bool("scores", false,
+		"print the scores of the existing ratings without rating")
+	flags.Usage = func() {
+		fmt.Printf("%v: %s rate [-ratings path] [-scores] "+
+			"dir|output.json ...\n", binName, os.Args[0])
+		flags.PrintDefaults()
+	}
+	flags.Parse(args)
+	if flags.NArg() == 0 {
+		flags.Usage()
+		os.Exit(1)
+	}
+	if *ratingsPath == "" {
+		dir := flags.Arg(0)
+		if info, err := os.Stat(dir); err != nil || !info.IsDir() {
+			dir = filepath.Dir(dir)
+		}
+		// Not `.jsonl`, which the readers of the outputs would take for one.
+		*ratingsPath = filepath.Join(dir, "ratings.ndjson")
+	}
+	ratings, err := nrt.LoadRatings(*ratingsPath)
+	if err != nil {
+		fmt.Printf("%v: %v\n", binName, err)
+		os.Exit(1)
+	}
+	printScores := func() {
+		if len(ratings.Ratings) == 0 {
+			fmt.Printf("%v: no ratings in `%v`\n", binName, *ratingsPath)
+			return
+		}
+		fmt.Printf("\n%v ratings in `%v`:\n%v", len(ratings.Ratings),
+			*ratingsPath, nrt.RatingScoresString(
+				nrt.ScoreRatings(ratings.Ratings)))
+	}
+	if *scoresOnly {
+		printScores()
+		return
+	}
+
+	var pairs []nrt.RatingPair
+	for _, pair := range nrt.RatingPairs(readOutputs(binName, flags.Args())) {
+		if !ratings.Rated(pair) {
+			pairs = append(pairs, pair)
+		}
+	}
+	if len(pairs) == 0 {
+		fmt.Printf("%v: no unrated pairs of continuations from different "+
+			"permutations of the same prompt\n", binName)
+		printScores()
+		return
+	}
+	rng := rand.New(rand.NewSource(time.Now().UnixNano()))
+	rng.Shuffle(len(pairs), func(i, j int) {
+		pairs[i], pairs[j] = pairs[j], pairs[i]
+	})
+	input := bufio.NewReader(os.Stdin)
+	for pairIdx, pair := range pairs {
+		if rng.Intn(2) == 1 {
+			pair.Left, pair.Right = pair.Right, pair.Left
+		}
+		prompt := pair.Prompt
+		if len(prompt) > promptTail {
+			start := len(prompt) - promptTail
+			for !utf8.RuneStart(prompt[start]) {
+				start++
+			}
+			prompt = "..." + prompt[start:]
+		}
+		fmt.Printf("\n=== Pair %v of %v ===\n%v\n\n--- A ---\n%v\n\n"+
+			"--- B ---\n%v\n\n", pairIdx+1, len(pairs), prompt,
+			pair.Left.Text, pair.Right.Text)
+		var choice nrt.RatingChoice
+		for choice == "" {
+			fmt.Print("Prefer [a], [b], [t]ie, [s]kip or [q]uit? ")
+			line, err := input.ReadString('\n')
+			if err != nil {
+				printScores()
+				return
+			}
+			switch strings.ToLower(strings.TrimSpace(line)) {
+			case "a":
+				choice = nrt.RatingLeft
+			case "b":
+				choice = nrt.RatingRight
+			case "t":
+				choice = nrt.RatingTie
+			case "s":
+				choice = "skip"
+			case "q":
+				printScores()
+				return
+			}
+		}
+		if choice == "skip" {
+			continue
+		}
+		if err := ratings.Add(pair, choice); err != nil {
+			fmt.Printf("%v: error recording rating: %v\n", binName, err)
+			os.Exit(1)
+		}
+	}
+	printScores()
+}
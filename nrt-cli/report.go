@@ -0,0 +1,52 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"path/filepath"
+
+	nrt "github.com/wbrown/novelai-research-tool"
+)
+
+// reportCommand renders the outputs in a directory as a single HTML page.
+func reportCommand(binName string, args []string) {
+	flags := flag.NewFlagSet("report", flag.ExitOnError)
+	outputPath := flags.String("o", "",
+		"path of the HTML report, `dir/report.html` by default")
+	flags.Usage = func() {
+		fmt.Printf("%v: %s report [-o report.html] dir\n", binName,
+			os.Args[0])
+		flags.PrintDefaults()
+	}
+	flags.Parse(args)
+	if flags.NArg() != 1 {
+		flags.Usage()
+		os.Exit(1)
+	}
+	dir := flags.Arg(0)
+	outputs, err := nrt.ReadOutputDir(dir)
+	if err != nil {
+		fmt.Printf("%v: error reading `%v`: %v\n", binName, dir, err)
+		os.Exit(1)
+	} else if len(outputs) == 0 {
+		fmt.Printf("%v: no outputs found in `%v`\n", binName, dir)
+		os.Exit(1)
+	}
+	if *outputPath == "" {
+		*outputPath = filepath.Join(dir, "report.html")
+	}
+	f, err := os.Create(*outputPath)
+	if err == nil {
+		err = nrt.WriteReport(f, filepath.Base(filepath.Clean(dir)), outputs)
+		if closeErr := f.Close(); err == nil {
+			err = closeErr
+		}
+	}
+	if err != nil {
+		fmt.Printf("%v: error writing `%v`: %v\n", binName, *outputPath, err)
+		os.Exit(1)
+	}
+	fmt.Printf("%v: wrote a report on %v outputs to `%v`\n", binName,
+		len(outputs), *outputPath)
+}
@@ -1,7 +1,9 @@
 package nrt
 
 import (
+	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"github.com/wbrown/novelai-research-tool/aimodules"
 	novelai_api "github.com/wbrown/novelai-research-tool/novelai-api"
@@ -50,30 +52,45 @@ type PermutationsSpec struct {
 	RepetitionPenaltyFrequency []*float64                       `json:"repetition_penalty_frequency"`
 	RepetitionPenaltyPresence  []*float64                       `json:"repetition_penalty_presence"`
 	Order                      []*novelai_api.LogitProcessorIDs `json:"order"`
+	// Zip groups fields whose values are permuted on together, pairwise,
+	// rather than crossed with each other.
+	Zip [][]string `json:"zip" permutation:"-"`
+	// Exclude and IncludeOnly are rules deciding which permutations are
+	// performed; see `rules.go`.
+	Exclude     []string `json:"exclude" permutation:"-"`
+	IncludeOnly []string `json:"include_only" permutation:"-"`
+	// parameters holds the values of any `parameters.<name>` fields, keyed
+	// by the full field name.
+	parameters map[string]reflect.Value
 }
 
 type ContentTest struct {
-	Index            int                           `json:-`
+	Index            int                           `json:"-"`
 	OutputPrefix     string                        `json:"output_prefix"`
+	OutputFormat     OutputFormat                  `json:"output_format"`
 	PromptFilename   string                        `json:"prompt_filename"`
 	ScenarioFilename string                        `json:"scenario_filename"`
 	ModuleFilename   string                        `json:"module_filename"`
 	Prompt           string                        `json:"prompt"`
 	Memory           string                        `json:"memory"`
 	AuthorsNote      string                        `json:"authors_note"`
+	EphemeralContext []string                      `json:"ephemeral_context"`
 	MaxTokens        *int                          `json:"max_tokens"`
 	Iterations       *int                          `json:"iterations"`
 	Generations      *int                          `json:"generations"`
 	Parameters       novelai_api.NaiGenerateParams `json:"parameters"`
 	Permutations     []PermutationsSpec            `json:"permutations"`
 	Placeholders     PlaceholderMap                `json:"placeholders"`
+	Sampling         *SamplingSpec                 `json:"sampling"`
 	WorkingDir       string
 	PromptPath       string
 	ScenarioPath     string
 	ModulePath       string
 	Scenario         *scenario.Scenario
 	AIModule         *aimodules.AIModule
-	API              novelai_api.NovelAiAPI
+	API              novelai_api.Generator
+	Manifest         *Manifest
+	Metrics          *MetricsTable
 }
 
 func MakeDefaultContentTest() (ct ContentTest) {
@@ -132,22 +149,35 @@ type IterationResult struct {
 	Responses     []string                      `json:"responses"`
 	ContextReport scenario.ContextReport        `json:"context_report"`
 	Encoded       EncodedIterationResult        `json:"encoded"`
+	Error         string                        `json:"error,omitempty"`
+	Metrics       *TextMetrics                  `json:"metrics,omitempty"`
 }
 
-func (ct *ContentTest) performGenerations(generations int, input string,
-	reporters *Reporters) (results IterationResult) {
-	context := input
+// performGenerations runs `generations` generations in sequence, feeding each
+// response back into the context. If the API returns an error, the
+// generations so far are returned along with the error, which is also
+// recorded in the result.
+func (ct *ContentTest) performGenerations(ctx context.Context,
+	generations int, input string,
+	reporters *Reporters) (results IterationResult, err error) {
+	storyContext := input
 	results.Prompt = input
 	results.Memory = ct.Memory
 	results.AuthorsNote = ct.AuthorsNote
 	results.Parameters = ct.Parameters
 	ct.Scenario.SetMemory(ct.Memory)
 	ct.Scenario.SetAuthorsNote(ct.AuthorsNote)
-	throttle := time.NewTimer(2000 * time.Millisecond)
 	for generation := 0; generation < generations; generation++ {
-		submission, ctxReport := ct.Scenario.GenerateContext(context,
+		ct.Scenario.SetStep(generation)
+		submission, ctxReport := ct.Scenario.GenerateContext(storyContext,
 			*ct.MaxTokens)
-		resp := ct.API.GenerateWithParams(&submission, ct.Parameters)
+		resp, genErr := ct.API.GenerateWithParams(ctx, &submission,
+			ct.Parameters)
+		if genErr != nil {
+			err = genErr
+			results.Error = genErr.Error()
+			break
+		}
 		if generation == 0 {
 			results.Encoded.Prompt = resp.EncodedRequest
 		}
@@ -155,12 +185,10 @@ func (ct *ContentTest) performGenerations(generations int, input string,
 		results.Encoded.Requests = append(results.Encoded.Requests,
 			RequestContext{resp, ctxReport})
 		reporters.ReportGeneration(resp.Response)
-		context = context + resp.Response
-		<-throttle.C
-		throttle = time.NewTimer(1100 * time.Millisecond)
+		storyContext = storyContext + resp.Response
 	}
 	results.Result = strings.Join(results.Responses, "")
-	return results
+	return results, err
 }
 
 func makeFileNameSafe(s string) string {
@@ -201,21 +229,13 @@ func (ct *ContentTest) GetPrefixName() (prefixName string) {
 }
 
 func (ct *ContentTest) MakeLabel(spec PermutationsSpec) (label string) {
-	fieldNames := make([]string, 0)
-	fields := reflect.TypeOf(spec)
-	for field := 0; field < fields.NumField(); field++ {
-		fieldName := fields.FieldByIndex([]int{field}).Name
-		fieldValues := reflect.ValueOf(spec).Field(field)
-		if fieldValues.Len() > 0 {
-			fieldNames = append(fieldNames, fieldName)
-		}
-	}
-	ctFields := reflect.TypeOf(ct.Parameters)
-	for fieldIdx := range fieldNames {
+	axes := spec.axes()
+	for axisIdx := range axes {
 		if len(label) != 0 {
 			label += ","
 		}
-		fieldName := fieldNames[fieldIdx]
+		fieldName := axes[axisIdx].name
+		labelName := fieldName
 		fieldValueRepr := "#0"
 		switch fieldName {
 		case "Prefix":
@@ -258,22 +278,36 @@ func (ct *ContentTest) MakeLabel(spec PermutationsSpec) (label string) {
 						ct.PromptFilename)), "-", "_", -1),
 				".", "_", -1)
 		default:
-			field, _ := ctFields.FieldByName(fieldName)
-			ctVal := reflect.ValueOf(ct.Parameters).Field(field.Index[0])
-			if ctVal.Kind() == reflect.Ptr {
+			field := parameterFieldByName(fieldName)
+			labelName = field.Name
+			ctVal := reflect.ValueOf(ct.Parameters).FieldByIndex(field.Index)
+			if ctVal.Kind() == reflect.Ptr && ctVal.IsNil() {
+				fieldValueRepr = "null"
+			} else if ctVal.Kind() == reflect.Ptr &&
+				!isScalarKind(ctVal.Elem().Kind()) {
+				// Lists and objects are labelled by their position in the
+				// spec, like prompts.
+				values := axes[axisIdx].values
+				for valueIdx := 0; valueIdx < values.Len(); valueIdx++ {
+					if reflect.DeepEqual(values.Index(valueIdx).Interface(),
+						ctVal.Interface()) {
+						fieldValueRepr = fmt.Sprintf("#%d", valueIdx+1)
+						break
+					}
+				}
+			} else if ctVal.Kind() == reflect.Ptr {
 				fieldValueRepr = fmt.Sprintf("%v", ctVal.Elem())
 			} else {
 				fieldValueRepr = fmt.Sprintf("%v", ctVal)
 			}
 		}
 		fieldValueRepr = makeFileNameSafe(fmt.Sprintf("%v", fieldValueRepr))
-		label += fieldName + "=" + fieldValueRepr
+		label += labelName + "=" + fieldValueRepr
 	}
 	return label
 }
 
 func (ct ContentTest) FieldsSame(fields []string, other ContentTest) bool {
-	ctFields := reflect.TypeOf(ct.Parameters)
 	for fieldIdx := range fields {
 		fieldName := fields[fieldIdx]
 		switch fieldName {
@@ -308,136 +342,141 @@ func (ct ContentTest) FieldsSame(fields []string, other ContentTest) bool {
 			}
 			continue
 		}
-		field, _ := ctFields.FieldByName(fieldName)
-		ctVal := reflect.ValueOf(ct.Parameters).Field(field.Index[0])
-		otherVal := reflect.ValueOf(other.Parameters).Field(field.Index[0])
-		if ctVal.Kind() == reflect.Ptr {
-			if fmt.Sprintf("%v", ctVal.Elem()) !=
-				fmt.Sprintf("%v", otherVal.Elem()) {
-				return false
-			}
-		} else if fmt.Sprintf("%v", ctVal) !=
-			fmt.Sprintf("%v", otherVal) {
+		field := parameterFieldByName(fieldName)
+		ctVal := reflect.ValueOf(ct.Parameters).FieldByIndex(field.Index)
+		otherVal := reflect.ValueOf(other.Parameters).FieldByIndex(field.Index)
+		if !reflect.DeepEqual(ctVal.Interface(), otherVal.Interface()) {
 			return false
 		}
 	}
 	return true
 }
 
-func resolvePermutation(origPermutation ContentTest,
-	fieldName string, fieldValues *reflect.Value) ContentTests {
+// applyPermutationValue sets the field `fieldName` of `permutation` to
+// `value`, one of the values in the `PermutationsSpec` field of that name.
+func applyPermutationValue(permutation ContentTest,
+	fieldName string, value reflect.Value) ContentTest {
 	var stringType = reflect.TypeOf("")
-	newPermutations := make(ContentTests, 0)
-	for valIdx := 0; valIdx < fieldValues.Len(); valIdx++ {
-		permutation := origPermutation
-		value := fieldValues.Index(valIdx)
-		targetField, _ := reflect.TypeOf(permutation.Parameters).FieldByName(fieldName)
-		switch fieldName {
-		case "Placeholders":
-			newPlaceholders := make(PlaceholderMap, 0)
-			fromPlaceholders := value.Interface().(*PlaceholderMap)
-			for k, v := range permutation.Placeholders {
-				newPlaceholders[k] = sanitizeString(v)
-			}
-			for k, v := range *fromPlaceholders {
-				newPlaceholders[k] = sanitizeString(v)
+	switch fieldName {
+	case "Placeholders":
+		newPlaceholders := make(PlaceholderMap, 0)
+		fromPlaceholders := value.Interface().(*PlaceholderMap)
+		for k, v := range permutation.Placeholders {
+			newPlaceholders[k] = sanitizeString(v)
+		}
+		for k, v := range *fromPlaceholders {
+			newPlaceholders[k] = sanitizeString(v)
+		}
+		permutation.Placeholders = newPlaceholders
+	case "Prompt":
+		permutation.Prompt = sanitizeString(fmt.Sprintf("%s",
+			value.Elem()))
+	case "Memory":
+		permutation.Memory = sanitizeString(fmt.Sprintf("%s",
+			value.Elem()))
+	case "AuthorsNote":
+		permutation.AuthorsNote = sanitizeString(fmt.Sprintf("%s",
+			value.Elem()))
+	case "PromptFilename":
+		permutation.PromptFilename = fmt.Sprintf("%v", value.Elem())
+		if len(permutation.PromptFilename) > 0 {
+			permutation.PromptPath = filepath.Join(permutation.WorkingDir,
+				permutation.PromptFilename)
+			if _, err := os.Stat(permutation.PromptPath); os.IsNotExist(err) {
+				log.Printf("nrt: Prompt file `%s` does not exist!\n",
+					permutation.PromptPath)
+				os.Exit(1)
 			}
-			permutation.Placeholders = newPlaceholders
-		case "Prompt":
-			permutation.Prompt = sanitizeString(fmt.Sprintf("%s",
-				value.Elem()))
-		case "Memory":
-			permutation.Memory = sanitizeString(fmt.Sprintf("%s",
-				value.Elem()))
-		case "AuthorsNote":
-			permutation.AuthorsNote = sanitizeString(fmt.Sprintf("%s",
-				value.Elem()))
-		case "PromptFilename":
-			permutation.PromptFilename = fmt.Sprintf("%v", value.Elem())
-			if len(permutation.PromptFilename) > 0 {
-				permutation.PromptPath = filepath.Join(permutation.WorkingDir,
-					permutation.PromptFilename)
-				if _, err := os.Stat(permutation.PromptPath); os.IsNotExist(err) {
-					log.Printf("nrt: Prompt file `%s` does not exist!\n",
-						permutation.PromptPath)
-					os.Exit(1)
-				}
-				permutation.loadPrompt(permutation.PromptPath)
+			permutation.loadPrompt(permutation.PromptPath)
+		}
+	case "ModuleFilename":
+		permutation.ModuleFilename = fmt.Sprintf("%v", value.Elem())
+		if len(permutation.ModuleFilename) > 0 {
+			permutation.ModulePath = filepath.Join(permutation.WorkingDir,
+				permutation.ModuleFilename)
+			if _, err := os.Stat(permutation.ModulePath); os.IsNotExist(err) {
+				log.Printf("nrt: Module file `%s` does not exist!\n",
+					permutation.ModulePath)
+				os.Exit(1)
 			}
-		case "ModuleFilename":
-			permutation.ModuleFilename = fmt.Sprintf("%v", value.Elem())
-			if len(permutation.ModuleFilename) > 0 {
-				permutation.ModulePath = filepath.Join(permutation.WorkingDir,
-					permutation.ModuleFilename)
-				if _, err := os.Stat(permutation.ModulePath); os.IsNotExist(err) {
-					log.Printf("nrt: Module file `%s` does not exist!\n",
-						permutation.ModulePath)
-					os.Exit(1)
+			aiModule := aimodules.AIModuleFromFile(permutation.ModulePath)
+			permutation.AIModule = &aiModule
+			genPrefix := permutation.AIModule.ToPrefix()
+			permutation.Scenario.Settings.Prefix = &genPrefix
+			permutation.Scenario.Settings.ScenarioAIModule =
+				&scenario.ScenarioAIModule{
+					Name:        aiModule.Name,
+					Id:          *permutation.Scenario.Settings.Prefix,
+					Description: aiModule.Description,
 				}
-				aiModule := aimodules.AIModuleFromFile(permutation.ModulePath)
-				permutation.AIModule = &aiModule
-				genPrefix := permutation.AIModule.ToPrefix()
-				permutation.Scenario.Settings.Prefix = &genPrefix
-				permutation.Scenario.Settings.ScenarioAIModule =
-					&scenario.ScenarioAIModule{
-						Name:        aiModule.Name,
-						Id:          *permutation.Scenario.Settings.Prefix,
-						Description: aiModule.Description,
-					}
-			}
-		case "Model":
-			modelVal := value.String()
-			permutation.Parameters.Model = &modelVal
-			permutation.Scenario.Encoder = novelai_api.GetEncoderByModel(
-				modelVal)
-		default:
-			if value.Type() == stringType {
-				value.SetString(sanitizeString(value.String()))
-			}
-			reflect.ValueOf(&permutation.Parameters).Elem().Field(
-				targetField.Index[0]).Set(value)
 		}
-		newPermutations = append(newPermutations, permutation)
+	case "Model":
+		modelVal := value.String()
+		permutation.Parameters.Model = &modelVal
+		permutation.Scenario.Encoder = novelai_api.GetEncoderByModel(
+			modelVal)
+	default:
+		if value.Type() == stringType {
+			value.SetString(sanitizeString(value.String()))
+		}
+		targetField := parameterFieldByName(fieldName)
+		reflect.ValueOf(&permutation.Parameters).Elem().FieldByIndex(
+			targetField.Index).Set(value)
 	}
-	return newPermutations
+	return permutation
 }
 
 func (ct ContentTest) GeneratePermutationsFromSpec(spec PermutationsSpec) ContentTests {
-	templateTest := ct
-	templateTest.Parameters = ct.Parameters
-	permutations := ContentTests{templateTest}
-	// Loop over the fields in `Permutations` type.
-	fields := reflect.TypeOf(spec)
-	fieldNames := make([]string, 0)
-	for field := 0; field < fields.NumField(); field++ {
-		// For each field, check the field contents and determine if there's any
-		// values in there.
-		fieldName := fields.FieldByIndex([]int{field}).Name
-		fieldValues := reflect.ValueOf(spec).Field(field)
-		if fieldValues.Len() > 0 {
-			fieldNames = append(fieldNames, fieldName)
-			// Loop over the values in the field to permute on.
-			newPermutations := make(ContentTests, 0)
-			// Loop over each permutation we already have existing.
-			for permutationTargetIdx := range permutations {
-				// Create a new permutation for each value in the field.
-				permutation := permutations[permutationTargetIdx]
-				permScen := *permutation.Scenario
-				permScen.PlaceholderMap = permScen.PlaceholderMap
-				permutation.Scenario = &permScen
-				newPermutations = append(newPermutations,
-					resolvePermutation(permutation, fieldName, &fieldValues)...)
+	axes := spec.axes()
+	fieldNames := make([]string, 0, len(axes))
+	for axisIdx := range axes {
+		fieldNames = append(fieldNames, axes[axisIdx].name)
+	}
+	dimensions, err := spec.dimensions(axes)
+	if err != nil {
+		log.Printf("nrt: %v", err)
+		os.Exit(1)
+	}
+	rules, err := spec.compileRules()
+	if err != nil {
+		log.Printf("nrt: %v", err)
+		os.Exit(1)
+	}
+	// Each combination holds an index into the values of every dimension;
+	// the axes in a dimension all take the value at that index.
+	dimensionLens := make([]int, 0, len(dimensions))
+	for _, dimension := range dimensions {
+		dimensionLens = append(dimensionLens, axes[dimension[0]].values.Len())
+	}
+	combinations := ct.Sampling.combinations(dimensionLens)
+	permutations := make(ContentTests, 0, len(combinations))
+	for _, combination := range combinations {
+		permutation := ct
+		permScen := *permutation.Scenario
+		permutation.Scenario = &permScen
+		for dimensionIdx, valueIdx := range combination {
+			for _, axisIdx := range dimensions[dimensionIdx] {
+				permutation = applyPermutationValue(permutation,
+					axes[axisIdx].name, axes[axisIdx].values.Index(valueIdx))
 			}
-			permutations = newPermutations
 		}
+		permutations = append(permutations, permutation)
 	}
-	newLabel := ct.MakeLabel(spec)
-	ct.Parameters.Label = &newLabel
-	filteredPermutations := []ContentTest{ct}
+	// The base test goes first, and is filtered like any other permutation.
+	base := ct
+	baseScen := *base.Scenario
+	base.Scenario = &baseScen
+	permutations = append(ContentTests{base}, permutations...)
+	filteredPermutations := make([]ContentTest, 0, len(permutations))
 	for permutationIdx := range permutations {
 		permutation := permutations[permutationIdx]
-		if *permutation.Parameters.Model != "6B-v4" &&
-			*permutation.Parameters.Prefix != "vanilla" {
+		if included, err := rules.includes(&permutation); err != nil {
+			log.Printf("nrt: %v", err)
+			os.Exit(1)
+		} else if !included {
+			continue
+		}
+		if !modelSupports(&permutation, axes) {
 			continue
 		}
 		// Deduplicate based on fields we've permuted on.
@@ -529,57 +568,135 @@ func (ct ContentTest) sanitizeStrings() {
 	ct.Memory = sanitizeString(ct.Memory)
 }
 
-func (ct ContentTest) Perform() {
+// realize gives the test its own copy of the scenario, and fills in the
+// placeholders in the prompt, memory and author's note.
+func (ct *ContentTest) realize() {
+	// Permutations share their scenario's state; take our own copy so that
+	// tests can be performed concurrently.
+	scenario := ct.Scenario.Clone()
+	ct.Scenario = &scenario
 	// ct.loadPrompt(ct.PromptPath)
 	ct.Scenario.PlaceholderMap.UpdateValues(ct.Placeholders.toMap())
 	ct.Prompt = ct.Scenario.PlaceholderMap.ReplacePlaceholders(ct.Prompt)
 	ct.Memory = ct.Scenario.PlaceholderMap.ReplacePlaceholders(ct.Memory)
 	ct.AuthorsNote = ct.Scenario.PlaceholderMap.ReplacePlaceholders(ct.AuthorsNote)
-	reporters := ct.MakeReporters()
+}
+
+// Perform runs all iterations of the test, serializing each to the
+// reporters. If an iteration fails or `ctx` is cancelled, the partial
+// iteration is recorded, the reporters are closed, and the error is returned.
+//
+// If the test has a manifest, a permutation that has already completed its
+// iterations is skipped, with the metrics of its outputs added to the table,
+// and one that was cut short is resumed, appending to its existing outputs.
+func (ct ContentTest) Perform(ctx context.Context) error {
+	outputPath := ""
+	completed := 0
+	if ct.Manifest != nil {
+		if entry, ok := ct.Manifest.Get(ct.label()); ok {
+			outputPath = filepath.Join(filepath.Dir(ct.Manifest.path),
+				entry.Output)
+			if entry.Iterations >= *ct.Iterations {
+				fmt.Printf("== Skipping completed test: %v ==\n", entry.Label)
+				metricsReport := ct.CreateMetricsReporter()
+				metricsReport.resumeMetrics(outputPath+ct.outputExtension(),
+					*ct.Iterations)
+				return nil
+			}
+			completed = entry.Iterations
+		}
+	}
+	ct.realize()
+	var reporters Reporters
+	if outputPath == "" {
+		outputPath = ct.generateOutputPath()
+		reporters = ct.makeReportersAt(outputPath)
+	} else {
+		reporters, completed = ct.resumeReporters(outputPath, completed)
+	}
 	defer reporters.close()
-	for iteration := 0; iteration < *ct.Iterations; iteration++ {
+	if err := ct.updateManifest(ManifestRunning, outputPath,
+		completed); err != nil {
+		return err
+	}
+	for iteration := completed; iteration < *ct.Iterations; iteration++ {
 		reporters.ReportIteration(iteration)
-		responses := ct.performGenerations(*ct.Generations, ct.Prompt, &reporters)
+		responses, err := ct.performGenerations(ctx, *ct.Generations,
+			ct.Prompt, &reporters)
 		reporters.SerializeIteration(&responses)
+		if err != nil {
+			reporters.ReportError(err)
+			if manifestErr := ct.updateManifest(ManifestPartial, outputPath,
+				iteration); manifestErr != nil {
+				log.Printf("nrt: Error updating manifest: %v", manifestErr)
+			}
+			return err
+		}
+		status := ManifestRunning
+		if iteration+1 == *ct.Iterations {
+			status = ManifestComplete
+		}
+		if err = ct.updateManifest(status, outputPath,
+			iteration+1); err != nil {
+			return err
+		}
 	}
+	return nil
 }
 
-func LoadSpecFromFile(path string) (test ContentTest) {
-	configBytes, err := ioutil.ReadFile(path)
+// LoadSpecFromFile reads the spec at `path` with ReadSpecFile, exiting if it
+// can't be read.
+func LoadSpecFromFile(path string) ContentTest {
+	test, err := ReadSpecFile(path)
 	if err != nil {
-		log.Printf("nrt: Error loading JSON specification file `%s`: %v", path, err)
+		log.Printf("nrt: %v", err)
 		os.Exit(1)
 	}
+	return test
+}
+
+// ReadSpecFile reads the spec at `path`, along with the scenario, module and
+// prompt files it names, and checks the parameters of its permutations.
+func ReadSpecFile(path string) (test ContentTest, err error) {
+	configBytes, err := ioutil.ReadFile(path)
+	if err != nil {
+		return test, fmt.Errorf("Error loading JSON specification file "+
+			"`%s`: %v", path, err)
+	}
 	err = json.Unmarshal(configBytes, &test)
 	if err != nil {
-		log.Printf("nrt: Error loading JSON specification file `%s`: %v", path, err)
-		os.Exit(1)
+		return test, fmt.Errorf("Error loading JSON specification file "+
+			"`%s`: %v", path, err)
 	}
 	if test.OutputPrefix == "" {
-		log.Println("nrt: `output_prefix` must be set to a non-empty string.\n")
-		os.Exit(1)
+		return test, errors.New(
+			"`output_prefix` must be set to a non-empty string.")
 	} else if test.PromptFilename == "" && test.Prompt == "" && test.Memory == "" &&
 		test.AuthorsNote == "" && test.ScenarioFilename == "" {
-		log.Printf(
-			"nrt: %s %s\n",
-			"at least one of prompt_filename, prompt, memory, authors_note, or",
-			"scenario_filename must be filled in.")
-		os.Exit(1)
+		return test, errors.New("at least one of prompt_filename, prompt, " +
+			"memory, authors_note, or scenario_filename must be filled in.")
 	} else if test.PromptFilename != "" && test.Prompt != "" {
-		log.Println("nrt: you cannot have both `prompt_filename` and `prompt` set")
-		os.Exit(1)
+		return test, errors.New(
+			"you cannot have both `prompt_filename` and `prompt` set")
+	} else if test.OutputFormat != "" && test.OutputFormat != OutputJSON &&
+		test.OutputFormat != OutputJSONL {
+		return test, fmt.Errorf("`output_format` must be `%s` or `%s`, not `%s`",
+			OutputJSON, OutputJSONL, test.OutputFormat)
+	} else if test.Sampling != nil {
+		if err = test.Sampling.Validate(); err != nil {
+			return test, err
+		}
 	}
 	test.WorkingDir = filepath.Dir(path)
 	if test.ScenarioFilename != "" {
 		test.ScenarioPath = filepath.Join(test.WorkingDir, test.ScenarioFilename)
 		if _, err = os.Stat(test.ScenarioPath); os.IsNotExist(err) {
-			log.Printf("nrt: Scenario file `%v` does not exist!\n", test.ScenarioPath)
-			os.Exit(1)
+			return test, fmt.Errorf("Scenario file `%v` does not exist!",
+				test.ScenarioPath)
 		}
 		fmt.Printf("ScenarioPath: %v\n", test.ScenarioPath)
 		if scenario, err := scenario.ScenarioFromFile(test.ScenarioPath); err != nil {
-			log.Printf("nrt: Error loading scenario: %v\n", err)
-			os.Exit(1)
+			return test, fmt.Errorf("Error loading scenario: %v", err)
 		} else {
 			test.Scenario = &scenario
 		}
@@ -594,9 +711,8 @@ func LoadSpecFromFile(path string) (test ContentTest) {
 		test.ModulePath = filepath.Join(test.WorkingDir,
 			test.ModuleFilename)
 		if _, err := os.Stat(test.ModulePath); os.IsNotExist(err) {
-			log.Printf("nrt: Module file `%s` does not exist!\n",
+			return test, fmt.Errorf("Module file `%s` does not exist!",
 				test.ModulePath)
-			os.Exit(1)
 		}
 		aimodule := aimodules.AIModuleFromFile(test.ModulePath)
 		test.AIModule = &aimodule
@@ -605,11 +721,15 @@ func LoadSpecFromFile(path string) (test ContentTest) {
 	}
 	if test.PromptFilename != "" {
 		test.PromptPath = filepath.Join(test.WorkingDir, test.PromptFilename)
-		if _, err := os.Stat(test.PromptPath); os.IsNotExist(err) {
-			log.Printf("nrt: Prompt file `%v` does not exist!\n", test.PromptPath)
-			os.Exit(1)
+		promptBytes, err := ioutil.ReadFile(test.PromptPath)
+		if os.IsNotExist(err) {
+			return test, fmt.Errorf("Prompt file `%v` does not exist!",
+				test.PromptPath)
+		} else if err != nil {
+			return test, fmt.Errorf("Error loading prompt file `%s`: %v",
+				test.PromptPath, err)
 		}
-		test.loadPrompt(test.PromptPath)
+		test.Prompt = string(promptBytes)
 	}
 	if test.ScenarioFilename == "" {
 		model := "euterpe-v2"
@@ -622,9 +742,36 @@ func LoadSpecFromFile(path string) (test ContentTest) {
 		test.Scenario.Settings.Parameters = &novelai_api.NaiGenerateParams{}
 		test.Scenario.Settings.Parameters.CoerceNullValues(&test.Parameters)
 	}
+	for _, text := range test.EphemeralContext {
+		entry, err := scenario.ParseEphemeralEntry(text, 0)
+		if err != nil {
+			return test, err
+		}
+		test.Scenario.EphemeralContext = append(
+			test.Scenario.EphemeralContext, entry)
+	}
 	defaultTest := MakeDefaultContentTest()
 	test.CoerceContentTest(&defaultTest)
-	return test
+	// Catch invalid parameters before any requests go out, rather than as a
+	// failure partway through the run.
+	var problems []string
+	unknownModels := make(map[string]bool)
+	for _, permutation := range test.GeneratePermutations() {
+		model := *permutation.Parameters.Model
+		if _, ok := novelai_api.LookupModel(model); !ok && !unknownModels[model] {
+			log.Printf("nrt: model `%s` is not in the registry, so its "+
+				"permutations aren't validated; add it to `NAI_MODELS`", model)
+			unknownModels[model] = true
+		}
+		if err := permutation.Validate(); err != nil {
+			problems = append(problems, fmt.Sprintf("permutation `%s`: %v",
+				permutation.label(), err))
+		}
+	}
+	if len(problems) > 0 {
+		return test, errors.New(strings.Join(problems, "\n"))
+	}
+	return test, nil
 }
 
 func MakeTestFromScenario(path string) (test ContentTest) {
@@ -654,15 +801,34 @@ func MakeTestFromScenario(path string) (test ContentTest) {
 	return test
 }
 
-func GenerateTestsFromFile(path string) (tests []ContentTest) {
+// LoadTestsFromFile expands the spec or scenario at `path` into the tests to
+// perform, without connecting them to a generator.
+func LoadTestsFromFile(path string) (tests []ContentTest) {
 	if strings.HasSuffix(path, ".scenario") {
-		test := MakeTestFromScenario(path)
-		test.API = novelai_api.NewNovelAiAPI()
-		tests = []ContentTest{test}
+		tests = []ContentTest{MakeTestFromScenario(path)}
 	} else {
 		test := LoadSpecFromFile(path)
-		test.API = novelai_api.NewNovelAiAPI()
 		tests = test.GeneratePermutations()
 	}
 	return tests
 }
+
+func GenerateTestsFromFile(path string) (tests []ContentTest) {
+	tests = LoadTestsFromFile(path)
+	if len(tests) == 0 {
+		return tests
+	}
+	api, err := novelai_api.NewGeneratorFromEnv()
+	if err != nil {
+		log.Printf("nrt: %v", err)
+		os.Exit(1)
+	}
+	manifest := tests[0].loadManifest()
+	metrics := NewMetricsTable(tests[0].metricsPath())
+	for testIdx := range tests {
+		tests[testIdx].API = api
+		tests[testIdx].Manifest = manifest
+		tests[testIdx].Metrics = metrics
+	}
+	return tests
+}
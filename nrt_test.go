@@ -1,7 +1,25 @@
 package nrt
 
 import (
+	"context"
+	"encoding/base64"
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"math"
+	"net/http"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"sync"
 	"testing"
+	"time"
+
+	"github.com/wbrown/novelai-research-tool/mockapi"
+	novelai_api "github.com/wbrown/novelai-research-tool/novelai-api"
+	"github.com/wbrown/novelai-research-tool/structs"
 )
 
 func TestContentTest_GeneratePermutations(t *testing.T) {
@@ -11,10 +29,10 @@ func TestContentTest_GeneratePermutations(t *testing.T) {
 	if len(tests) != 2 {
 		t.Error("tests/calliope.json should not be producing more than 2 permutation!")
 	}
-	if tests[1].Parameters.Model != "2.7B" {
+	if *tests[1].Parameters.Model != "2.7B" {
 		t.Error("2.7B model was not produced in the permutation output!")
 	}
-	if tests[1].Parameters.Prefix != "vanilla" {
+	if *tests[1].Parameters.Prefix != "vanilla" {
 		t.Error("2.7B model should only produce a `Prefix` of `vanilla`")
 	}
 	// Test behaviors when `6B-v3` is added to the permutation for `Model`.
@@ -24,3 +42,981 @@ func TestContentTest_GeneratePermutations(t *testing.T) {
 		t.Error("tests/calliope.json with {\"model\":[\"2.7B\", \"6B-v3\"]} should be producing three permutations!")
 	}
 }
+
+func newMockBackend(t *testing.T) *mockapi.Server {
+	server := mockapi.NewServer(mockapi.Options{})
+	restore := server.Setenv()
+	t.Cleanup(func() {
+		restore()
+		server.Close()
+	})
+	return server
+}
+
+// writeSpec writes the test specification `spec` into `dir`, returning its
+// path.
+func writeSpec(t *testing.T, dir string, spec string) string {
+	specPath := filepath.Join(dir, "spec.json")
+	if err := ioutil.WriteFile(specPath, []byte(spec), 0644); err != nil {
+		t.Fatal(err)
+	}
+	return specPath
+}
+
+func readOutputs(t *testing.T, dir string) (results []IterationResult) {
+	paths, err := filepath.Glob(filepath.Join(dir, "*.json"))
+	if err != nil || len(paths) != 1 {
+		t.Fatalf("expected a single JSON output in %s, got %v (%v)",
+			dir, paths, err)
+	}
+	outputBytes, err := ioutil.ReadFile(paths[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = json.Unmarshal(outputBytes, &results); err != nil {
+		t.Fatalf("output is not valid JSON: %v", err)
+	}
+	return results
+}
+
+func TestContentTest_Perform(t *testing.T) {
+	server := newMockBackend(t)
+	dir := t.TempDir()
+	spec := `{
+  "prompt": "The detective looked up from the files on his desk.",
+  "memory": "A hardboiled noir story.",
+  "authors_note": "[Style: terse]",
+  "output_prefix": "output/perform",
+  "iterations": 2,
+  "generations": 2,
+  "parameters": {"model": "6B-v4", "max_length": 8, "num_logprobs": 3}
+}`
+	specPath := writeSpec(t, dir, spec)
+	tests := GenerateTestsFromFile(specPath)
+	if len(tests) != 1 {
+		t.Fatalf("expected 1 test, got %d", len(tests))
+	}
+	if err := tests[0].Perform(context.Background()); err != nil {
+		t.Fatalf("Perform: %v", err)
+	}
+	results := readOutputs(t, filepath.Join(dir, "output"))
+	if len(results) != 2 {
+		t.Fatalf("expected 2 iterations, got %d", len(results))
+	}
+	for _, result := range results {
+		if len(result.Responses) != 2 || len(result.Encoded.Requests) != 2 {
+			t.Errorf("expected 2 generations, got %d", len(result.Responses))
+		}
+		if result.Encoded.Requests[0].Request.Logprobs == nil {
+			t.Errorf("logprobs were not recorded")
+		}
+		if len(result.Encoded.Requests[0].ContextReport) == 0 {
+			t.Errorf("context report was not recorded")
+		}
+		if result.Metrics == nil || result.Metrics.MaxLengthHits != 2 {
+			t.Errorf("expected metrics with 2 max_length hits, got %+v",
+				result.Metrics)
+		}
+	}
+	if len(server.Requests()) != 4 {
+		t.Errorf("expected 4 requests, got %d", len(server.Requests()))
+	}
+	summaries := tests[0].Metrics.Summaries()
+	if len(summaries) != 1 || summaries[0].Iterations != 2 ||
+		summaries[0].MaxLengthRate != 1 {
+		t.Errorf("expected a summary of 2 iterations, got %+v", summaries)
+	}
+}
+
+func TestMeasureIteration(t *testing.T) {
+	model := "6B-v4"
+	maxLength := uint(4)
+	encoder := novelai_api.GetEncoderByModel(model)
+	responses := []string{" The cat sat on the mat.",
+		" The cat sat on the mat.", " [ A dog<|endoftext|>"}
+	result := IterationResult{Responses: responses}
+	result.Parameters.Model = &model
+	result.Parameters.MaxLength = &maxLength
+	for idx := range responses {
+		tokens := encoder.Encode(&responses[idx])
+		result.Encoded.Requests = append(result.Encoded.Requests,
+			RequestContext{Request: novelai_api.NaiGenerateResp{
+				Response: responses[idx],
+				EncodedResponse: base64.StdEncoding.EncodeToString(
+					*tokens.ToBin()),
+			}})
+	}
+	result.Result = strings.Join(responses, "")
+	metrics := MeasureIteration(&result)
+	if metrics.Generations != 3 || metrics.BracketLeaks != 1 ||
+		metrics.EndOfTextLeaks != 1 || metrics.MaxLengthHits != 3 {
+		t.Errorf("unexpected counts: %+v", metrics)
+	}
+	// "the cat sat on the mat the cat sat on the mat a dog endoftext"
+	if metrics.RepeatedNgramRate <= 0 || metrics.Distinct1 >= 1 ||
+		metrics.SelfBLEU <= 0 || metrics.SentenceLength <= 0 {
+		t.Errorf("expected repetition to be measured: %+v", metrics)
+	}
+	distinct := MeasureIteration(&IterationResult{
+		Result:    "One two three four five.",
+		Responses: []string{"One two three.", "Four five six."},
+	})
+	if distinct.Distinct1 != 1 || distinct.RepeatedNgramRate != 0 ||
+		distinct.SentenceLength != 5 {
+		t.Errorf("unexpected metrics for distinct text: %+v", distinct)
+	}
+}
+
+func TestContentTest_Perform_Error(t *testing.T) {
+	server := newMockBackend(t)
+	server.QueueErrors(http.StatusBadRequest)
+	test := MakeTestFromScenario("tests/a_laboratory_assistant.scenario")
+	api, err := novelai_api.NewNovelAiAPI()
+	if err != nil {
+		t.Fatal(err)
+	}
+	test.API = &api
+	test.WorkingDir = t.TempDir()
+	iterations, generations := 2, 1
+	test.Iterations = &iterations
+	test.Generations = &generations
+	err = test.Perform(context.Background())
+	var serverErr *novelai_api.ServerError
+	if !errors.As(err, &serverErr) {
+		t.Fatalf("expected ServerError, got %v", err)
+	}
+	// The failed iteration is still recorded, and the output is closed.
+	results := readOutputs(t, test.WorkingDir)
+	if len(results) != 1 || results[0].Error == "" {
+		t.Errorf("expected the failed iteration to be recorded: %v", results)
+	}
+}
+
+func TestContentTest_Perform_Resume(t *testing.T) {
+	server := newMockBackend(t)
+	dir := t.TempDir()
+	spec := `{
+  "prompt": "The detective looked up from the files on his desk.",
+  "output_prefix": "output/resume",
+  "iterations": 2,
+  "generations": 1,
+  "parameters": {"model": "6B-v4", "max_length": 8}
+}`
+	specPath := writeSpec(t, dir, spec)
+	perform := func() error {
+		tests := GenerateTestsFromFile(specPath)
+		if len(tests) != 1 {
+			t.Fatalf("expected 1 test, got %d", len(tests))
+		}
+		if err := tests[0].Perform(context.Background()); err != nil {
+			return err
+		}
+		return tests[0].Metrics.Save()
+	}
+	metricsPath := filepath.Join(dir, "output/resume.metrics.txt")
+	// The first run fails on its first iteration ...
+	server.QueueErrors(http.StatusBadRequest)
+	if err := perform(); err == nil {
+		t.Fatalf("expected the first run to fail")
+	}
+	manifest, err := LoadManifest(filepath.Join(dir, "output/resume.manifest"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if entry, ok := manifest.Get("base"); !ok || entry.Status != ManifestPartial ||
+		entry.Iterations != 0 {
+		t.Fatalf("expected a partial manifest entry, got %v", entry)
+	}
+	// ... the second resumes it, replacing the failed iteration ...
+	if err := perform(); err != nil {
+		t.Fatalf("Perform: %v", err)
+	}
+	results := readOutputs(t, filepath.Join(dir, "output"))
+	if len(results) != 2 {
+		t.Fatalf("expected 2 iterations, got %d", len(results))
+	}
+	for _, result := range results {
+		if result.Error != "" {
+			t.Errorf("failed iteration was not discarded: %v", result.Error)
+		}
+	}
+	metrics, err := ioutil.ReadFile(metricsPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// ... and the third has nothing left to do, keeping the metrics table of
+	// the iterations it skips.
+	if err := perform(); err != nil {
+		t.Fatalf("Perform: %v", err)
+	}
+	if resumed, err := ioutil.ReadFile(metricsPath); err != nil {
+		t.Fatal(err)
+	} else if string(resumed) != string(metrics) {
+		t.Errorf("metrics changed on rerunning:\n%s\n%s", metrics, resumed)
+	}
+	if len(server.Requests()) != 3 {
+		t.Errorf("expected 3 requests, got %d", len(server.Requests()))
+	}
+	if results = readOutputs(t, filepath.Join(dir, "output")); len(results) != 2 {
+		t.Errorf("expected 2 iterations, got %d", len(results))
+	}
+}
+
+func TestContentTest_Perform_Concurrent(t *testing.T) {
+	server := newMockBackend(t)
+	dir := t.TempDir()
+	spec := `{
+  "prompt": "The detective looked up from the files on his desk.",
+  "memory": "A hardboiled noir story.",
+  "authors_note": "[Style: terse]",
+  "output_prefix": "output/concurrent",
+  "iterations": 2,
+  "generations": 2,
+  "parameters": {"model": "6B-v4", "max_length": 8},
+  "permutations": [{"temperature": [0.5, 0.7, 0.9]}]
+}`
+	specPath := writeSpec(t, dir, spec)
+	tests := GenerateTestsFromFile(specPath)
+	// The base permutation is performed along with the three temperatures.
+	if len(tests) != 4 {
+		t.Fatalf("expected 4 tests, got %d", len(tests))
+	}
+	// Performed by several workers, as `nrt --workers` does, sharing the
+	// manifest and metrics table, which is saved while they run.
+	work := make(chan ContentTest)
+	errs := make(chan error, len(tests))
+	done := make(chan struct{})
+	saved := make(chan error)
+	go func() {
+		for {
+			select {
+			case <-done:
+				saved <- tests[0].Metrics.Save()
+				return
+			default:
+				if err := tests[0].Metrics.Save(); err != nil {
+					saved <- err
+					return
+				}
+				time.Sleep(time.Millisecond)
+			}
+		}
+	}()
+	var wg sync.WaitGroup
+	for worker := 0; worker < 3; worker++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for test := range work {
+				errs <- test.Perform(context.Background())
+			}
+		}()
+	}
+	for testIdx := range tests {
+		tests[testIdx].Index = testIdx
+		work <- tests[testIdx]
+	}
+	close(work)
+	wg.Wait()
+	close(done)
+	if err := <-saved; err != nil {
+		t.Fatalf("Save: %v", err)
+	}
+	close(errs)
+	for err := range errs {
+		if err != nil {
+			t.Fatalf("Perform: %v", err)
+		}
+	}
+	outputs, err := ReadOutputDir(filepath.Join(dir, "output"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(outputs) != len(tests) {
+		t.Fatalf("expected %d outputs, got %d", len(tests), len(outputs))
+	}
+	manifest, err := LoadManifest(filepath.Join(dir,
+		"output/concurrent.manifest"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, output := range outputs {
+		if len(output.Iterations) != 2 {
+			t.Errorf("%s: expected 2 iterations, got %d", output.Label(),
+				len(output.Iterations))
+		}
+		for _, iteration := range output.Iterations {
+			if iteration.Memory != "A hardboiled noir story." ||
+				len(iteration.Responses) != 2 {
+				t.Errorf("%s: unexpected iteration: %+v", output.Label(),
+					iteration)
+			}
+			if iteration.Parameters.Label == nil ||
+				*iteration.Parameters.Label != output.Label() {
+				t.Errorf("%s: iteration of another permutation",
+					output.Label())
+			}
+		}
+		entry, ok := manifest.Get(output.Label())
+		if !ok || entry.Status != ManifestComplete || entry.Iterations != 2 {
+			t.Errorf("%s: expected a complete manifest entry, got %+v",
+				output.Label(), entry)
+		}
+	}
+	if len(server.Requests()) != 16 {
+		t.Errorf("expected 16 requests, got %d", len(server.Requests()))
+	}
+	if summaries := tests[0].Metrics.Summaries(); len(summaries) != 4 {
+		t.Errorf("expected a summary per permutation, got %+v", summaries)
+	}
+	table, err := ioutil.ReadFile(filepath.Join(dir,
+		"output/concurrent.metrics.txt"))
+	if err != nil || string(table) != tests[0].Metrics.String() {
+		t.Errorf("saved metrics are not the final table: %v", err)
+	}
+}
+
+func TestContentTest_Plan(t *testing.T) {
+	dir := t.TempDir()
+	spec := `{
+  "prompt": "The detective looked up from the files on his desk.",
+  "memory": "A hardboiled noir story.",
+  "output_prefix": "plan",
+  "iterations": 2,
+  "generations": 3,
+  "parameters": {"model": "6B-v4", "max_length": 8}
+}`
+	specPath := writeSpec(t, dir, spec)
+	plans, requests, tokens := PlanTests(LoadTestsFromFile(specPath))
+	if len(plans) != 1 || requests != 6 || tokens != 48 {
+		t.Fatalf("expected 1 plan, 6 requests and 48 tokens, got %d, %d, %d",
+			len(plans), requests, tokens)
+	}
+	if !strings.Contains(plans[0].Context, "The detective looked up") ||
+		!strings.Contains(plans[0].Context, "A hardboiled noir story.") {
+		t.Errorf("context was not realized: %q", plans[0].Context)
+	}
+	if len(plans[0].ContextReport) == 0 || plans[0].ContextTokens == 0 {
+		t.Errorf("context report was not recorded")
+	}
+}
+
+func TestContentTest_Validate(t *testing.T) {
+	dir := t.TempDir()
+	spec := `{
+  "prompt": "The detective looked up from the files on his desk.",
+  "output_prefix": "validate",
+  "parameters": {"model": "6B-v4", "max_length": 40}
+}`
+	specPath := writeSpec(t, dir, spec)
+	test := LoadTestsFromFile(specPath)[0]
+	if err := test.Validate(); err != nil {
+		t.Errorf("the spec should be valid: %v", err)
+	}
+	topP := 1.5
+	test.Parameters.TopP = &topP
+	if err := test.Validate(); err == nil ||
+		!strings.Contains(err.Error(), "`top_p`") {
+		t.Errorf("top_p 1.5 should be rejected: %v", err)
+	}
+	topP = 0.5
+	maxLength := uint(2047)
+	test.Parameters.MaxLength = &maxLength
+	if err := test.Validate(); err == nil ||
+		!strings.Contains(err.Error(), "exceed the context length") {
+		t.Errorf("context and max_length should overflow the model: %v", err)
+	}
+}
+
+func TestContentTest_GeneratePermutations_Sampling(t *testing.T) {
+	dir := t.TempDir()
+	var specPath string
+	writeSampling := func(sampling string) {
+		spec := `{
+  "prompt": "The detective looked up from the files on his desk.",
+  "output_prefix": "sampling",
+  "parameters": {"model": "6B-v4", "prefix": "vanilla", "temperature": 0.5,
+                 "top_p": 0.95},
+  "permutations": [{
+    "temperature": {"min": 0.4, "max": 0.8, "step": 0.05},
+    "top_p": [0.8, 0.9, 1.0]
+  }],
+  "sampling": ` + sampling + `
+}`
+		specPath = writeSpec(t, dir, spec)
+	}
+	labels := func(tests []ContentTest) (labels []string) {
+		for _, test := range tests {
+			labels = append(labels, *test.Parameters.Label)
+		}
+		return labels
+	}
+
+	writeSampling(`null`)
+	test := LoadSpecFromFile(specPath)
+	temperatures := test.Permutations[0].Temperature
+	if len(temperatures) != 9 || *temperatures[8] != 0.8 {
+		t.Fatalf("range was not expanded to 0.4..0.8: %d values", len(temperatures))
+	}
+	// The base test is the first permutation, as no rule excludes it.
+	if tests := test.GeneratePermutations(); len(tests) != 1+9*3 {
+		t.Errorf("cartesian: expected 28 permutations, got %d", len(tests))
+	}
+
+	writeSampling(`{"strategy": "random", "samples": 5, "seed": 7}`)
+	random := LoadSpecFromFile(specPath).GeneratePermutations()
+	if len(random) != 1+5 {
+		t.Errorf("random: expected 6 permutations, got %d", len(random))
+	}
+	again := LoadSpecFromFile(specPath).GeneratePermutations()
+	if !reflect.DeepEqual(labels(random), labels(again)) {
+		t.Errorf("random: the same seed sampled %v and %v",
+			labels(random), labels(again))
+	}
+
+	// With as many samples as temperatures, every temperature is used once.
+	writeSampling(`{"strategy": "latin_hypercube", "samples": 9, "seed": 7}`)
+	lhs := LoadSpecFromFile(specPath).GeneratePermutations()
+	if len(lhs) != 1+9 {
+		t.Fatalf("latin_hypercube: expected 10 permutations, got %d", len(lhs))
+	}
+	seen := make(map[float64]bool)
+	for _, permutation := range lhs[1:] {
+		seen[*permutation.Parameters.Temperature] = true
+	}
+	if len(seen) != 9 {
+		t.Errorf("latin_hypercube: expected 9 temperatures, got %d", len(seen))
+	}
+}
+
+func TestContentTest_GeneratePermutations_Parameters(t *testing.T) {
+	dir := t.TempDir()
+	spec := `{
+  "prompt": "The detective looked up from the files on his desk.",
+  "output_prefix": "parameters",
+  "parameters": {"model": "6B-v4", "prefix": "vanilla", "temperature": 0.5},
+  "permutations": [{
+    "parameters.temperature": [0.6],
+    "parameters.typical_p": {"min": 0.9, "max": 0.95, "step": 0.05},
+    "parameters.bad_words_ids": [[[1, 2]], [[3]]]
+  }]
+}`
+	specPath := writeSpec(t, dir, spec)
+	test := LoadSpecFromFile(specPath)
+	if len(test.Permutations[0].Temperature) != 1 {
+		t.Errorf("`parameters.temperature` was not read as `temperature`")
+	}
+	tests := test.GeneratePermutations()
+	if len(tests) != 1+2*2 {
+		t.Fatalf("expected 5 permutations, got %d", len(tests))
+	}
+	last := tests[len(tests)-1]
+	if *last.Parameters.TypicalP != 0.95 ||
+		!reflect.DeepEqual(*last.Parameters.BadWordsIds, [][]uint16{{3}}) {
+		t.Errorf("parameters were not permuted: %v, %v",
+			*last.Parameters.TypicalP, *last.Parameters.BadWordsIds)
+	}
+	expected := "Temperature=0_6,BadWordsIds=#2,TypicalP=0_95"
+	if *last.Parameters.Label != expected {
+		t.Errorf("expected label %s, got %s", expected, *last.Parameters.Label)
+	}
+
+	var unknown PermutationsSpec
+	if err := json.Unmarshal([]byte(`{"parameters.nonsense": [1]}`),
+		&unknown); err == nil {
+		t.Errorf("expected an error for an unknown parameter")
+	}
+}
+
+func TestContentTest_FieldsSame(t *testing.T) {
+	biasGroups := func(bias float64) *structs.BiasGroups {
+		phrases := []structs.BiasSequences{}
+		return &structs.BiasGroups{{Phrases: &phrases, Bias: &bias}}
+	}
+	var ct, other ContentTest
+	ct.Parameters.LogitBiasGroups = biasGroups(-0.5)
+	other.Parameters.LogitBiasGroups = biasGroups(-0.5)
+	fields := []string{"LogitBiasGroups"}
+	if !ct.FieldsSame(fields, other) {
+		t.Errorf("equal bias groups should be the same")
+	}
+	other.Parameters.LogitBiasGroups = biasGroups(0.5)
+	if ct.FieldsSame(fields, other) {
+		t.Errorf("different bias groups should not be the same")
+	}
+}
+
+func TestPermutationRule_Matches(t *testing.T) {
+	model, prefix := "6B-v4", "vanilla"
+	temperature, topK := 0.55, uint(40)
+	banBrackets := true
+	test := ContentTest{
+		Memory:       "A hardboiled noir story.",
+		Placeholders: PlaceholderMap{"name": "Sam"},
+		Parameters: novelai_api.NaiGenerateParams{
+			Model:       &model,
+			Prefix:      &prefix,
+			Temperature: &temperature,
+			TopK:        &topK,
+			BanBrackets: &banBrackets,
+		},
+	}
+	cases := map[string]bool{
+		`model == "6B-v4"`:                                true,
+		`model != '6B-v4'`:                                false,
+		`temperature > 0.5 && top_k <= 40`:                true,
+		`parameters.temperature >= 0.6 || !ban_brackets`:  false,
+		`!(prefix == "vanilla" && model == "euterpe-v2")`: true,
+		`typical_p == null`:                               true,
+		`placeholders.name == "Sam" && memory != ""`:      true,
+		`temperature > -1`:                                true,
+	}
+	for source, expected := range cases {
+		rule, err := CompileRule(source)
+		if err != nil {
+			t.Errorf("%s: %v", source, err)
+			continue
+		}
+		if matched, err := rule.Matches(&test); err != nil {
+			t.Errorf("%s: %v", source, err)
+		} else if matched != expected {
+			t.Errorf("%s: expected %v, got %v", source, expected, matched)
+		}
+	}
+	for _, source := range []string{`model ==`, `(model == "6B-v4"`,
+		`nonsense == 1`, `model = "6B-v4"`} {
+		if _, err := CompileRule(source); err == nil {
+			t.Errorf("%s: expected a syntax error", source)
+		}
+	}
+	if rule, _ := CompileRule(`model > 1`); rule != nil {
+		if _, err := rule.Matches(&test); err == nil {
+			t.Errorf("expected an error comparing a string with a number")
+		}
+	}
+}
+
+func TestContentTest_GeneratePermutations_Rules(t *testing.T) {
+	dir := t.TempDir()
+	spec := `{
+  "prompt": "The detective looked up from the files on his desk.",
+  "output_prefix": "rules",
+  "parameters": {"model": "6B-v4", "prefix": "vanilla"},
+  "permutations": [{
+    "memory": ["A noir story.", "A fantasy story.", "A horror story."],
+    "authors_note": ["[Style: terse]", "[Style: epic]", "[Style: dread]"],
+    "temperature": [0.5, 0.7, 0.9],
+    "zip": [["memory", "authors_note"]],
+    "exclude": ["temperature > 0.8 && memory == 'A horror story.'"],
+    "include_only": ["temperature < 0.6", "authors_note != '[Style: terse]'"]
+  }]
+}`
+	specPath := writeSpec(t, dir, spec)
+	tests := LoadSpecFromFile(specPath).GeneratePermutations()
+	// 3 zipped pairs x 3 temperatures, less the excluded horror run at 0.9
+	// and the terse runs above 0.6, plus the base test.
+	if len(tests) != 1+3*3-1-2 {
+		t.Fatalf("expected 7 permutations, got %d", len(tests))
+	}
+	pairs := map[string]string{
+		"A noir story.":    "[Style: terse]",
+		"A fantasy story.": "[Style: epic]",
+		"A horror story.":  "[Style: dread]",
+	}
+	for _, test := range tests[1:] {
+		if pairs[test.Memory] != test.AuthorsNote {
+			t.Errorf("%s was not zipped with %s", test.Memory, test.AuthorsNote)
+		}
+	}
+
+	// The base test is excluded by rules like any other permutation.
+	spec = `{
+  "prompt": "The detective looked up from the files on his desk.",
+  "output_prefix": "rules",
+  "parameters": {"model": "6B-v4", "prefix": "vanilla", "temperature": 0.6},
+  "permutations": [{
+    "temperature": [0.5, 0.9],
+    "exclude": ["temperature == 0.6"]
+  }]
+}`
+	specPath = writeSpec(t, dir, spec)
+	tests = LoadSpecFromFile(specPath).GeneratePermutations()
+	if len(tests) != 2 {
+		t.Fatalf("expected the base test to be excluded, got %d permutations",
+			len(tests))
+	}
+	for _, test := range tests {
+		if *test.Parameters.Temperature == 0.6 {
+			t.Errorf("the excluded base test was generated")
+		}
+	}
+
+	var mismatched PermutationsSpec
+	if err := json.Unmarshal([]byte(`{"memory": ["a", "b"],
+"authors_note": ["c"], "zip": [["memory", "authors_note"]]}`),
+		&mismatched); err == nil {
+		t.Errorf("expected an error zipping fields of different lengths")
+	}
+}
+
+func TestContentTest_GeneratePermutations_Models(t *testing.T) {
+	dir := t.TempDir()
+	spec := `{
+  "prompt": "The detective looked up from the files on his desk.",
+  "output_prefix": "models",
+  "parameters": {"model": "euterpe-v2", "prefix": "vanilla"},
+  "permutations": [{
+    "model": ["2.7B", "6B-v4"],
+    "parameters.typical_p": [0.9]
+  }]
+}`
+	specPath := writeSpec(t, dir, spec)
+	// 2.7B has no `typical_p` sampler, so only 6B-v4 is permuted on.
+	tests := LoadSpecFromFile(specPath).GeneratePermutations()
+	if len(tests) != 2 || *tests[1].Parameters.Model != "6B-v4" {
+		t.Errorf("expected only the 6B-v4 permutation, got %d tests",
+			len(tests))
+	}
+	// Models missing from the registry aren't validated or filtered.
+	spec = strings.Replace(spec, `"2.7B"`, `"krake-v3"`, 1)
+	specPath = writeSpec(t, dir, spec)
+	tests = LoadSpecFromFile(specPath).GeneratePermutations()
+	if len(tests) != 3 || *tests[1].Parameters.Model != "krake-v3" {
+		t.Errorf("expected the krake-v3 permutation, got %d tests",
+			len(tests))
+	}
+}
+
+func TestWriteReport(t *testing.T) {
+	newMockBackend(t)
+	dir := t.TempDir()
+	spec := `{
+  "prompt": "The detective looked up from the files on his desk.",
+  "output_prefix": "report",
+  "iterations": 1,
+  "generations": 2,
+  "parameters": {"model": "6B-v4", "max_length": 8, "num_logprobs": 3},
+  "permutations": [{"temperature": [0.5, 0.9]}]
+}`
+	specPath := writeSpec(t, dir, spec)
+	for _, test := range GenerateTestsFromFile(specPath) {
+		if err := test.Perform(context.Background()); err != nil {
+			t.Fatalf("Perform: %v", err)
+		}
+	}
+	// Ratings given a `.jsonl` name with `nrt rate -ratings` aren't outputs.
+	ratings, err := LoadRatings(filepath.Join(dir, "ratings.jsonl"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = ratings.Add(RatingPair{
+		Prompt: "The detective looked up from the files on his desk.",
+		Left:   RatingCandidate{Label: "a", Path: "a.json"},
+		Right:  RatingCandidate{Label: "b", Path: "b.json"},
+	}, RatingLeft)
+	if err != nil {
+		t.Fatal(err)
+	}
+	outputs, err := ReadOutputDir(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// The base permutation is performed along with the two temperatures.
+	if len(outputs) != 3 {
+		t.Fatalf("expected 3 outputs, skipping the spec and ratings, got %d",
+			len(outputs))
+	}
+	var sb strings.Builder
+	if err = WriteReport(&sb, "report", outputs); err != nil {
+		t.Fatalf("WriteReport: %v", err)
+	}
+	html := sb.String()
+	for _, expected := range []string{">temperature</th>",
+		">perplexity</th>", outputs[0].Label(), outputs[1].Label(),
+		`title="logprob -0.500`, "Context report"} {
+		if !strings.Contains(html, expected) {
+			t.Errorf("report is missing %q", expected)
+		}
+	}
+	if strings.Contains(html, ">top_p</th>") {
+		t.Errorf("parameters that weren't permuted should not be shown")
+	}
+}
+
+func TestExportOutputs(t *testing.T) {
+	newMockBackend(t)
+	dir := t.TempDir()
+	spec := `{
+  "prompt": "The detective looked up from the files on his desk.",
+  "output_prefix": "export",
+  "iterations": 2,
+  "generations": 2,
+  "parameters": {"model": "6B-v4", "max_length": 8, "num_logprobs": 3},
+  "permutations": [{"temperature": [0.5, 0.9]}]
+}`
+	specPath := writeSpec(t, dir, spec)
+	for _, test := range GenerateTestsFromFile(specPath) {
+		if err := test.Perform(context.Background()); err != nil {
+			t.Fatalf("Perform: %v", err)
+		}
+	}
+	outputs, err := ReadOutputDir(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// 3 permutations of 2 iterations of 2 generations each.
+	expectedRows := 3 * 2 * 2
+
+	var csvOut strings.Builder
+	if err = ExportOutputs(&csvOut, ExportCSV, outputs); err != nil {
+		t.Fatalf("ExportOutputs: %v", err)
+	}
+	records, err := csv.NewReader(strings.NewReader(csvOut.String())).ReadAll()
+	if err != nil {
+		t.Fatalf("export is not valid CSV: %v", err)
+	}
+	if len(records) != expectedRows+1 {
+		t.Fatalf("expected %d rows and a header, got %d", expectedRows,
+			len(records))
+	}
+	header := strings.Join(records[0], ",")
+	for _, column := range []string{"label", "iteration", "generation",
+		"response", "response_tokens", "temperature", "perplexity",
+		"context_budget_remaining"} {
+		if !strings.Contains(","+header+",", ","+column+",") {
+			t.Errorf("export is missing column %q: %s", column, header)
+		}
+	}
+
+	var jsonlOut strings.Builder
+	if err = ExportOutputs(&jsonlOut, ExportJSONL, outputs); err != nil {
+		t.Fatalf("ExportOutputs: %v", err)
+	}
+	lines := strings.Split(strings.TrimSpace(jsonlOut.String()), "\n")
+	if len(lines) != expectedRows {
+		t.Fatalf("expected %d lines, got %d", expectedRows, len(lines))
+	}
+	var row map[string]interface{}
+	if err = json.Unmarshal([]byte(lines[len(lines)-1]), &row); err != nil {
+		t.Fatalf("line is not valid JSON: %v", err)
+	}
+	if _, ok := row["temperature"].(float64); !ok {
+		t.Errorf("temperature should be numeric, got %v", row["temperature"])
+	}
+	if perplexity, ok := row["perplexity"].(float64); !ok || perplexity <= 0 {
+		t.Errorf("expected a perplexity, got %v", row["perplexity"])
+	}
+	if err = ExportOutputs(&jsonlOut, "parquet", outputs); err == nil {
+		t.Errorf("expected an error for an unknown format")
+	}
+}
+
+func TestRatings(t *testing.T) {
+	output := func(label string, results ...string) OutputFile {
+		file := OutputFile{Path: label + ".json"}
+		for _, result := range results {
+			iteration := IterationResult{Prompt: "Once upon a time",
+				Result: result}
+			iteration.Parameters.Label = &label
+			file.Iterations = append(file.Iterations, iteration)
+		}
+		return file
+	}
+	outputs := []OutputFile{output("strong", " a", " b"),
+		output("weak", " c", " d"), output("middling", " e")}
+	outputs[2].Iterations = append(outputs[2].Iterations,
+		IterationResult{Prompt: "Once upon a time", Error: "failed"})
+	pairs := RatingPairs(outputs)
+	// strong×weak: 4, strong×middling: 2, weak×middling: 2.
+	if len(pairs) != 8 {
+		t.Fatalf("expected 8 pairs, got %d", len(pairs))
+	}
+
+	path := filepath.Join(t.TempDir(), "ratings.jsonl")
+	ratings, err := LoadRatings(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, pair := range pairs {
+		ranks := map[string]int{"strong": 2, "middling": 1, "weak": 0}
+		choice := RatingLeft
+		if ranks[pair.Right.Label] > ranks[pair.Left.Label] {
+			choice = RatingRight
+		}
+		if err = ratings.Add(pair, choice); err != nil {
+			t.Fatal(err)
+		}
+	}
+	reloaded, err := LoadRatings(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(reloaded.Ratings) != len(pairs) {
+		t.Fatalf("expected %d ratings, got %d", len(pairs),
+			len(reloaded.Ratings))
+	}
+	swapped := RatingPair{Left: pairs[0].Right, Right: pairs[0].Left}
+	if !reloaded.Rated(swapped) {
+		t.Errorf("a pair should be rated regardless of its order")
+	}
+
+	scores := ScoreRatings(reloaded.Ratings)
+	if len(scores) != 3 || scores[0].Label != "strong" ||
+		scores[1].Label != "middling" || scores[2].Label != "weak" {
+		t.Fatalf("unexpected ranking: %+v", scores)
+	}
+	if scores[0].Wins != 6 || scores[0].Losses != 0 ||
+		scores[0].Elo <= scores[2].Elo {
+		t.Errorf("unexpected scores for strong: %+v", scores[0])
+	}
+	if math.IsInf(scores[2].BradleyTerry, 0) ||
+		scores[2].BradleyTerry >= 1500 {
+		t.Errorf("expected a finite, below average score for weak: %+v",
+			scores[2])
+	}
+}
+
+func TestContentTest_Perform_JSONL(t *testing.T) {
+	server := newMockBackend(t)
+	dir := t.TempDir()
+	spec := `{
+  "prompt": "The detective looked up from the files on his desk.",
+  "output_prefix": "output/lines",
+  "output_format": "jsonl",
+  "iterations": 2,
+  "generations": 1,
+  "parameters": {"model": "6B-v4", "max_length": 8}
+}`
+	specPath := writeSpec(t, dir, spec)
+	perform := func() error {
+		return GenerateTestsFromFile(specPath)[0].Perform(
+			context.Background())
+	}
+	// The first run fails on its first iteration, and the second resumes it.
+	server.QueueErrors(http.StatusBadRequest)
+	if err := perform(); err == nil {
+		t.Fatalf("expected the first run to fail")
+	}
+	if err := perform(); err != nil {
+		t.Fatalf("Perform: %v", err)
+	}
+	paths, err := filepath.Glob(filepath.Join(dir, "output", "*.jsonl"))
+	if err != nil || len(paths) != 1 {
+		t.Fatalf("expected a single JSON Lines output, got %v (%v)", paths,
+			err)
+	}
+	outputBytes, err := ioutil.ReadFile(paths[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	lines := strings.Split(strings.TrimSpace(string(outputBytes)), "\n")
+	if len(lines) != 2 {
+		t.Fatalf("expected 2 lines, got %d", len(lines))
+	}
+	for _, line := range lines {
+		var result IterationResult
+		if err = json.Unmarshal([]byte(line), &result); err != nil ||
+			result.Error != "" || result.Result == "" {
+			t.Errorf("expected a complete iteration per line: %v", err)
+		}
+	}
+	// A line cut short by a crash is skipped by readers.
+	f, err := os.OpenFile(paths[0], os.O_APPEND|os.O_WRONLY, 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	f.WriteString(`{"settings": {"temper`)
+	f.Close()
+	outputs, err := ReadOutputDir(filepath.Join(dir, "output"))
+	if err != nil || len(outputs) != 1 || len(outputs[0].Iterations) != 2 {
+		t.Fatalf("expected the output's 2 iterations, got %v (%v)", outputs,
+			err)
+	}
+}
+
+func TestRepairOutput(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "cut-short.json")
+	truncated := `[{"settings": {}, "prompt": "Once", "result": " upon"},
+{"settings": {}, "prompt": "Once", "result": " a time"},
+{"settings": {}, "prompt": "Once", "res`
+	if err := ioutil.WriteFile(path, []byte(truncated), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := ReadOutputFile(path); err == nil {
+		t.Fatalf("expected an error reading a truncated output")
+	}
+	kept, err := RepairOutput(path)
+	if err != nil || kept != 2 {
+		t.Fatalf("expected 2 iterations to be kept, got %d (%v)", kept, err)
+	}
+	output, err := ReadOutputFile(path)
+	if err != nil {
+		t.Fatalf("repaired output is not valid: %v", err)
+	}
+	if len(output.Iterations) != 2 ||
+		output.Iterations[1].Result != " a time" {
+		t.Errorf("unexpected iterations: %+v", output.Iterations)
+	}
+	garbage := filepath.Join(filepath.Dir(path), "garbage.json")
+	if err = ioutil.WriteFile(garbage, []byte("not json"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = RepairOutput(garbage); err == nil {
+		t.Errorf("expected an error repairing a file without iterations")
+	}
+}
+
+func TestContentTest_Perform_Ephemeral(t *testing.T) {
+	newMockBackend(t)
+	dir := t.TempDir()
+	spec := `{
+  "prompt": "The detective looked up from the files on his desk.",
+  "ephemeral_context": ["{+1~1,-1:The lights went out.}"],
+  "output_prefix": "output/ephemeral",
+  "iterations": 1,
+  "generations": 3,
+  "parameters": {"model": "6B-v4", "max_length": 8}
+}`
+	specPath := writeSpec(t, dir, spec)
+	if err := GenerateTestsFromFile(specPath)[0].Perform(
+		context.Background()); err != nil {
+		t.Fatalf("Perform: %v", err)
+	}
+	results := readOutputs(t, filepath.Join(dir, "output"))
+	if len(results) != 1 || len(results[0].Encoded.Requests) != 3 {
+		t.Fatalf("expected 1 iteration of 3 generations, got %v", results)
+	}
+	for generation, request := range results[0].Encoded.Requests {
+		active := false
+		for _, entry := range request.ContextReport {
+			active = active || entry.Label == "Ephemeral 1"
+		}
+		if active != (generation == 1) {
+			t.Errorf("generation %d: expected the ephemeral entry to be "+
+				"active: %v", generation, generation == 1)
+		}
+	}
+}
+
+func TestReadSpecFile_Errors(t *testing.T) {
+	dir := t.TempDir()
+	spec := `{
+  "prompt": "The detective looked up from the files on his desk.",
+  "ephemeral_context": ["The lights went out."],
+  "output_prefix": "output/ephemeral",
+  "parameters": {"model": "6B-v4", "max_length": 8}
+}`
+	specPath := writeSpec(t, dir, spec)
+	if _, err := ReadSpecFile(specPath); err == nil ||
+		!strings.Contains(err.Error(), "ephemeral") {
+		t.Errorf("expected the malformed ephemeral entry to be reported: %v",
+			err)
+	}
+	spec = strings.NewReplacer(`"The lights`, `"{+1~1,-1:The lights`,
+		`out."`, `out.}"`, `"max_length": 8`, `"max_length": 0`).Replace(spec)
+	specPath = writeSpec(t, dir, spec)
+	if _, err := ReadSpecFile(specPath); err == nil ||
+		!strings.Contains(err.Error(), "permutation `base`") {
+		t.Errorf("expected the invalid permutation to be reported: %v", err)
+	}
+}
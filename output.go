@@ -0,0 +1,76 @@
+package nrt
+
+import (
+	"encoding/json"
+	"fmt"
+	"path/filepath"
+	"strings"
+
+	"github.com/wbrown/novelai-research-tool/analysis"
+)
+
+//
+// Output - reads back the output written by JSONReporter.
+//
+
+type OutputFile struct {
+	Path       string
+	Iterations []IterationResult
+}
+
+// Label returns the permutation label of the output, falling back to the
+// file's name for outputs of tests without a label.
+func (output *OutputFile) Label() string {
+	for _, iteration := range output.Iterations {
+		if iteration.Parameters.Label != nil &&
+			*iteration.Parameters.Label != "" {
+			return *iteration.Parameters.Label
+		}
+	}
+	return strings.TrimSuffix(filepath.Base(output.Path),
+		filepath.Ext(output.Path))
+}
+
+// ReadOutputFile reads the output at `path`, either a JSON array or JSON
+// Lines. Files of other JSON objects, such as the ratings of `nrt rate`, are
+// rejected, as every iteration records its `settings`.
+func ReadOutputFile(path string) (output OutputFile, err error) {
+	output.Path = path
+	serialized, err := analysis.ReadOutput(path)
+	if err != nil {
+		return output, err
+	}
+	output.Iterations = make([]IterationResult, len(serialized))
+	for idx := range serialized {
+		var fields map[string]json.RawMessage
+		if err = json.Unmarshal(serialized[idx], &fields); err != nil {
+			return output, fmt.Errorf("`%s` is not `nrt` JSON output: %v",
+				path, err)
+		}
+		if _, ok := fields["settings"]; !ok {
+			return output, fmt.Errorf("`%s` is not `nrt` JSON output: "+
+				"iteration %d has no `settings`", path, idx+1)
+		}
+		if err = json.Unmarshal(serialized[idx],
+			&output.Iterations[idx]); err != nil {
+			return output, fmt.Errorf("`%s` is not `nrt` JSON output: %v",
+				path, err)
+		}
+	}
+	return output, nil
+}
+
+// ReadOutputDir reads every output in `dir`, sorted by path. Other JSON
+// files, such as test specifications, are skipped.
+func ReadOutputDir(dir string) (outputs []OutputFile, err error) {
+	paths, err := analysis.OutputPaths(dir)
+	if err != nil {
+		return nil, err
+	}
+	for _, path := range paths {
+		if output, err := ReadOutputFile(path); err == nil {
+			outputs = append(outputs, output)
+		}
+	}
+	return outputs, nil
+}
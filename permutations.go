@@ -0,0 +1,451 @@
+package nrt
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"math"
+	"math/rand"
+	"reflect"
+	"sort"
+	"strings"
+
+	novelai_api "github.com/wbrown/novelai-research-tool/novelai-api"
+)
+
+//
+// Ranges - a `PermutationsSpec` field can be given as a range of numbers
+//          instead of a list, such as `{"min": 0.4, "max": 0.8, "step": 0.05}`
+//
+
+type RangeSpec struct {
+	Min  *float64 `json:"min"`
+	Max  *float64 `json:"max"`
+	Step *float64 `json:"step"`
+}
+
+// expand returns the values from `Min` to `Max` inclusive, `Step` apart.
+func (rangeSpec *RangeSpec) expand() ([]float64, error) {
+	if rangeSpec.Min == nil || rangeSpec.Max == nil || rangeSpec.Step == nil {
+		return nil, fmt.Errorf("a range needs `min`, `max` and `step`")
+	}
+	min, max, step := *rangeSpec.Min, *rangeSpec.Max, *rangeSpec.Step
+	if step <= 0 {
+		return nil, fmt.Errorf("range `step` must be positive, not %v", step)
+	} else if max < min {
+		return nil, fmt.Errorf("range `max` %v is less than `min` %v", max, min)
+	}
+	// Allow for floating point error in the step count and in each value, so
+	// that 0.4 to 0.8 by 0.05 ends with 0.8 rather than 0.7999999999999999.
+	steps := int(math.Floor((max-min)/step + 1e-9))
+	values := make([]float64, 0, steps+1)
+	for stepIdx := 0; stepIdx <= steps; stepIdx++ {
+		value := min + float64(stepIdx)*step
+		values = append(values, math.Round(value*1e9)/1e9)
+	}
+	return values, nil
+}
+
+//
+// Parameters - any `NaiGenerateParams` field can be permuted on by its JSON
+//              name, such as `"parameters.typical_p": [0.9, 0.95]`
+//
+
+const parameterPrefix = "parameters."
+
+func jsonName(field reflect.StructField) string {
+	return strings.Split(field.Tag.Get("json"), ",")[0]
+}
+
+// parameterField returns the `NaiGenerateParams` field with the JSON name
+// `name`.
+func parameterField(name string) (field reflect.StructField, ok bool) {
+	fields := reflect.TypeOf(novelai_api.NaiGenerateParams{})
+	for fieldIdx := 0; fieldIdx < fields.NumField(); fieldIdx++ {
+		if jsonName(fields.Field(fieldIdx)) == name {
+			return fields.Field(fieldIdx), true
+		}
+	}
+	return field, false
+}
+
+// parameterFieldByName returns the `NaiGenerateParams` field permuted on by
+// the `PermutationsSpec` field `fieldName`, which is either a Go field name
+// shared by both structs or `parameters.<json name>`.
+func parameterFieldByName(fieldName string) (field reflect.StructField) {
+	if strings.HasPrefix(fieldName, parameterPrefix) {
+		field, _ = parameterField(strings.TrimPrefix(fieldName,
+			parameterPrefix))
+	} else {
+		field, _ = reflect.TypeOf(
+			novelai_api.NaiGenerateParams{}).FieldByName(fieldName)
+	}
+	return field
+}
+
+func isScalarKind(kind reflect.Kind) bool {
+	switch kind {
+	case reflect.Slice, reflect.Array, reflect.Map, reflect.Struct,
+		reflect.Invalid:
+		return false
+	default:
+		return true
+	}
+}
+
+// decodeParameters moves the `parameters.<name>` fields out of `fields`,
+// decoding each into a list of values of its `NaiGenerateParams` field's
+// type. Names with a field of their own in `PermutationsSpec` are renamed to
+// it instead.
+func decodeParameters(fields map[string]json.RawMessage) (
+	map[string]reflect.Value, error) {
+	specFields := make(map[string]bool)
+	specType := reflect.TypeOf(PermutationsSpec{})
+	for fieldIdx := 0; fieldIdx < specType.NumField(); fieldIdx++ {
+		if specType.Field(fieldIdx).Tag.Get("permutation") != "-" {
+			specFields[jsonName(specType.Field(fieldIdx))] = true
+		}
+	}
+	fieldNames := make([]string, 0, len(fields))
+	for fieldName := range fields {
+		fieldNames = append(fieldNames, fieldName)
+	}
+	parameters := make(map[string]reflect.Value)
+	for _, fieldName := range fieldNames {
+		if !strings.HasPrefix(fieldName, parameterPrefix) {
+			continue
+		}
+		raw := fields[fieldName]
+		delete(fields, fieldName)
+		name := strings.TrimPrefix(fieldName, parameterPrefix)
+		if specFields[name] {
+			if _, exists := fields[name]; exists {
+				return nil, fmt.Errorf(
+					"permutations: both `%s` and `%s` are set", name, fieldName)
+			}
+			fields[name] = raw
+			continue
+		}
+		field, ok := parameterField(name)
+		if !ok {
+			return nil, fmt.Errorf("permutations: `%s` is not a parameter",
+				fieldName)
+		}
+		values := reflect.New(reflect.SliceOf(field.Type))
+		if err := json.Unmarshal(raw, values.Interface()); err != nil {
+			return nil, fmt.Errorf("permutations: `%s`: %v", fieldName, err)
+		}
+		parameters[fieldName] = values.Elem()
+	}
+	return parameters, nil
+}
+
+// UnmarshalJSON expands any range specs into lists of values before decoding
+// the spec as usual.
+func (spec *PermutationsSpec) UnmarshalJSON(data []byte) error {
+	var fields map[string]json.RawMessage
+	if err := json.Unmarshal(data, &fields); err != nil {
+		return err
+	}
+	for fieldName, raw := range fields {
+		raw = bytes.TrimSpace(raw)
+		if len(raw) == 0 || raw[0] != '{' {
+			continue
+		}
+		var rangeSpec RangeSpec
+		decoder := json.NewDecoder(bytes.NewReader(raw))
+		decoder.DisallowUnknownFields()
+		if err := decoder.Decode(&rangeSpec); err != nil {
+			return fmt.Errorf("permutations: `%s`: %v", fieldName, err)
+		}
+		values, err := rangeSpec.expand()
+		if err != nil {
+			return fmt.Errorf("permutations: `%s`: %v", fieldName, err)
+		}
+		if fields[fieldName], err = json.Marshal(values); err != nil {
+			return err
+		}
+	}
+	parameters, err := decodeParameters(fields)
+	if err != nil {
+		return err
+	}
+	expanded, err := json.Marshal(fields)
+	if err != nil {
+		return err
+	}
+	type plainSpec PermutationsSpec
+	if err = json.Unmarshal(expanded, (*plainSpec)(spec)); err != nil {
+		return err
+	}
+	if len(parameters) > 0 {
+		spec.parameters = parameters
+	}
+	if _, err = spec.dimensions(spec.axes()); err != nil {
+		return err
+	}
+	_, err = spec.compileRules()
+	return err
+}
+
+//
+// Axes - the fields of a `PermutationsSpec` that have values to permute on
+//
+
+type permutationAxis struct {
+	name string
+	// key is the name of the axis in the spec's JSON.
+	key    string
+	values reflect.Value
+}
+
+// axes returns the fields of the spec with values, in declaration order,
+// followed by any `parameters.<name>` fields sorted by name.
+func (spec PermutationsSpec) axes() (axes []permutationAxis) {
+	fields := reflect.TypeOf(spec)
+	for field := 0; field < fields.NumField(); field++ {
+		if fields.Field(field).PkgPath != "" ||
+			fields.Field(field).Tag.Get("permutation") == "-" {
+			continue
+		}
+		fieldValues := reflect.ValueOf(spec).Field(field)
+		if fieldValues.Len() > 0 {
+			axes = append(axes, permutationAxis{
+				name:   fields.Field(field).Name,
+				key:    jsonName(fields.Field(field)),
+				values: fieldValues,
+			})
+		}
+	}
+	parameterNames := make([]string, 0, len(spec.parameters))
+	for fieldName, fieldValues := range spec.parameters {
+		if fieldValues.Len() > 0 {
+			parameterNames = append(parameterNames, fieldName)
+		}
+	}
+	sort.Strings(parameterNames)
+	for _, fieldName := range parameterNames {
+		axes = append(axes, permutationAxis{
+			name:   fieldName,
+			key:    fieldName,
+			values: spec.parameters[fieldName],
+		})
+	}
+	return axes
+}
+
+// modelSupports reports whether the permutation `ct` can be performed by its
+// model: it must not use an AI module with a model that has none, nor
+// permute on a sampler the model does not use. Models missing from the
+// registry are assumed to support everything.
+func modelSupports(ct *ContentTest, axes []permutationAxis) bool {
+	model, ok := novelai_api.LookupModel(*ct.Parameters.Model)
+	if !ok {
+		return true
+	}
+	if ct.Parameters.Prefix != nil && *ct.Parameters.Prefix != "vanilla" &&
+		!model.SupportsModules {
+		return false
+	}
+	for axisIdx := range axes {
+		name := strings.TrimPrefix(axes[axisIdx].key, parameterPrefix)
+		if isSampler(name) && !model.SupportsSampler(name) {
+			return false
+		}
+	}
+	return true
+}
+
+// isSampler reports whether the parameter `name` is used by a sampler of any
+// model in the registry.
+func isSampler(name string) bool {
+	for _, model := range novelai_api.Models() {
+		if model.SupportsSampler(name) {
+			return true
+		}
+	}
+	return false
+}
+
+// dimensions groups the indices of `axes` that are permuted on together: each
+// zip group is one dimension, and every other axis is a dimension of its own.
+// Dimensions are ordered by their first axis.
+func (spec *PermutationsSpec) dimensions(axes []permutationAxis) (
+	[][]int, error) {
+	axisIdxs := make(map[string]int, len(axes))
+	for axisIdx := range axes {
+		axisIdxs[axes[axisIdx].key] = axisIdx
+	}
+	groups := make(map[int]int)
+	for groupIdx, group := range spec.Zip {
+		for _, key := range group {
+			axisIdx, ok := axisIdxs[key]
+			if !ok {
+				axisIdx, ok = axisIdxs[strings.TrimPrefix(key, parameterPrefix)]
+			}
+			if !ok {
+				return nil, fmt.Errorf("zip: `%s` has no values to permute on",
+					key)
+			} else if _, zipped := groups[axisIdx]; zipped {
+				return nil, fmt.Errorf("zip: `%s` is zipped more than once",
+					key)
+			}
+			groups[axisIdx] = groupIdx
+		}
+	}
+	dimensions := make([][]int, 0, len(axes))
+	groupDimensions := make(map[int]int)
+	for axisIdx := range axes {
+		groupIdx, zipped := groups[axisIdx]
+		if !zipped {
+			dimensions = append(dimensions, []int{axisIdx})
+			continue
+		}
+		if dimensionIdx, ok := groupDimensions[groupIdx]; ok {
+			dimension := dimensions[dimensionIdx]
+			if axes[dimension[0]].values.Len() != axes[axisIdx].values.Len() {
+				return nil, fmt.Errorf(
+					"zip: `%s` and `%s` have different numbers of values",
+					axes[dimension[0]].key, axes[axisIdx].key)
+			}
+			dimensions[dimensionIdx] = append(dimension, axisIdx)
+		} else {
+			groupDimensions[groupIdx] = len(dimensions)
+			dimensions = append(dimensions, []int{axisIdx})
+		}
+	}
+	return dimensions, nil
+}
+
+//
+// Sampling - chooses which combinations of axis values become permutations
+//
+
+type SamplingStrategy string
+
+const (
+	SamplingCartesian      SamplingStrategy = "cartesian"
+	SamplingRandom         SamplingStrategy = "random"
+	SamplingLatinHypercube SamplingStrategy = "latin_hypercube"
+)
+
+type SamplingSpec struct {
+	Strategy SamplingStrategy `json:"strategy"`
+	// Samples is the number of combinations to draw from each permutation
+	// spec, for the `random` and `latin_hypercube` strategies.
+	Samples int   `json:"samples"`
+	Seed    int64 `json:"seed"`
+}
+
+func (sampling *SamplingSpec) Validate() error {
+	switch sampling.Strategy {
+	case "", SamplingCartesian:
+		return nil
+	case SamplingRandom, SamplingLatinHypercube:
+		if sampling.Samples < 1 {
+			return fmt.Errorf("sampling: `%s` needs a positive `samples`",
+				sampling.Strategy)
+		}
+		return nil
+	default:
+		return fmt.Errorf("sampling: unknown strategy `%s`", sampling.Strategy)
+	}
+}
+
+// combinations returns the combinations to permute on, each as an index into
+// every dimension, given the number of values in each. A nil `sampling` is
+// `cartesian`.
+func (sampling *SamplingSpec) combinations(lens []int) [][]int {
+	if sampling == nil {
+		return cartesianCombinations(lens)
+	}
+	rng := rand.New(rand.NewSource(sampling.Seed))
+	switch sampling.Strategy {
+	case SamplingRandom:
+		if sampling.Samples >= combinationCount(lens) {
+			return cartesianCombinations(lens)
+		}
+		return randomCombinations(lens, sampling.Samples, rng)
+	case SamplingLatinHypercube:
+		return latinHypercubeCombinations(lens, sampling.Samples, rng)
+	default:
+		return cartesianCombinations(lens)
+	}
+}
+
+// combinationCount returns the size of the full Cartesian product of `lens`,
+// saturating at `math.MaxInt32`.
+func combinationCount(lens []int) int {
+	count := 1
+	for _, dimensionLen := range lens {
+		if count > math.MaxInt32/dimensionLen {
+			return math.MaxInt32
+		}
+		count *= dimensionLen
+	}
+	return count
+}
+
+// cartesianCombinations returns every combination, varying the last axis
+// fastest.
+func cartesianCombinations(lens []int) [][]int {
+	combinations := [][]int{{}}
+	for _, dimensionLen := range lens {
+		newCombinations := make([][]int, 0)
+		for _, combination := range combinations {
+			for valueIdx := 0; valueIdx < dimensionLen; valueIdx++ {
+				newCombination := append(append([]int{}, combination...),
+					valueIdx)
+				newCombinations = append(newCombinations, newCombination)
+			}
+		}
+		combinations = newCombinations
+	}
+	return combinations
+}
+
+// randomCombinations draws `samples` distinct combinations uniformly at
+// random; `samples` must be less than the number of combinations.
+func randomCombinations(lens []int, samples int,
+	rng *rand.Rand) [][]int {
+	combinations := make([][]int, 0, samples)
+	seen := make(map[string]bool)
+	for len(combinations) < samples {
+		combination := make([]int, len(lens))
+		for dimensionIdx, dimensionLen := range lens {
+			combination[dimensionIdx] = rng.Intn(dimensionLen)
+		}
+		key := fmt.Sprint(combination)
+		if !seen[key] {
+			seen[key] = true
+			combinations = append(combinations, combination)
+		}
+	}
+	return combinations
+}
+
+// latinHypercubeCombinations divides every dimension into `samples` equal
+// strata and draws `samples` combinations so that each stratum of each
+// dimension is used exactly once. Dimensions with fewer values than strata
+// repeat values, so the permutations produced may have duplicates, which are
+// removed later.
+func latinHypercubeCombinations(lens []int, samples int,
+	rng *rand.Rand) [][]int {
+	combinations := make([][]int, samples)
+	for sampleIdx := range combinations {
+		combinations[sampleIdx] = make([]int, len(lens))
+	}
+	for dimensionIdx, dimensionLen := range lens {
+		strata := rng.Perm(samples)
+		for sampleIdx := range combinations {
+			position := (float64(strata[sampleIdx]) + rng.Float64()) /
+				float64(samples)
+			valueIdx := int(position * float64(dimensionLen))
+			if valueIdx >= dimensionLen {
+				valueIdx = dimensionLen - 1
+			}
+			combinations[sampleIdx][dimensionIdx] = valueIdx
+		}
+	}
+	return combinations
+}
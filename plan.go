@@ -0,0 +1,89 @@
+package nrt
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/wbrown/novelai-research-tool/scenario"
+)
+
+//
+// TestPlan - what performing a test would do, worked out without calling the
+//            API.
+//
+
+type TestPlan struct {
+	Label         string
+	Context       string
+	ContextReport scenario.ContextReport
+	// ContextTokens is the size of the first request's context.
+	ContextTokens int
+	Requests      int
+	// TokensGenerated is the most tokens the test can generate, assuming
+	// every generation runs to `max_length`.
+	TokensGenerated int
+}
+
+// firstContext realizes the context of the test's first generation.
+func (ct ContentTest) firstContext() (string, scenario.ContextReport) {
+	ct.realize()
+	ct.Scenario.SetMemory(ct.Memory)
+	ct.Scenario.SetAuthorsNote(ct.AuthorsNote)
+	ct.Scenario.SetStep(0)
+	return ct.Scenario.GenerateContext(ct.Prompt, *ct.MaxTokens)
+}
+
+// Plan realizes the context of the test's first generation and estimates the
+// number of requests and tokens performing it would take.
+func (ct ContentTest) Plan() (plan TestPlan) {
+	plan.Label = ct.label()
+	plan.Context, plan.ContextReport = ct.firstContext()
+	for _, entry := range plan.ContextReport {
+		plan.ContextTokens += entry.TokensInserted
+	}
+	plan.Requests = *ct.Iterations * *ct.Generations
+	if ct.Parameters.MaxLength != nil {
+		plan.TokensGenerated = plan.Requests * int(*ct.Parameters.MaxLength)
+	}
+	return plan
+}
+
+func (plan *TestPlan) String() string {
+	var sb strings.Builder
+	sb.WriteString(fmt.Sprintf("=== %s ===\n", plan.Label))
+	sb.WriteString(fmt.Sprintf("%-20s %8s %8s %8s %8s %8s %6s\n",
+		"Context", "Position", "Tokens", "Inserted", "Budget", "Reserved",
+		"Forced"))
+	for _, entry := range plan.ContextReport {
+		sb.WriteString(fmt.Sprintf("%-20.20s %8d %8d %8d %8d %8d %6v\n",
+			entry.Label, entry.InsertionPos, entry.TokenCount,
+			entry.TokensInserted, entry.BudgetRemaining,
+			entry.ReservedRemaining, entry.Forced))
+	}
+	sb.WriteString(fmt.Sprintf("--- Realized Context (%d tokens) ---\n%s\n",
+		plan.ContextTokens, plan.Context))
+	sb.WriteString(fmt.Sprintf("--- %d requests, up to %d tokens generated\n",
+		plan.Requests, plan.TokensGenerated))
+	return sb.String()
+}
+
+// Validate checks the test's parameters, and that its first context leaves
+// room for `max_length`, against the limits of its model.
+func (ct ContentTest) Validate() error {
+	context, _ := ct.firstContext()
+	contextTokens := len(*ct.Scenario.Encoder.Encode(&context))
+	return ct.Parameters.ValidateContext(contextTokens)
+}
+
+// PlanTests plans each of `tests`, returning the plans along with the total
+// requests and tokens generated.
+func PlanTests(tests []ContentTest) (plans []TestPlan, requests int,
+	tokens int) {
+	for testIdx := range tests {
+		plan := tests[testIdx].Plan()
+		requests += plan.Requests
+		tokens += plan.TokensGenerated
+		plans = append(plans, plan)
+	}
+	return plans, requests, tokens
+}
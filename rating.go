@@ -0,0 +1,339 @@
+package nrt
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"math"
+	"os"
+	"sort"
+	"strings"
+	"time"
+)
+
+//
+// Ratings - blind pairwise preferences between the continuations of different
+//           permutations, scored per permutation label.
+//
+
+type RatingChoice string
+
+const (
+	RatingLeft  RatingChoice = "left"
+	RatingRight RatingChoice = "right"
+	RatingTie   RatingChoice = "tie"
+)
+
+// RatingCandidate identifies one iteration of an output.
+type RatingCandidate struct {
+	Label     string `json:"label"`
+	Path      string `json:"path"`
+	Iteration int    `json:"iteration"`
+	Text      string `json:"-"`
+}
+
+// RatingPair is two continuations of the same prompt from different
+// permutations, in the order they are shown.
+type RatingPair struct {
+	Prompt string
+	Left   RatingCandidate
+	Right  RatingCandidate
+}
+
+// Rating is a recorded preference; a ratings file holds one JSON serialized
+// rating per line.
+type Rating struct {
+	Prompt    string          `json:"prompt"`
+	Left      RatingCandidate `json:"left"`
+	Right     RatingCandidate `json:"right"`
+	Preferred RatingChoice    `json:"preferred"`
+	Time      time.Time       `json:"time"`
+}
+
+// key identifies the pair of iterations rated, regardless of their order.
+func (pair RatingPair) key() string {
+	keys := []string{
+		fmt.Sprintf("%s#%d", pair.Left.Path, pair.Left.Iteration),
+		fmt.Sprintf("%s#%d", pair.Right.Path, pair.Right.Iteration),
+	}
+	sort.Strings(keys)
+	return strings.Join(keys, "|")
+}
+
+// RatingPairs returns every pair of successful iterations of `outputs` that
+// continue the same prompt but come from different permutations.
+func RatingPairs(outputs []OutputFile) (pairs []RatingPair) {
+	var prompts []string
+	byPrompt := make(map[string][]RatingCandidate)
+	for outputIdx := range outputs {
+		output := &outputs[outputIdx]
+		label := output.Label()
+		for iterationIdx, iteration := range output.Iterations {
+			if iteration.Error != "" || iteration.Result == "" {
+				continue
+			}
+			if _, ok := byPrompt[iteration.Prompt]; !ok {
+				prompts = append(prompts, iteration.Prompt)
+			}
+			byPrompt[iteration.Prompt] = append(byPrompt[iteration.Prompt],
+				RatingCandidate{
+					Label:     label,
+					Path:      output.Path,
+					Iteration: iterationIdx,
+					Text:      iteration.Result,
+				})
+		}
+	}
+	for _, prompt := range prompts {
+		candidates := byPrompt[prompt]
+		for leftIdx := range candidates {
+			for rightIdx := leftIdx + 1; rightIdx < len(candidates); rightIdx++ {
+				if candidates[leftIdx].Label == candidates[rightIdx].Label {
+					continue
+				}
+				pairs = append(pairs, RatingPair{
+					Prompt: prompt,
+					Left:   candidates[leftIdx],
+					Right:  candidates[rightIdx],
+				})
+			}
+		}
+	}
+	return pairs
+}
+
+type Ratings struct {
+	path    string
+	Ratings []Rating
+	rated   map[string]bool
+}
+
+// LoadRatings reads the ratings file at `path`, returning no ratings if it
+// does not exist yet.
+func LoadRatings(path string) (*Ratings, error) {
+	ratings := &Ratings{path: path, rated: make(map[string]bool)}
+	f, err := os.Open(path)
+	if os.IsNotExist(err) {
+		return ratings, nil
+	} else if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	scanner := bufio.NewScanner(f)
+	scanner.Buffer(make([]byte, 64*1024), 64*1024*1024)
+	for lineNum := 1; scanner.Scan(); lineNum++ {
+		if len(scanner.Bytes()) == 0 {
+			continue
+		}
+		var rating Rating
+		if err := json.Unmarshal(scanner.Bytes(), &rating); err != nil {
+			return nil, fmt.Errorf("ratings: %s:%d: %v", path, lineNum, err)
+		}
+		ratings.Ratings = append(ratings.Ratings, rating)
+		ratings.rated[RatingPair{Left: rating.Left,
+			Right: rating.Right}.key()] = true
+	}
+	return ratings, scanner.Err()
+}
+
+// Rated returns whether `pair` has already been rated, in either order.
+func (ratings *Ratings) Rated(pair RatingPair) bool {
+	return ratings.rated[pair.key()]
+}
+
+// Add records the preference for `pair`, appending it to the ratings file.
+func (ratings *Ratings) Add(pair RatingPair, preferred RatingChoice) error {
+	rating := Rating{
+		Prompt:    pair.Prompt,
+		Left:      pair.Left,
+		Right:     pair.Right,
+		Preferred: preferred,
+		Time:      time.Now().UTC(),
+	}
+	serialized, err := json.Marshal(rating)
+	if err != nil {
+		return err
+	}
+	f, err := os.OpenFile(ratings.path,
+		os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0644)
+	if err != nil {
+		return err
+	}
+	if _, err = f.Write(append(serialized, '\n')); err != nil {
+		f.Close()
+		return err
+	}
+	if err = f.Close(); err != nil {
+		return err
+	}
+	ratings.Ratings = append(ratings.Ratings, rating)
+	ratings.rated[pair.key()] = true
+	return nil
+}
+
+//
+// Scoring
+//
+
+const (
+	eloInitial = 1500.0
+	eloK       = 32.0
+)
+
+type RatingScore struct {
+	Label        string
+	Wins         int
+	Losses       int
+	Ties         int
+	Elo          float64
+	BradleyTerry float64
+}
+
+// leftScore returns the score of the left candidate: 1 for a win, 0.5 for a
+// tie and 0 for a loss.
+func (rating Rating) leftScore() float64 {
+	switch rating.Preferred {
+	case RatingLeft:
+		return 1
+	case RatingRight:
+		return 0
+	default:
+		return 0.5
+	}
+}
+
+// EloScores rates each label by applying the ratings in order, starting from
+// 1500 with a K-factor of 32.
+func EloScores(ratings []Rating) map[string]float64 {
+	elo := make(map[string]float64)
+	for _, rating := range ratings {
+		left, right := rating.Left.Label, rating.Right.Label
+		for _, label := range []string{left, right} {
+			if _, ok := elo[label]; !ok {
+				elo[label] = eloInitial
+			}
+		}
+		expected := 1 / (1 + math.Pow(10, (elo[right]-elo[left])/400))
+		delta := eloK * (rating.leftScore() - expected)
+		elo[left] += delta
+		elo[right] -= delta
+	}
+	return elo
+}
+
+// BradleyTerryScores fits a Bradley-Terry model to the ratings, returning
+// each label's strength on the Elo scale, centered on 1500. Unlike Elo,
+// the fit does not depend on the order of the ratings. Ties count as half a
+// win for each side, and every pair of labels that was compared is given one
+// extra tie so that a label without wins still has a finite strength.
+func BradleyTerryScores(ratings []Rating) map[string]float64 {
+	wins := make(map[string]float64)
+	games := make(map[string]map[string]float64)
+	addGames := func(a, b string, count float64) {
+		if games[a] == nil {
+			games[a] = make(map[string]float64)
+		}
+		games[a][b] += count
+	}
+	for _, rating := range ratings {
+		left, right := rating.Left.Label, rating.Right.Label
+		if left == right {
+			continue
+		}
+		if games[left][right] == 0 {
+			wins[left] += 0.5
+			wins[right] += 0.5
+			addGames(left, right, 1)
+			addGames(right, left, 1)
+		}
+		wins[left] += rating.leftScore()
+		wins[right] += 1 - rating.leftScore()
+		addGames(left, right, 1)
+		addGames(right, left, 1)
+	}
+	strength := make(map[string]float64)
+	for label := range games {
+		strength[label] = 1
+	}
+	// Hunter's MM algorithm, normalized to a geometric mean of 1.
+	for iteration := 0; iteration < 1000; iteration++ {
+		next := make(map[string]float64)
+		logSum := 0.0
+		for label, opponents := range games {
+			denominator := 0.0
+			for opponent, count := range opponents {
+				denominator += count / (strength[label] + strength[opponent])
+			}
+			next[label] = wins[label] / denominator
+			logSum += math.Log(next[label])
+		}
+		mean := math.Exp(logSum / float64(len(next)))
+		change := 0.0
+		for label := range next {
+			next[label] /= mean
+			change = math.Max(change, math.Abs(next[label]-strength[label]))
+		}
+		strength = next
+		if change < 1e-9 {
+			break
+		}
+	}
+	scores := make(map[string]float64)
+	for label, value := range strength {
+		scores[label] = eloInitial + 400*math.Log10(value)
+	}
+	return scores
+}
+
+// ScoreRatings tallies the ratings of each label, best first by its
+// Bradley-Terry score.
+func ScoreRatings(ratings []Rating) (scores []RatingScore) {
+	tallies := make(map[string]*RatingScore)
+	tally := func(label string) *RatingScore {
+		if _, ok := tallies[label]; !ok {
+			tallies[label] = &RatingScore{Label: label}
+		}
+		return tallies[label]
+	}
+	for _, rating := range ratings {
+		left, right := tally(rating.Left.Label), tally(rating.Right.Label)
+		switch rating.Preferred {
+		case RatingLeft:
+			left.Wins++
+			right.Losses++
+		case RatingRight:
+			left.Losses++
+			right.Wins++
+		default:
+			left.Ties++
+			right.Ties++
+		}
+	}
+	elo := EloScores(ratings)
+	bradleyTerry := BradleyTerryScores(ratings)
+	for label, score := range tallies {
+		score.Elo = elo[label]
+		score.BradleyTerry = bradleyTerry[label]
+		scores = append(scores, *score)
+	}
+	sort.Slice(scores, func(i, j int) bool {
+		if scores[i].BradleyTerry != scores[j].BradleyTerry {
+			return scores[i].BradleyTerry > scores[j].BradleyTerry
+		}
+		return scores[i].Label < scores[j].Label
+	})
+	return scores
+}
+
+// RatingScoresString formats `scores` as a table.
+func RatingScoresString(scores []RatingScore) string {
+	var sb strings.Builder
+	sb.WriteString(fmt.Sprintf("%-40s %5s %5s %5s %7s %7s\n", "Label",
+		"Wins", "Loss", "Ties", "Elo", "B-T"))
+	for _, score := range scores {
+		sb.WriteString(fmt.Sprintf("%-40.40s %5d %5d %5d %7.1f %7.1f\n",
+			score.Label, score.Wins, score.Losses, score.Ties, score.Elo,
+			score.BradleyTerry))
+	}
+	return sb.String()
+}
@@ -0,0 +1,276 @@
+package nrt
+
+import (
+	_ "embed"
+	"encoding/json"
+	"fmt"
+	"html/template"
+	"io"
+	"math"
+	"sort"
+	"strconv"
+	"strings"
+	"unicode/utf8"
+
+	"github.com/wbrown/gpt_bpe"
+	"github.com/wbrown/novelai-research-tool/analysis"
+	novelai_api "github.com/wbrown/novelai-research-tool/novelai-api"
+	"github.com/wbrown/novelai-research-tool/scenario"
+)
+
+//
+// HTML report - compares the outputs of a run's permutations side by side on
+// a single static page.
+//
+
+//go:embed report.html
+var reportTemplateHTML string
+
+var reportTemplate = template.Must(template.New("report").Funcs(
+	template.FuncMap{"inc": func(i int) int { return i + 1 }}).Parse(
+	reportTemplateHTML))
+
+type reportColumn struct {
+	Name    string
+	Numeric bool
+	// Metric columns are measured from the outputs rather than permuted.
+	Metric bool
+}
+
+type reportToken struct {
+	Text    string
+	Logprob string
+	// Color is the token's background, from red for unlikely tokens to green
+	// for likely ones; empty if the token has no logprob.
+	Color template.CSS
+}
+
+type reportChunk struct {
+	Tokens []reportToken
+}
+
+type reportIteration struct {
+	Index         int
+	Prompt        string
+	Chunks        []reportChunk
+	ContextReport scenario.ContextReport
+	Error         string
+}
+
+type reportPermutation struct {
+	ID         string
+	Label      string
+	Path       string
+	Values     []string
+	Iterations []reportIteration
+}
+
+type reportData struct {
+	Title        string
+	Columns      []reportColumn
+	Permutations []reportPermutation
+}
+
+// parameterValues returns the JSON value of each of the iteration's
+// parameters, along with the text fields that permutations can vary.
+func parameterValues(iteration *IterationResult) map[string]json.RawMessage {
+	values := make(map[string]json.RawMessage)
+	if serialized, err := json.Marshal(iteration.Parameters); err == nil {
+		json.Unmarshal(serialized, &values)
+	}
+	delete(values, "label")
+	for name, text := range map[string]string{
+		"prompt":       iteration.Prompt,
+		"memory":       iteration.Memory,
+		"authors_note": iteration.AuthorsNote,
+	} {
+		values[name], _ = json.Marshal(text)
+	}
+	return values
+}
+
+// rawText returns a JSON value as plain text, unquoting strings.
+func rawText(value json.RawMessage) string {
+	var text string
+	if json.Unmarshal(value, &text) == nil {
+		return text
+	}
+	return string(value)
+}
+
+func flattenParameters(iteration *IterationResult) map[string]string {
+	values := make(map[string]string)
+	for name, value := range parameterValues(iteration) {
+		values[name] = rawText(value)
+	}
+	return values
+}
+
+// renderTokens splits a response into its tokens, colored by the logprob of
+// each if they were recorded. Tokens that end partway through a character are
+// merged into the next.
+func renderTokens(encoder *gpt_bpe.GPTEncoder,
+	resp *novelai_api.NaiGenerateResp) (tokens []reportToken) {
+	if resp.Logprobs == nil || len(*resp.Logprobs) == 0 {
+		return []reportToken{{Text: resp.Response}}
+	}
+	var sequence gpt_bpe.Tokens
+	text := ""
+	for _, entry := range *resp.Logprobs {
+		if entry.Chosen == nil || len(*entry.Chosen) == 0 {
+			continue
+		}
+		chosen := (*entry.Chosen)[0]
+		sequence = append(sequence, chosen.Tokens...)
+		decoded := encoder.Decode(&sequence)
+		if !utf8.ValidString(decoded) || !strings.HasPrefix(decoded, text) {
+			continue
+		}
+		token := reportToken{Text: decoded[len(text):]}
+		text = decoded
+		if logprob := chosen.Logprobs.Before; logprob != nil {
+			p := math.Exp(float64(*logprob))
+			token.Logprob = fmt.Sprintf("logprob %.3f, p %.3f", *logprob, p)
+			token.Color = template.CSS(fmt.Sprintf("hsl(%.0f, 70%%, 80%%)",
+				120*p))
+		}
+		tokens = append(tokens, token)
+	}
+	return tokens
+}
+
+func formatMetric(value float64) string {
+	return strconv.FormatFloat(value, 'f', 3, 64)
+}
+
+// buildReport gathers the permutations of `outputs`, with a column for each
+// parameter that differs between them, followed by their metrics.
+func buildReport(title string, outputs []OutputFile) (data reportData) {
+	data.Title = title
+	flattened := make([]map[string]string, len(outputs))
+	varying := make(map[string]bool)
+	for idx := range outputs {
+		flattened[idx] = make(map[string]string)
+		if len(outputs[idx].Iterations) > 0 {
+			flattened[idx] = flattenParameters(&outputs[idx].Iterations[0])
+		}
+		for name, value := range flattened[idx] {
+			if value != flattened[0][name] {
+				varying[name] = true
+			}
+		}
+		for name := range flattened[0] {
+			if _, ok := flattened[idx][name]; !ok {
+				varying[name] = true
+			}
+		}
+	}
+	parameters := make([]string, 0, len(varying))
+	for name := range varying {
+		parameters = append(parameters, name)
+	}
+	sort.Strings(parameters)
+	for _, name := range parameters {
+		numeric := true
+		for idx := range flattened {
+			if _, err := strconv.ParseFloat(flattened[idx][name],
+				64); err != nil {
+				numeric = false
+			}
+		}
+		data.Columns = append(data.Columns,
+			reportColumn{Name: name, Numeric: numeric})
+	}
+	metricNames := []string{"distinct_1", "distinct_2", "self_bleu",
+		"repeated_ngram_rate", "sentence_length", "bracket_leak_rate",
+		"endoftext_rate", "max_length_rate", "perplexity", "entropy",
+		"non_argmax_rate"}
+	for _, name := range metricNames {
+		data.Columns = append(data.Columns,
+			reportColumn{Name: name, Numeric: true, Metric: true})
+	}
+
+	for idx := range outputs {
+		output := &outputs[idx]
+		label := output.Label()
+		permutation := reportPermutation{
+			ID:    fmt.Sprintf("permutation-%d", idx),
+			Label: label,
+			Path:  output.Path,
+		}
+		for _, name := range parameters {
+			permutation.Values = append(permutation.Values,
+				flattened[idx][name])
+		}
+		table := NewMetricsTable("")
+		for iterationIdx := range output.Iterations {
+			iteration := &output.Iterations[iterationIdx]
+			if iteration.Error != "" {
+				continue
+			} else if iteration.Metrics != nil {
+				table.Add(label, *iteration.Metrics)
+			} else {
+				table.Add(label, MeasureIteration(iteration))
+			}
+		}
+		values := make(map[string]float64)
+		if summaries := table.Summaries(); len(summaries) > 0 {
+			summary := summaries[0]
+			values["distinct_1"] = summary.Distinct1
+			values["distinct_2"] = summary.Distinct2
+			values["self_bleu"] = summary.SelfBLEU
+			values["repeated_ngram_rate"] = summary.RepeatedNgramRate
+			values["sentence_length"] = summary.SentenceLength
+			values["bracket_leak_rate"] = summary.BracketLeakRate
+			values["endoftext_rate"] = summary.EndOfTextRate
+			values["max_length_rate"] = summary.MaxLengthRate
+		}
+		generations, err := analysis.AnalyzeFile(output.Path)
+		if summaries := analysis.Summarize(generations); err == nil &&
+			len(summaries) > 0 {
+			values["perplexity"] = summaries[0].Perplexity
+			values["entropy"] = summaries[0].Entropy
+			values["non_argmax_rate"] = summaries[0].NonArgmaxRate
+		}
+		// Metrics that couldn't be measured are left blank.
+		metrics := make([]string, len(metricNames))
+		for metricIdx, name := range metricNames {
+			if value, ok := values[name]; ok {
+				metrics[metricIdx] = formatMetric(value)
+			}
+		}
+		permutation.Values = append(permutation.Values, metrics...)
+
+		for iterationIdx := range output.Iterations {
+			iteration := &output.Iterations[iterationIdx]
+			model := ""
+			if iteration.Parameters.Model != nil {
+				model = *iteration.Parameters.Model
+			}
+			encoder := novelai_api.GetEncoderByModel(model)
+			rendered := reportIteration{
+				Index:  iterationIdx,
+				Prompt: iteration.Prompt,
+				Error:  iteration.Error,
+			}
+			for requestIdx := range iteration.Encoded.Requests {
+				request := &iteration.Encoded.Requests[requestIdx]
+				rendered.Chunks = append(rendered.Chunks, reportChunk{
+					Tokens: renderTokens(encoder, &request.Request),
+				})
+				if requestIdx == 0 {
+					rendered.ContextReport = request.ContextReport
+				}
+			}
+			permutation.Iterations = append(permutation.Iterations,
+				rendered)
+		}
+		data.Permutations = append(data.Permutations, permutation)
+	}
+	return data
+}
+
+// WriteReport renders the HTML report comparing `outputs` to `w`.
+func WriteReport(w io.Writer, title string, outputs []OutputFile) error {
+	return reportTemplate.Execute(w, buildReport(title, outputs))
+}
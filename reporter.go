@@ -1,9 +1,11 @@
 package nrt
 
 import (
+	"bytes"
 	"encoding/json"
 	"fmt"
 	"github.com/fatih/color"
+	"io/ioutil"
 	"log"
 	"os"
 	"path/filepath"
@@ -93,6 +95,11 @@ func (cr *ConsoleReporter) ReportGeneration(resp string) {
 		strings.Replace(resp, "\n", cr.greenNewline, -1))
 }
 
+func (cr *ConsoleReporter) ReportError(err error) {
+	fmt.Printf("%v %v\n", color.New(color.FgWhite, color.BgRed).Sprint(
+		"Error:"), err)
+}
+
 func (cr *ConsoleReporter) close() {
 	fmt.Printf("%v\n", cr.blue("== Test Instance Complete =="))
 }
@@ -102,31 +109,149 @@ func (cr *ConsoleReporter) close() {
 //                file
 //
 
+type OutputFormat string
+
+const (
+	// OutputJSON writes a JSON array, which is only valid once the test is
+	// complete.
+	OutputJSON OutputFormat = "json"
+	// OutputJSONL writes JSON Lines, each iteration on a line of its own, so
+	// that the output stays readable if the run is cut short.
+	OutputJSONL OutputFormat = "jsonl"
+)
+
 type JSONReporter struct {
 	fileHandle *os.File
 	iteration  int
+	lines      bool
 }
 
-func CreateJSONReporter(path string) (reportWriter JSONReporter) {
-	var err error
+func openForAppend(path string) *os.File {
 	dir := filepath.Dir(path)
-	err = os.MkdirAll(dir, 0755)
+	err := os.MkdirAll(dir, 0755)
 	if err != nil {
 		log.Printf("reporter: Cannot create path: `%s`: %s", dir, err)
 		os.Exit(1)
 	}
-	reportWriter.fileHandle, err = os.OpenFile(path,
-		os.O_APPEND|os.O_WRONLY|os.O_CREATE, 0644)
+	f, err := os.OpenFile(path, os.O_APPEND|os.O_WRONLY|os.O_CREATE, 0644)
 	if err != nil {
 		log.Printf("reporter: Cannot open file for writing: `%s`: %s", path, err)
 		os.Exit(1)
 	}
+	return f
+}
+
+func CreateJSONReporter(path string,
+	format OutputFormat) (reportWriter JSONReporter) {
+	reportWriter.fileHandle = openForAppend(path)
 	reportWriter.iteration = 0
-	handleWrite(reportWriter.fileHandle, "[")
+	reportWriter.lines = format == OutputJSONL
+	if !reportWriter.lines {
+		handleWrite(reportWriter.fileHandle, "[")
+	}
 	return reportWriter
 }
 
+// recoverIterations returns up to `limit` of the iterations in output that may
+// have been cut short, such as a JSON array without its closing bracket, or
+// JSON Lines with an incomplete last line. Reading stops at the first
+// iteration that can't be decoded; a negative `limit` reads all of them.
+func recoverIterations(outputBytes []byte,
+	limit int) (results []json.RawMessage) {
+	decoder := json.NewDecoder(bytes.NewReader(outputBytes))
+	if bytes.HasPrefix(bytes.TrimSpace(outputBytes), []byte("[")) {
+		if _, err := decoder.Token(); err != nil {
+			return nil
+		}
+	}
+	for (limit < 0 || len(results) < limit) && decoder.More() {
+		var result json.RawMessage
+		if err := decoder.Decode(&result); err != nil {
+			break
+		}
+		results = append(results, result)
+	}
+	return results
+}
+
+// joinIterations serializes `results` in `format`. JSON arrays are left open,
+// for more iterations to be appended.
+func joinIterations(results []json.RawMessage, format OutputFormat) []byte {
+	var buffer bytes.Buffer
+	if format != OutputJSONL {
+		buffer.WriteString("[")
+	}
+	for idx, result := range results {
+		if idx > 0 && format != OutputJSONL {
+			buffer.WriteString(",\n")
+		}
+		buffer.Write(result)
+		if format == OutputJSONL {
+			buffer.WriteString("\n")
+		}
+	}
+	return buffer.Bytes()
+}
+
+// ResumeJSONReporter reopens the output at `path` to continue a run. At most
+// `iterations` serialized iterations are kept; anything after them, such as a
+// failed iteration or one cut short by a crash, is discarded. The number of
+// iterations kept is returned.
+func ResumeJSONReporter(path string, format OutputFormat,
+	iterations int) (reportWriter JSONReporter, kept int) {
+	outputBytes, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return CreateJSONReporter(path, format), 0
+	} else if err != nil {
+		log.Printf("reporter: Cannot read `%s`: %s", path, err)
+		os.Exit(1)
+	}
+	results := recoverIterations(outputBytes, iterations)
+	if err = writeFileAtomic(path, joinIterations(results, format)); err != nil {
+		log.Printf("reporter: Cannot rewrite `%s`: %s", path, err)
+		os.Exit(1)
+	}
+	reportWriter.fileHandle = openForAppend(path)
+	reportWriter.iteration = len(results)
+	reportWriter.lines = format == OutputJSONL
+	return reportWriter, len(results)
+}
+
+// RepairOutput rewrites the output at `path`, left invalid by a run that was
+// cut short, keeping every iteration that was completely written. It returns
+// the number of iterations kept.
+func RepairOutput(path string) (kept int, err error) {
+	outputBytes, err := ioutil.ReadFile(path)
+	if err != nil {
+		return 0, err
+	}
+	format := OutputJSONL
+	if bytes.HasPrefix(bytes.TrimSpace(outputBytes), []byte("[")) {
+		format = OutputJSON
+	}
+	results := recoverIterations(outputBytes, -1)
+	if len(results) == 0 {
+		return 0, fmt.Errorf("`%s` has no complete iterations to keep", path)
+	}
+	repaired := joinIterations(results, format)
+	if format == OutputJSON {
+		repaired = append(repaired, ']')
+	}
+	return len(results), writeFileAtomic(path, repaired)
+}
+
 func (reportWriter *JSONReporter) SerializeIteration(result *IterationResult) {
+	if reportWriter.lines {
+		serialized, err := json.Marshal(result)
+		if err != nil {
+			log.Printf("reporter: Cannot marshal JSON: %v, %v", result, err)
+			os.Exit(1)
+		}
+		reportWriter.iteration += 1
+		handleWrite(reportWriter.fileHandle, string(serialized)+"\n")
+		reportWriter.fileHandle.Sync()
+		return
+	}
 	if reportWriter.iteration != 0 {
 		handleWrite(reportWriter.fileHandle, ",\n")
 	}
@@ -141,7 +266,9 @@ func (reportWriter *JSONReporter) SerializeIteration(result *IterationResult) {
 }
 
 func (reportWriter *JSONReporter) close() {
-	handleWrite(reportWriter.fileHandle, "]")
+	if !reportWriter.lines {
+		handleWrite(reportWriter.fileHandle, "]")
+	}
 	reportWriter.fileHandle.Close()
 }
 
@@ -156,19 +283,7 @@ type TextReporter struct {
 }
 
 func (ct ContentTest) CreateTextReporter(path string) (textReporter TextReporter) {
-	var err error
-	dir := filepath.Dir(path)
-	err = os.MkdirAll(dir, 0755)
-	if err != nil {
-		log.Printf("reporter: Cannot create path: `%s`: %s", dir, err)
-		os.Exit(1)
-	}
-	textReporter.fileHandle, err = os.OpenFile(path,
-		os.O_APPEND|os.O_WRONLY|os.O_CREATE, 0644)
-	if err != nil {
-		log.Printf("reporter: Cannot open file for writing: `%s`: %s", path, err)
-		os.Exit(1)
-	}
+	textReporter.fileHandle = openForAppend(path)
 	paramsReport := ct.generateParamRepr()
 	phReport := ""
 	for _, v := range ct.Scenario.PlaceholderMap {
@@ -191,6 +306,14 @@ func (ct ContentTest) CreateTextReporter(path string) (textReporter TextReporter
 	return textReporter
 }
 
+// ResumeTextReporter reopens the text output at `path` to continue a run.
+func (ct ContentTest) ResumeTextReporter(path string) (textReporter TextReporter) {
+	textReporter.fileHandle = openForAppend(path)
+	handleWrite(textReporter.fileHandle,
+		"\n\n=== Resumed =======================================")
+	return textReporter
+}
+
 func (tr *TextReporter) ReportIteration(iteration int) {
 	handleWrite(tr.fileHandle,
 		fmt.Sprintf("\n\n=== Iteration %-5v ==============================\n", iteration))
@@ -202,6 +325,12 @@ func (tr *TextReporter) ReportGeneration(resp string) {
 	tr.fileHandle.Sync()
 }
 
+func (tr *TextReporter) ReportError(err error) {
+	handleWrite(tr.fileHandle,
+		fmt.Sprintf("\n\n=== Error =========================================\n%v\n", err))
+	tr.fileHandle.Sync()
+}
+
 func (tr *TextReporter) close() {
 	tr.fileHandle.Close()
 }
@@ -210,6 +339,7 @@ type Reporters struct {
 	JSON    *JSONReporter
 	Text    *TextReporter
 	Console *ConsoleReporter
+	Metrics *MetricsReporter
 }
 
 func (reporters Reporters) close() {
@@ -228,18 +358,59 @@ func (reporters Reporters) ReportGeneration(resp string) {
 	reporters.Text.ReportGeneration(resp)
 }
 
+func (reporters Reporters) ReportError(err error) {
+	reporters.Console.ReportError(err)
+	reporters.Text.ReportError(err)
+}
+
 func (reporters Reporters) SerializeIteration(result *IterationResult) {
+	reporters.Metrics.SerializeIteration(result)
 	reporters.JSON.SerializeIteration(result)
 }
 
+func (ct ContentTest) outputFormat() OutputFormat {
+	if ct.OutputFormat == "" {
+		return OutputJSON
+	}
+	return ct.OutputFormat
+}
+
+func (ct ContentTest) outputExtension() string {
+	return "." + string(ct.outputFormat())
+}
+
 func (ct ContentTest) MakeReporters() Reporters {
+	return ct.makeReportersAt(ct.generateOutputPath())
+}
+
+func (ct ContentTest) makeReportersAt(outputPath string) Reporters {
 	consoleReport := ct.CreateConsoleReporter()
-	outputPath := ct.generateOutputPath()
 	textReport := ct.CreateTextReporter(outputPath + ".txt")
-	jsonReport := CreateJSONReporter(outputPath + ".json")
+	jsonReport := CreateJSONReporter(outputPath+ct.outputExtension(),
+		ct.outputFormat())
+	metricsReport := ct.CreateMetricsReporter()
 	return Reporters{
 		&jsonReport,
 		&textReport,
 		&consoleReport,
+		&metricsReport,
 	}
 }
+
+// resumeReporters reopens the outputs at `outputPath`, keeping at most
+// `iterations` completed iterations, and returns how many were kept.
+func (ct ContentTest) resumeReporters(outputPath string,
+	iterations int) (Reporters, int) {
+	consoleReport := ct.CreateConsoleReporter()
+	textReport := ct.ResumeTextReporter(outputPath + ".txt")
+	jsonReport, kept := ResumeJSONReporter(outputPath+ct.outputExtension(),
+		ct.outputFormat(), iterations)
+	metricsReport := ct.CreateMetricsReporter()
+	metricsReport.resumeMetrics(outputPath+ct.outputExtension(), kept)
+	return Reporters{
+		&jsonReport,
+		&textReport,
+		&consoleReport,
+		&metricsReport,
+	}, kept
+}
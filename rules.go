@@ -0,0 +1,476 @@
+package nrt
+
+import (
+	"fmt"
+	"reflect"
+	"strconv"
+	"strings"
+	"unicode"
+)
+
+//
+// Rules - expressions over a permutation's values that decide whether it is
+//         performed, such as `model == "6B-v4" && temperature > 0.5`
+//
+// Fields are referred to by their name in the spec: `model`, `prefix`,
+// `prompt`, `memory`, `authors_note`, `prompt_filename`, `module_filename`,
+// `placeholders.<name>`, and any generation parameter, optionally prefixed
+// with `parameters.`. Values are compared with `==`, `!=`, `<`, `<=`, `>` and
+// `>=`, and combined with `&&`, `||`, `!` and parentheses. Literals are
+// numbers, quoted strings, `true`, `false` and `null`.
+//
+
+type PermutationRule struct {
+	Source string
+	expr   ruleExpr
+}
+
+type ruleExpr interface {
+	eval(ct *ContentTest) (interface{}, error)
+}
+
+// CompileRule parses the rule expression `source`.
+func CompileRule(source string) (*PermutationRule, error) {
+	tokens, err := tokenizeRule(source)
+	if err != nil {
+		return nil, fmt.Errorf("rule `%s`: %v", source, err)
+	}
+	parser := ruleParser{tokens: tokens}
+	expr, err := parser.parseOr()
+	if err == nil && parser.pos < len(parser.tokens) {
+		err = fmt.Errorf("unexpected `%s`", parser.tokens[parser.pos].text)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("rule `%s`: %v", source, err)
+	}
+	return &PermutationRule{Source: source, expr: expr}, nil
+}
+
+// Matches evaluates the rule against the permutation `ct`.
+func (rule *PermutationRule) Matches(ct *ContentTest) (bool, error) {
+	value, err := rule.expr.eval(ct)
+	if err != nil {
+		return false, fmt.Errorf("rule `%s`: %v", rule.Source, err)
+	}
+	matched, ok := value.(bool)
+	if !ok {
+		return false, fmt.Errorf("rule `%s`: result %v is not a boolean",
+			rule.Source, value)
+	}
+	return matched, nil
+}
+
+//
+// Tokenizer
+//
+
+type ruleTokenKind int
+
+const (
+	ruleTokenOperator ruleTokenKind = iota
+	ruleTokenIdentifier
+	ruleTokenNumber
+	ruleTokenString
+)
+
+type ruleToken struct {
+	kind  ruleTokenKind
+	text  string
+	value interface{}
+}
+
+var ruleOperators = []string{"==", "!=", "<=", ">=", "&&", "||",
+	"<", ">", "!", "(", ")", "-"}
+
+func isIdentifierRune(r rune, first bool) bool {
+	return r == '_' || unicode.IsLetter(r) ||
+		(!first && (r == '.' || unicode.IsDigit(r)))
+}
+
+func tokenizeRule(source string) (tokens []ruleToken, err error) {
+	runes := []rune(source)
+	for pos := 0; pos < len(runes); {
+		r := runes[pos]
+		switch {
+		case unicode.IsSpace(r):
+			pos++
+		case r == '"' || r == '\'':
+			end := pos + 1
+			for ; end < len(runes) && runes[end] != r; end++ {
+				if runes[end] == '\\' {
+					end++
+				}
+			}
+			if end >= len(runes) {
+				return nil, fmt.Errorf("unterminated string")
+			}
+			text := string(runes[pos : end+1])
+			value := string(runes[pos+1 : end])
+			if r == '"' {
+				if value, err = strconv.Unquote(text); err != nil {
+					return nil, fmt.Errorf("bad string %s", text)
+				}
+			}
+			tokens = append(tokens, ruleToken{ruleTokenString, text, value})
+			pos = end + 1
+		case unicode.IsDigit(r) || r == '.':
+			end := pos
+			for end < len(runes) &&
+				(unicode.IsDigit(runes[end]) || runes[end] == '.') {
+				end++
+			}
+			text := string(runes[pos:end])
+			value, parseErr := strconv.ParseFloat(text, 64)
+			if parseErr != nil {
+				return nil, fmt.Errorf("bad number `%s`", text)
+			}
+			tokens = append(tokens, ruleToken{ruleTokenNumber, text, value})
+			pos = end
+		case isIdentifierRune(r, true):
+			end := pos
+			for end < len(runes) && isIdentifierRune(runes[end], end == pos) {
+				end++
+			}
+			text := string(runes[pos:end])
+			tokens = append(tokens, ruleToken{ruleTokenIdentifier, text, nil})
+			pos = end
+		default:
+			matched := false
+			for _, op := range ruleOperators {
+				if strings.HasPrefix(string(runes[pos:]), op) {
+					tokens = append(tokens,
+						ruleToken{ruleTokenOperator, op, nil})
+					pos += len([]rune(op))
+					matched = true
+					break
+				}
+			}
+			if !matched {
+				return nil, fmt.Errorf("unexpected `%c`", r)
+			}
+		}
+	}
+	return tokens, nil
+}
+
+//
+// Parser - a recursive descent parser, from lowest to highest precedence:
+//          `||`, `&&`, `!`, comparisons, then literals, fields, unary `-`
+//          and parentheses.
+//
+
+type ruleParser struct {
+	tokens []ruleToken
+	pos    int
+}
+
+func (parser *ruleParser) peekOperator(ops ...string) string {
+	if parser.pos >= len(parser.tokens) ||
+		parser.tokens[parser.pos].kind != ruleTokenOperator {
+		return ""
+	}
+	for _, op := range ops {
+		if parser.tokens[parser.pos].text == op {
+			return op
+		}
+	}
+	return ""
+}
+
+func (parser *ruleParser) parseOr() (ruleExpr, error) {
+	left, err := parser.parseAnd()
+	for err == nil && parser.peekOperator("||") != "" {
+		parser.pos++
+		var right ruleExpr
+		if right, err = parser.parseAnd(); err == nil {
+			left = &ruleBinary{"||", left, right}
+		}
+	}
+	return left, err
+}
+
+func (parser *ruleParser) parseAnd() (ruleExpr, error) {
+	left, err := parser.parseNot()
+	for err == nil && parser.peekOperator("&&") != "" {
+		parser.pos++
+		var right ruleExpr
+		if right, err = parser.parseNot(); err == nil {
+			left = &ruleBinary{"&&", left, right}
+		}
+	}
+	return left, err
+}
+
+func (parser *ruleParser) parseNot() (ruleExpr, error) {
+	if parser.peekOperator("!") != "" {
+		parser.pos++
+		operand, err := parser.parseNot()
+		return &ruleNot{operand}, err
+	}
+	return parser.parseComparison()
+}
+
+func (parser *ruleParser) parseComparison() (ruleExpr, error) {
+	left, err := parser.parsePrimary()
+	if err != nil {
+		return nil, err
+	}
+	if op := parser.peekOperator("==", "!=", "<=", ">=", "<", ">"); op != "" {
+		parser.pos++
+		right, err := parser.parsePrimary()
+		if err != nil {
+			return nil, err
+		}
+		return &ruleBinary{op, left, right}, nil
+	}
+	return left, nil
+}
+
+func (parser *ruleParser) parsePrimary() (ruleExpr, error) {
+	if parser.pos >= len(parser.tokens) {
+		return nil, fmt.Errorf("unexpected end of expression")
+	}
+	token := parser.tokens[parser.pos]
+	parser.pos++
+	switch token.kind {
+	case ruleTokenNumber, ruleTokenString:
+		return &ruleLiteral{token.value}, nil
+	case ruleTokenIdentifier:
+		switch token.text {
+		case "true":
+			return &ruleLiteral{true}, nil
+		case "false":
+			return &ruleLiteral{false}, nil
+		case "null":
+			return &ruleLiteral{nil}, nil
+		}
+		if !isRuleField(token.text) {
+			return nil, fmt.Errorf("unknown field `%s`", token.text)
+		}
+		return &ruleField{token.text}, nil
+	}
+	switch token.text {
+	case "(":
+		expr, err := parser.parseOr()
+		if err != nil {
+			return nil, err
+		}
+		if parser.peekOperator(")") == "" {
+			return nil, fmt.Errorf("missing `)`")
+		}
+		parser.pos++
+		return expr, nil
+	case "-":
+		if parser.pos < len(parser.tokens) &&
+			parser.tokens[parser.pos].kind == ruleTokenNumber {
+			parser.pos++
+			return &ruleLiteral{
+				-parser.tokens[parser.pos-1].value.(float64)}, nil
+		}
+	}
+	return nil, fmt.Errorf("unexpected `%s`", token.text)
+}
+
+//
+// Evaluation
+//
+
+type ruleLiteral struct {
+	value interface{}
+}
+
+func (literal *ruleLiteral) eval(*ContentTest) (interface{}, error) {
+	return literal.value, nil
+}
+
+type ruleNot struct {
+	operand ruleExpr
+}
+
+func (not *ruleNot) eval(ct *ContentTest) (interface{}, error) {
+	value, err := not.operand.eval(ct)
+	if err != nil {
+		return nil, err
+	}
+	boolean, ok := value.(bool)
+	if !ok {
+		return nil, fmt.Errorf("`!` needs a boolean, not %v", value)
+	}
+	return !boolean, nil
+}
+
+type ruleBinary struct {
+	op    string
+	left  ruleExpr
+	right ruleExpr
+}
+
+func (binary *ruleBinary) eval(ct *ContentTest) (interface{}, error) {
+	left, err := binary.left.eval(ct)
+	if err != nil {
+		return nil, err
+	}
+	if binary.op == "&&" || binary.op == "||" {
+		leftBool, ok := left.(bool)
+		if !ok {
+			return nil, fmt.Errorf("`%s` needs booleans, not %v",
+				binary.op, left)
+		}
+		// Short circuit.
+		if leftBool == (binary.op == "||") {
+			return leftBool, nil
+		}
+		right, err := binary.right.eval(ct)
+		if err != nil {
+			return nil, err
+		}
+		rightBool, ok := right.(bool)
+		if !ok {
+			return nil, fmt.Errorf("`%s` needs booleans, not %v",
+				binary.op, right)
+		}
+		return rightBool, nil
+	}
+	right, err := binary.right.eval(ct)
+	if err != nil {
+		return nil, err
+	}
+	switch binary.op {
+	case "==":
+		return left == right, nil
+	case "!=":
+		return left != right, nil
+	}
+	if leftNum, ok := left.(float64); ok {
+		if rightNum, ok := right.(float64); ok {
+			switch binary.op {
+			case "<":
+				return leftNum < rightNum, nil
+			case "<=":
+				return leftNum <= rightNum, nil
+			case ">":
+				return leftNum > rightNum, nil
+			case ">=":
+				return leftNum >= rightNum, nil
+			}
+		}
+	}
+	if leftStr, ok := left.(string); ok {
+		if rightStr, ok := right.(string); ok {
+			switch binary.op {
+			case "<":
+				return leftStr < rightStr, nil
+			case "<=":
+				return leftStr <= rightStr, nil
+			case ">":
+				return leftStr > rightStr, nil
+			case ">=":
+				return leftStr >= rightStr, nil
+			}
+		}
+	}
+	return nil, fmt.Errorf("cannot compare %v %s %v", left, binary.op, right)
+}
+
+type ruleField struct {
+	name string
+}
+
+var ruleContentFields = map[string]func(ct *ContentTest) interface{}{
+	"prompt":          func(ct *ContentTest) interface{} { return ct.Prompt },
+	"memory":          func(ct *ContentTest) interface{} { return ct.Memory },
+	"authors_note":    func(ct *ContentTest) interface{} { return ct.AuthorsNote },
+	"prompt_filename": func(ct *ContentTest) interface{} { return ct.PromptFilename },
+	"module_filename": func(ct *ContentTest) interface{} { return ct.ModuleFilename },
+}
+
+func isRuleField(name string) bool {
+	if _, ok := ruleContentFields[name]; ok {
+		return true
+	} else if strings.HasPrefix(name, "placeholders.") {
+		return true
+	}
+	_, ok := parameterField(strings.TrimPrefix(name, parameterPrefix))
+	return ok
+}
+
+func (field *ruleField) eval(ct *ContentTest) (interface{}, error) {
+	if value, ok := ruleContentFields[field.name]; ok {
+		return value(ct), nil
+	} else if strings.HasPrefix(field.name, "placeholders.") {
+		if value, ok := ct.Placeholders[strings.TrimPrefix(field.name,
+			"placeholders.")]; ok {
+			return value, nil
+		}
+		return nil, nil
+	}
+	paramField, _ := parameterField(strings.TrimPrefix(field.name,
+		parameterPrefix))
+	value := reflect.ValueOf(ct.Parameters).FieldByIndex(paramField.Index)
+	if value.Kind() == reflect.Ptr {
+		if value.IsNil() {
+			return nil, nil
+		}
+		value = value.Elem()
+	}
+	switch value.Kind() {
+	case reflect.Bool:
+		return value.Bool(), nil
+	case reflect.String:
+		return value.String(), nil
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32,
+		reflect.Int64:
+		return float64(value.Int()), nil
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32,
+		reflect.Uint64:
+		return float64(value.Uint()), nil
+	case reflect.Float32, reflect.Float64:
+		return value.Float(), nil
+	}
+	return nil, fmt.Errorf("`%s` cannot be compared", field.name)
+}
+
+type permutationRules struct {
+	exclude     []*PermutationRule
+	includeOnly []*PermutationRule
+}
+
+// compileRules compiles the spec's `exclude` and `include_only` rules.
+func (spec *PermutationsSpec) compileRules() (rules permutationRules,
+	err error) {
+	for _, source := range spec.Exclude {
+		rule, err := CompileRule(source)
+		if err != nil {
+			return rules, err
+		}
+		rules.exclude = append(rules.exclude, rule)
+	}
+	for _, source := range spec.IncludeOnly {
+		rule, err := CompileRule(source)
+		if err != nil {
+			return rules, err
+		}
+		rules.includeOnly = append(rules.includeOnly, rule)
+	}
+	return rules, nil
+}
+
+// includes reports whether the permutation `ct` should be performed: it must
+// match none of the `exclude` rules and, if there are any `include_only`
+// rules, at least one of those.
+func (rules *permutationRules) includes(ct *ContentTest) (bool, error) {
+	for _, rule := range rules.exclude {
+		if matched, err := rule.Matches(ct); err != nil || matched {
+			return false, err
+		}
+	}
+	if len(rules.includeOnly) == 0 {
+		return true, nil
+	}
+	for _, rule := range rules.includeOnly {
+		if matched, err := rule.Matches(ct); err != nil || matched {
+			return matched, err
+		}
+	}
+	return false, nil
+}
@@ -0,0 +1,112 @@
+package scenario
+
+import (
+	"github.com/wbrown/gpt_bpe"
+)
+
+//
+// Lorebook categories - can disable their entries as a group, supply defaults
+// for them, and gather them into a sub-context with a budget of its own.
+//
+
+func (lorebook *Lorebook) category(id *string) *Category {
+	if id == nil {
+		return nil
+	}
+	for categoryIdx := range lorebook.Categories {
+		category := &lorebook.Categories[categoryIdx]
+		if category.Id != nil && *category.Id == *id {
+			return category
+		}
+	}
+	return nil
+}
+
+// isEnabled returns whether the entry and its category, if any, are enabled.
+func (lorebook *Lorebook) isEnabled(lorebookEntry *LorebookEntry) bool {
+	if lorebookEntry.Enabled != nil && !*lorebookEntry.Enabled {
+		return false
+	}
+	category := lorebook.category(lorebookEntry.CategoryId)
+	return category == nil || category.Enabled == nil || *category.Enabled
+}
+
+// RealizeCategoryDefaults fills in the fields that entries leave unset from
+// the defaults of their category, for categories that use them. Fields of the
+// context configuration are filled in individually.
+func (lorebook *Lorebook) RealizeCategoryDefaults() {
+	for loreIdx := range lorebook.Entries {
+		entry := &lorebook.Entries[loreIdx]
+		category := lorebook.category(entry.CategoryId)
+		if category == nil || category.UseCategoryDefaults == nil ||
+			!*category.UseCategoryDefaults ||
+			category.CategoryDefaults == nil {
+			continue
+		}
+		defaults := category.CategoryDefaults
+		// Take copies of what entries modify, rather than share them.
+		if defaults.ContextCfg != nil {
+			cfg := *defaults.ContextCfg
+			if entry.ContextCfg != nil {
+				cfg.coerceDefaults(*entry.ContextCfg)
+			}
+			entry.ContextCfg = &cfg
+		}
+		if entry.Keys == nil && defaults.Keys != nil {
+			keys := append([]string{}, *defaults.Keys...)
+			entry.Keys = &keys
+		}
+		defaults.RealizeDefaults(entry)
+	}
+}
+
+// buildSubcontexts gathers the active entries of each category that creates
+// a sub-context into a single entry, realized within the sub-context's own
+// token budget, or `budget` if that is smaller. Other entries are returned as
+// they are.
+func (lorebook *Lorebook) buildSubcontexts(encoder *gpt_bpe.GPTEncoder,
+	entries ContextEntries, budget int) (resolved ContextEntries) {
+	var categories []*Category
+	members := make(map[*Category]ContextEntries)
+	for _, entry := range entries {
+		category := lorebook.category(entry.Category)
+		if category == nil || category.CreateSubcontext == nil ||
+			!*category.CreateSubcontext {
+			resolved = append(resolved, entry)
+			continue
+		}
+		if _, ok := members[category]; !ok {
+			categories = append(categories, category)
+		}
+		members[category] = append(members[category], entry)
+	}
+	for _, category := range categories {
+		cfg := CreateDefaultContextConfig()
+		if category.SubcontextSettings != nil &&
+			category.SubcontextSettings.ContextCfg != nil {
+			cfg.coerceDefaults(*category.SubcontextSettings.ContextCfg)
+		}
+		subBudget := budget
+		if *cfg.TokenBudget > 0 && *cfg.TokenBudget < budget {
+			subBudget = *cfg.TokenBudget
+		}
+		cb := NewContextBuilder(encoder)
+		categoryMembers := members[category]
+		cb.AppendContexts(&categoryMembers)
+		text, report := cb.Realize(subBudget)
+		label := ""
+		if category.Name != nil {
+			label = *category.Name
+		} else if category.Id != nil {
+			label = *category.Id
+		}
+		resolved = append(resolved, ContextEntry{
+			Text:       &text,
+			ContextCfg: &cfg,
+			Label:      label,
+			Index:      categoryMembers[0].Index,
+			Subcontext: report,
+		})
+	}
+	return resolved
+}
@@ -0,0 +1,113 @@
+package scenario
+
+import (
+	"fmt"
+	"reflect"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+//
+// Ephemeral context - entries that are only inserted into the context for a
+// span of generation steps, written in NovelAI's `{+delay~duration,position:
+// text}` syntax.
+//
+
+// EphemeralEntry is active from `StartingStep + Delay` for `Duration` steps.
+type EphemeralEntry struct {
+	Text         *string        `json:"text,omitempty"`
+	ContextCfg   *ContextConfig `json:"contextConfig,omitempty"`
+	StartingStep int            `json:"startingStep"`
+	Delay        int            `json:"delay"`
+	Duration     int            `json:"duration"`
+}
+
+var ephemeralRegex = regexp.MustCompile(
+	`(?s)^\{(\+?)(\d+)(?:~(\d+))?(?:,(-?\d+))?:(.*)\}$`)
+
+// CreateEphemeralContextConfig returns the configuration of ephemeral entries
+// that don't have their own: inserted at `insertionPosition` after
+// everything else, with reserved tokens so that they aren't crowded out.
+func CreateEphemeralContextConfig(insertionPosition int) ContextConfig {
+	cfg := CreateDefaultContextConfig()
+	*cfg.ReservedTokens = 2048
+	*cfg.BudgetPriority = -10000
+	*cfg.InsertionPosition = insertionPosition
+	*cfg.Force = true
+	return cfg
+}
+
+// ParseEphemeralEntry parses `text` in the `{+delay~duration,position:text}`
+// syntax, created at generation step `step`. A delay prefixed with `+` is
+// relative to `step`; without it, the delay is the absolute step the entry
+// starts at. The duration defaults to 1 step, and the position to -1, the end
+// of the context.
+func ParseEphemeralEntry(text string, step int) (entry EphemeralEntry,
+	err error) {
+	parts := ephemeralRegex.FindStringSubmatch(strings.TrimSpace(text))
+	if parts == nil {
+		return entry, fmt.Errorf("ephemeral: `%s` is not of the form "+
+			"`{+delay~duration,position:text}`", text)
+	}
+	if parts[1] == "+" {
+		entry.StartingStep = step
+	}
+	entry.Delay, _ = strconv.Atoi(parts[2])
+	entry.Duration = 1
+	if parts[3] != "" {
+		entry.Duration, _ = strconv.Atoi(parts[3])
+	}
+	position := -1
+	if parts[4] != "" {
+		position, _ = strconv.Atoi(parts[4])
+	}
+	cfg := CreateEphemeralContextConfig(position)
+	entry.ContextCfg = &cfg
+	entry.Text = &parts[5]
+	return entry, nil
+}
+
+// coerceDefaults overrides the configuration with the fields that are set in
+// `cfg`.
+func (defaults *ContextConfig) coerceDefaults(cfg ContextConfig) {
+	fields := reflect.ValueOf(cfg)
+	for field := 0; field < fields.NumField(); field++ {
+		if !fields.Field(field).IsNil() {
+			reflect.ValueOf(defaults).Elem().Field(field).Set(
+				fields.Field(field))
+		}
+	}
+}
+
+// Active returns whether the entry is inserted at generation step `step`.
+func (entry *EphemeralEntry) Active(step int) bool {
+	start := entry.StartingStep + entry.Delay
+	return step >= start && step < start+entry.Duration
+}
+
+// resolveEphemeral returns the ephemeral entries active at the scenario's
+// current step.
+func (scenario *Scenario) resolveEphemeral(
+	placeholders *Placeholders) (entries ContextEntries) {
+	beginIdx := 1 + len(scenario.Context) + len(scenario.Lorebook.Entries)
+	for ephemeralIdx := range scenario.EphemeralContext {
+		ephemeral := &scenario.EphemeralContext[ephemeralIdx]
+		if ephemeral.Text == nil || !ephemeral.Active(scenario.Step) {
+			continue
+		}
+		// Scenarios' entries may leave out fields of their configuration.
+		cfg := CreateEphemeralContextConfig(-1)
+		if ephemeral.ContextCfg != nil {
+			cfg.coerceDefaults(*ephemeral.ContextCfg)
+		}
+		resolvedText := placeholders.ReplacePlaceholders(*ephemeral.Text)
+		entries = append(entries, ContextEntry{
+			Text:       &resolvedText,
+			ContextCfg: &cfg,
+			Label:      fmt.Sprintf("Ephemeral %d", ephemeralIdx+1),
+			Index:      uint(beginIdx + ephemeralIdx),
+		})
+	}
+	return entries
+}
@@ -0,0 +1,277 @@
+package scenario
+
+import (
+	"regexp"
+	"sort"
+	"strings"
+	"unicode/utf8"
+
+	"github.com/wbrown/gpt_bpe"
+)
+
+//
+// Insertion - entries are inserted into the context at positions counted in
+// newlines, sentences or tokens, and are kept out of the entries that don't
+// allow insertion inside of them.
+//
+
+type InsertionType uint
+
+const (
+	InsertNewlines InsertionType = iota
+	InsertSentences
+	InsertTokens
+)
+
+func (context *ContextEntry) getInsertionType() InsertionType {
+	if context.ContextCfg.InsertionType == nil {
+		return InsertNewlines
+	}
+	switch *context.ContextCfg.InsertionType {
+	case "sentence":
+		return InsertSentences
+	case "token":
+		return InsertTokens
+	default:
+		return InsertNewlines
+	}
+}
+
+// allowInnerInsertion returns whether the entry may be inserted inside other
+// entries; unset, it may.
+func (context *ContextEntry) allowInnerInsertion() bool {
+	return context.ContextCfg.AllowInnerInsertion == nil ||
+		*context.ContextCfg.AllowInnerInsertion
+}
+
+// allowInsertionInside returns whether other entries may be inserted inside
+// the entry; unset, they may.
+func (context *ContextEntry) allowInsertionInside() bool {
+	return context.ContextCfg.AllowInsertionInside == nil ||
+		*context.ContextCfg.AllowInsertionInside
+}
+
+// sentenceEndRegex matches the end of a sentence and the whitespace after it.
+var sentenceEndRegex = regexp.MustCompile(`[.!?]+["'”’)\]]*[ \t]+`)
+
+// contextSpan is a run of the context's text inserted by the entry `owner`,
+// or -1 for the newlines that separate entries.
+type contextSpan struct {
+	text  string
+	owner int
+}
+
+// builtContext is the context as entries are inserted into it, keeping track
+// of which entry each part of the text came from.
+type builtContext struct {
+	spans       []contextSpan
+	allowInside map[int]bool
+}
+
+func newBuiltContext() *builtContext {
+	return &builtContext{allowInside: make(map[int]bool)}
+}
+
+func (built *builtContext) String() string {
+	var sb strings.Builder
+	for _, span := range built.spans {
+		sb.WriteString(span.text)
+	}
+	return sb.String()
+}
+
+// boundaries returns the offsets that entries can be inserted at, counted in
+// `unit`. The last one is always the end of the context.
+func (built *builtContext) boundaries(encoder *gpt_bpe.GPTEncoder,
+	unit InsertionType) []int {
+	text := built.String()
+	offsets := []int{0}
+	for offset := range text {
+		if text[offset] == '\n' {
+			offsets = append(offsets, offset+1)
+		}
+	}
+	switch unit {
+	case InsertSentences:
+		lineStart := 0
+		for _, line := range strings.Split(text, "\n") {
+			for _, match := range sentenceEndRegex.FindAllStringIndex(
+				line, -1) {
+				if match[1] < len(line) {
+					offsets = append(offsets, lineStart+match[1])
+				}
+			}
+			lineStart += len(line) + 1
+		}
+	case InsertTokens:
+		offset := 0
+		for _, token := range *encoder.Encode(&text) {
+			offset += len(encoder.Decode(&gpt_bpe.Tokens{token}))
+			if offset >= len(text) {
+				break
+			}
+			if utf8.RuneStart(text[offset]) {
+				offsets = append(offsets, offset)
+			}
+		}
+	}
+	sort.Ints(offsets)
+	deduplicated := offsets[:1]
+	for _, offset := range offsets[1:] {
+		if offset != deduplicated[len(deduplicated)-1] {
+			deduplicated = append(deduplicated, offset)
+		}
+	}
+	// The end is distinct from a last, empty line starting at the same
+	// offset, as entries inserted at the end go on a line of their own.
+	return append(deduplicated, len(text))
+}
+
+// ownerRange returns the offsets that the text of the entry `owner` starts
+// and ends at, including anything inserted inside of it.
+func (built *builtContext) ownerRange(owner int) (start int, end int) {
+	start = -1
+	offset := 0
+	for _, span := range built.spans {
+		if span.owner == owner {
+			if start == -1 {
+				start = offset
+			}
+			end = offset + len(span.text)
+		}
+		offset += len(span.text)
+	}
+	return start, end
+}
+
+// blocked returns whether inserting an entry at `offset` would put it inside
+// an entry that doesn't allow it, or inside any entry if the inserted entry
+// doesn't allow `inner` insertion.
+func (built *builtContext) blocked(offset int, inner bool) bool {
+	for owner, allowInside := range built.allowInside {
+		if inner && allowInside {
+			continue
+		}
+		if start, end := built.ownerRange(owner); start < offset &&
+			offset < end {
+			return true
+		}
+	}
+	return false
+}
+
+// insertionBoundary returns the index into `boundaries` of the closest
+// boundary to `at` that isn't blocked, looking away from where the position
+// was counted from: upwards for positions counted from the bottom.
+func (built *builtContext) insertionBoundary(boundaries []int, at int,
+	fromBottom bool, inner bool) int {
+	step := 1
+	if fromBottom {
+		step = -1
+	}
+	for _, direction := range []int{step, -step} {
+		for idx := at; idx >= 0 && idx < len(boundaries); idx += direction {
+			if !built.blocked(boundaries[idx], inner) {
+				return idx
+			}
+		}
+	}
+	return at
+}
+
+// position returns the index into `boundaries` that an entry inserted at
+// `insertion` goes at, counting from the top, or from the bottom if negative,
+// where -1 is the end.
+func position(boundaries []int, insertion int) int {
+	if insertion < 0 {
+		insertion += len(boundaries)
+	}
+	if insertion < 0 {
+		return 0
+	} else if insertion >= len(boundaries) {
+		return len(boundaries) - 1
+	}
+	return insertion
+}
+
+// keyRelativePosition returns the index into `boundaries` that a
+// key-relative entry inserted at `insertion` goes at: 0 is directly below the
+// last line of the context that is `keyLine`, positive values are further
+// below it and negative values above it. It returns false if no line is
+// `keyLine`.
+func (built *builtContext) keyRelativePosition(boundaries []int,
+	keyLine string, insertion int) (int, bool) {
+	text := built.String()
+	lines := strings.Split(text, "\n")
+	lineEnd := len(text)
+	for lineIdx := len(lines) - 1; lineIdx >= 0; lineIdx-- {
+		lineStart := lineEnd - len(lines[lineIdx])
+		if lines[lineIdx] == keyLine {
+			anchor := len(boundaries) - 1
+			for boundaryIdx, offset := range boundaries[:anchor] {
+				if offset > lineEnd {
+					anchor = boundaryIdx
+					break
+				}
+			}
+			at := anchor + insertion
+			if at < 0 {
+				return 0, true
+			} else if at >= len(boundaries) {
+				return len(boundaries) - 1, true
+			}
+			return at, true
+		}
+		lineEnd = lineStart - 1
+	}
+	return 0, false
+}
+
+// insert adds the text of the entry `owner` at `offset`, followed by a
+// newline, or on a line of its own after everything else if `atEnd`.
+func (built *builtContext) insert(owner int, text string, offset int,
+	atEnd bool, allowInside bool) {
+	built.allowInside[owner] = allowInside
+	entry := contextSpan{text: text, owner: owner}
+	separator := contextSpan{text: "\n", owner: -1}
+	if len(built.spans) == 0 {
+		built.spans = []contextSpan{entry}
+		return
+	} else if atEnd {
+		built.spans = append(built.spans, separator, entry)
+		return
+	}
+	spans := make([]contextSpan, 0, len(built.spans)+3)
+	spanStart := 0
+	inserted := false
+	for _, span := range built.spans {
+		spanEnd := spanStart + len(span.text)
+		if !inserted && offset < spanEnd {
+			if offset > spanStart {
+				spans = append(spans, contextSpan{
+					text:  span.text[:offset-spanStart],
+					owner: span.owner,
+				})
+				span.text = span.text[offset-spanStart:]
+			}
+			spans = append(spans, entry, separator)
+			inserted = true
+		}
+		spans = append(spans, span)
+		spanStart = spanEnd
+	}
+	if !inserted {
+		spans = append(spans, entry, separator)
+	}
+	built.spans = spans
+}
+
+// insertEntry inserts `text` of the entry `owner` at the boundary `at` of
+// `boundaries`, moved out of the entries that it can't be inserted inside.
+func (built *builtContext) insertEntry(ctx *ContextEntry, owner int,
+	text string, boundaries []int, at int, fromBottom bool) {
+	at = built.insertionBoundary(boundaries, at, fromBottom,
+		ctx.allowInnerInsertion())
+	built.insert(owner, text, boundaries[at], at == len(boundaries)-1,
+		ctx.allowInsertionInside())
+}
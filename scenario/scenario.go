@@ -2,6 +2,7 @@ package scenario
 
 import (
 	"encoding/json"
+	"fmt"
 	"github.com/wbrown/gpt_bpe"
 	"github.com/wbrown/novelai-research-tool/aimodules"
 	novelai_api "github.com/wbrown/novelai-research-tool/novelai-api"
@@ -35,7 +36,20 @@ type ContextEntry struct {
 	Tokens       *gpt_bpe.Tokens      `json:"-" yaml:"-"`
 	Label        string               `json:"-" yaml:"-"`
 	MatchIndexes []map[string][][]int `json:"-" yaml:"-"`
-	Index        uint                 `json:"-" yaml:"-"`
+	// ActivatedBy holds the labels of the entries whose text activated a
+	// cascading lorebook entry.
+	ActivatedBy []string `json:"-" yaml:"-"`
+	// Category is the id of a lorebook entry's category.
+	Category *string `json:"-" yaml:"-"`
+	// Subcontext reports on the entries gathered into a category's
+	// sub-context.
+	Subcontext ContextReport `json:"-" yaml:"-"`
+	// KeyRelative entries are inserted relative to KeyLine, the line of the
+	// story holding their last key match, which starts at KeyLocation.
+	KeyRelative bool   `json:"-" yaml:"-"`
+	KeyLine     string `json:"-" yaml:"-"`
+	KeyLocation int    `json:"-" yaml:"-"`
+	Index       uint   `json:"-" yaml:"-"`
 }
 
 type ContextEntries []ContextEntry
@@ -180,10 +194,14 @@ type Scenario struct {
 	Lorebook           Lorebook            `json:"lorebook,omitempty"`
 	Placeholders       []Placeholder       `json:"placeholders,omitempty"`
 	StoryContextConfig *ContextConfig      `json:"storyContextConfig,omitempty"`
+	EphemeralContext   []EphemeralEntry    `json:"ephemeralContext,omitempty"`
 	Biases             *structs.BiasGroups `json:"-" yaml:"biases"`
 	AIModule           *aimodules.AIModule `json:"-"`
 	PlaceholderMap     Placeholders        `json:"-"`
 	Encoder            *gpt_bpe.GPTEncoder `json:"-"`
+	// Step is the generation step that the context is generated for, which
+	// decides the ephemeral entries that are active.
+	Step int `json:"-"`
 }
 
 type ContextReportEntry struct {
@@ -194,92 +212,250 @@ type ContextReportEntry struct {
 	BudgetRemaining   int                  `json:"budget_remaining"`
 	ReservedRemaining int                  `json:"reserved_remaining"`
 	MatchIndexes      []map[string][][]int `json:"matches"`
+	ActivatedBy       []string             `json:"activated_by,omitempty"`
+	Subcontext        ContextReport        `json:"subcontext,omitempty"`
 	Forced            bool                 `json:"forced"`
 }
 
 type ContextReport []ContextReportEntry
 
-func createLorebookRegexp(key string) *regexp.Regexp {
+var regexKeyRegex = regexp.MustCompile(`^/(.+)/([a-z]*)$`)
+
+// createLorebookRegexp compiles a lorebook key. Keys of the form
+// `/pattern/flags` are regular expressions, case sensitive unless given the
+// `i` flag; any other key matches as a case insensitive whole word. Keys
+// written for JavaScript's regular expressions may not compile.
+func createLorebookRegexp(key string) (*regexp.Regexp, error) {
+	if parts := regexKeyRegex.FindStringSubmatch(key); parts != nil {
+		flags := ""
+		for _, flag := range parts[2] {
+			switch flag {
+			case 'i', 'm', 's':
+				flags += string(flag)
+			case 'g', 'u', 'y':
+				// These change how JavaScript iterates over matches,
+				// which doesn't apply to finding keys.
+			default:
+				return nil, fmt.Errorf(
+					"lorebook: unknown flag `%c` in key `%s`", flag, key)
+			}
+		}
+		pattern := parts[1]
+		if flags != "" {
+			pattern = "(?" + flags + ")" + pattern
+		}
+		keyRegex, err := regexp.Compile(pattern)
+		if err != nil {
+			return nil, fmt.Errorf(
+				"lorebook: invalid regular expression key `%s`: %v", key, err)
+		}
+		return keyRegex, nil
+	}
 	keyRegex, err := regexp.Compile("(?i)(^|\\W)(" + key + ")($|\\W)")
 	if err != nil {
-		log.Fatal(err)
+		return nil, fmt.Errorf("lorebook: invalid key `%s`: %v", key, err)
+	}
+	return keyRegex, nil
+}
+
+// compileLorebookKey compiles a lorebook key with createLorebookRegexp,
+// logging a key that doesn't compile and returning nil, which never matches.
+func compileLorebookKey(key string) *regexp.Regexp {
+	keyRegex, err := createLorebookRegexp(key)
+	if err != nil {
+		log.Printf("%v; skipping the key", err)
 	}
 	return keyRegex
 }
 
-func (lorebook *Lorebook) ResolveContexts(placeholders *Placeholders,
-	contexts *ContextEntries) (entries ContextEntries) {
-	beginIdx := len(*contexts)
-	for loreIdx := range lorebook.Entries {
-		lorebookEntry := lorebook.Entries[loreIdx]
-		if !*lorebookEntry.Enabled {
+// resolveKeys replaces any placeholders in the entry's keys, recompiling the
+// regular expressions of those that changed.
+func (lorebookEntry *LorebookEntry) resolveKeys(placeholders *Placeholders) {
+	keys := lorebookEntry.Keys
+	for keyIdx := range lorebookEntry.KeysRegex {
+		resolvedKey := placeholders.ReplacePlaceholders((*keys)[keyIdx])
+		if resolvedKey != (*keys)[keyIdx] {
+			(*keys)[keyIdx] = resolvedKey
+			lorebookEntry.KeysRegex[keyIdx] = compileLorebookKey(resolvedKey)
+		}
+	}
+}
+
+// matchKeys returns the locations of each of the entry's keys in the last
+// `searchRange` characters of `searchText`.
+func (lorebookEntry *LorebookEntry) matchKeys(searchText string,
+	searchRange int) (indexes []map[string][][]int) {
+	searchLen := len(searchText) - searchRange
+	if searchLen > 0 {
+		searchText = searchText[searchLen:]
+	}
+	for keyIdx, keyRegex := range lorebookEntry.KeysRegex {
+		if keyRegex == nil {
 			continue
 		}
-		keys := lorebookEntry.Keys
-		keysRegex := lorebookEntry.KeysRegex
-		indexes := make([]map[string][][]int, 0)
-		searchRange := lorebookEntry.SearchRange
-		for keyIdx := range keysRegex {
-			var keyRegex *regexp.Regexp
-			resolvedKey := placeholders.ReplacePlaceholders(
-				(*keys)[keyIdx])
-			if resolvedKey != (*keys)[keyIdx] {
-				(*keys)[keyIdx] = resolvedKey
-				keyRegex = createLorebookRegexp(resolvedKey)
-			} else {
-				keyRegex = keysRegex[keyIdx]
+		ctxMatches := keyRegex.FindAllStringIndex(searchText, -1)
+		if len(ctxMatches) == 0 {
+			continue
+		}
+		if searchLen > 0 {
+			for ctxMatchIdx := range ctxMatches {
+				ctxMatches[ctxMatchIdx][0] += searchLen
+				ctxMatches[ctxMatchIdx][1] += searchLen
 			}
-			for ctxIdx := range *contexts {
-				searchText := *(*contexts)[ctxIdx].Text
-				searchLen := len(searchText) - *searchRange
-				if searchLen > 0 {
-					searchText = searchText[searchLen:]
-				}
-				ctxMatches := keyRegex.FindAllStringIndex(searchText, -1)
-				keyMatches := make(map[string][][]int, 0)
-				if searchLen > 0 {
-					for ctxMatchIdx := range ctxMatches {
-						ctxMatches[ctxMatchIdx][0] =
-							ctxMatches[ctxMatchIdx][0] + searchLen
-						ctxMatches[ctxMatchIdx][1] =
-							ctxMatches[ctxMatchIdx][1] + searchLen
-					}
-				}
-				if len(ctxMatches) > 0 {
-					keyMatches[(*keys)[keyIdx]] = append(
-						keyMatches[(*keys)[keyIdx]], ctxMatches...)
-				}
-				if len(keyMatches) > 0 {
-					indexes = append(indexes, keyMatches)
+		}
+		key := (*lorebookEntry.Keys)[keyIdx]
+		indexes = append(indexes, map[string][][]int{key: ctxMatches})
+	}
+	return indexes
+}
+
+// lastKeyMatch returns where the last match in `indexes` starts.
+func lastKeyMatch(indexes []map[string][][]int) (location int, ok bool) {
+	location = -1
+	for _, keyMatches := range indexes {
+		for _, matches := range keyMatches {
+			for _, match := range matches {
+				if match[0] > location {
+					location = match[0]
 				}
 			}
 		}
+	}
+	return location, location >= 0
+}
+
+// lineAt returns the line of `text` that contains `offset`. As keys match
+// along with the character before them, a newline at `offset` is skipped.
+func lineAt(text string, offset int) string {
+	if offset < len(text) && text[offset] == '\n' {
+		offset++
+	}
+	start := strings.LastIndex(text[:offset], "\n") + 1
+	end := strings.Index(text[offset:], "\n")
+	if end < 0 {
+		return text[start:]
+	}
+	return text[start : offset+end]
+}
+
+// isCascading returns whether the entry can also be activated by the text of
+// other activated entries.
+func (lorebookEntry *LorebookEntry) isCascading() bool {
+	return lorebookEntry.NonStoryActivatable != nil &&
+		*lorebookEntry.NonStoryActivatable
+}
+
+func (lorebook *Lorebook) ResolveContexts(placeholders *Placeholders,
+	contexts *ContextEntries) (entries ContextEntries) {
+	beginIdx := len(*contexts)
+	activated := make(map[int]bool)
+	activate := func(loreIdx int, indexes []map[string][][]int,
+		activatedBy []string) *ContextEntry {
+		lorebookEntry := &lorebook.Entries[loreIdx]
 		resolvedText := placeholders.ReplacePlaceholders(
 			*lorebookEntry.Text)
 		label := placeholders.ReplacePlaceholders(
 			*lorebookEntry.DisplayName)
-
+		entries = append(entries, ContextEntry{
+			Text:         &resolvedText,
+			ContextCfg:   lorebookEntry.ContextCfg,
+			Label:        label,
+			MatchIndexes: indexes,
+			ActivatedBy:  activatedBy,
+			Category:     lorebookEntry.CategoryId,
+			KeyRelative: lorebookEntry.KeyRelative != nil &&
+				*lorebookEntry.KeyRelative,
+			KeyLocation: -1,
+			Index:       uint(beginIdx + loreIdx),
+		})
+		activated[loreIdx] = true
+		return &entries[len(entries)-1]
+	}
+	for loreIdx := range lorebook.Entries {
+		lorebookEntry := &lorebook.Entries[loreIdx]
+		if !lorebook.isEnabled(lorebookEntry) {
+			continue
+		}
+		lorebookEntry.resolveKeys(placeholders)
+		indexes := make([]map[string][][]int, 0)
+		keyLocation, keyLine := -1, ""
+		for ctxIdx := range *contexts {
+			text := *(*contexts)[ctxIdx].Text
+			ctxIndexes := lorebookEntry.matchKeys(text,
+				*lorebookEntry.SearchRange)
+			if location, ok := lastKeyMatch(ctxIndexes); ok &&
+				location >= keyLocation {
+				keyLocation, keyLine = location, lineAt(text, location)
+			}
+			indexes = append(indexes, ctxIndexes...)
+		}
 		if len(indexes) > 0 || *lorebookEntry.ForceActivation {
-			entry := ContextEntry{
-				Text:         &resolvedText,
-				ContextCfg:   lorebookEntry.ContextCfg,
-				Label:        label,
-				MatchIndexes: indexes,
-				Index:        uint(beginIdx + loreIdx),
+			entry := activate(loreIdx, indexes, nil)
+			entry.KeyLocation = keyLocation
+			entry.KeyLine = keyLine
+		}
+	}
+	// Cascading entries are also scanned against the whole text of the
+	// entries activated in the previous round, until a round activates no
+	// more. Each entry is activated at most once, so entries whose keys
+	// appear in each other's text can't cycle.
+	for scanFrom := 0; scanFrom < len(entries); {
+		scanTo := len(entries)
+		for loreIdx := range lorebook.Entries {
+			lorebookEntry := &lorebook.Entries[loreIdx]
+			if activated[loreIdx] || !lorebook.isEnabled(lorebookEntry) ||
+				!lorebookEntry.isCascading() {
+				continue
+			}
+			var activatedBy []string
+			for _, other := range entries[scanFrom:scanTo] {
+				if len(lorebookEntry.matchKeys(*other.Text,
+					len(*other.Text))) > 0 {
+					activatedBy = append(activatedBy, other.Label)
+				}
+			}
+			if len(activatedBy) > 0 {
+				activate(loreIdx, nil, activatedBy)
 			}
-			entries = append(entries, entry)
 		}
+		scanFrom = scanTo
+	}
+	if lorebook.Settings.OrderByKeyLocations {
+		orderByKeyLocations(entries)
 	}
 	return entries
 }
 
+// orderByKeyLocations reorders entries of the same budget priority by where
+// their keys were last found in the story, rather than by their order in the
+// lorebook, by exchanging their indexes. Entries whose keys weren't found,
+// such as forced ones, come first.
+func orderByKeyLocations(entries ContextEntries) {
+	indexes := make([]uint, 0, len(entries))
+	for _, entry := range entries {
+		indexes = append(indexes, entry.Index)
+	}
+	sort.Slice(indexes, func(i, j int) bool {
+		return indexes[i] < indexes[j]
+	})
+	byLocation := make([]*ContextEntry, 0, len(entries))
+	for entryIdx := range entries {
+		byLocation = append(byLocation, &entries[entryIdx])
+	}
+	sort.SliceStable(byLocation, func(i, j int) bool {
+		return byLocation[i].KeyLocation < byLocation[j].KeyLocation
+	})
+	for entryIdx, entry := range byLocation {
+		entry.Index = indexes[entryIdx]
+	}
+}
+
 /*
 Create context list
 Add story to context list
 Add story context array to list
 Add active lorebook entries to the context list
 Add active ephemeral entries to the context list
-Add cascading lorebook entries to the context list
 Determine token lengths of each entry
 Determine reserved tokens for each entry
 Sort context list by insertion order
@@ -372,6 +548,12 @@ func (context *ContextEntry) Clone() ContextEntry {
 		Index:        context.Index,
 		Label:        context.Label,
 		MatchIndexes: context.MatchIndexes,
+		ActivatedBy:  context.ActivatedBy,
+		Category:     context.Category,
+		Subcontext:   context.Subcontext,
+		KeyRelative:  context.KeyRelative,
+		KeyLine:      context.KeyLine,
+		KeyLocation:  context.KeyLocation,
 	}
 }
 
@@ -494,6 +676,12 @@ func (cb *ContextBuilder) ResolvePlaceholders() {
 
 }
 
+type deferredInsertion struct {
+	ctx   *ContextEntry
+	owner int
+	text  string
+}
+
 func (cb *ContextBuilder) Realize(budget int) (string, ContextReport) {
 	cb.Contexts.ApplyTokenizer(cb.Encoder)
 	reservations := 0
@@ -512,7 +700,8 @@ func (cb *ContextBuilder) Realize(budget int) (string, ContextReport) {
 	}
 	sort.Sort(sort.Reverse(cb.Contexts))
 	contextReport := make(ContextReport, 0)
-	newContexts := make([]string, 0)
+	built := newBuiltContext()
+	var deferred []deferredInsertion
 
 	for ctxIdx := range cb.Contexts {
 		ctx := cb.Contexts[ctxIdx]
@@ -528,9 +717,9 @@ func (cb *ContextBuilder) Realize(budget int) (string, ContextReport) {
 		numTokens := len(*trimmedTokens)
 		budget -= numTokens - reserved
 		reservations -= reserved
-		contextText := strings.Split(cb.Encoder.Decode(trimmedTokens),
-			"\n")
-		ctxInsertion := ctx.ContextCfg.InsertionPosition
+		contextText := cb.Encoder.Decode(trimmedTokens)
+		// Take a copy, as the config is shared with the scenario's entries.
+		ctxInsertion := *ctx.ContextCfg.InsertionPosition
 		if numTokens == 0 {
 			continue
 		} else {
@@ -542,34 +731,24 @@ func (cb *ContextBuilder) Realize(budget int) (string, ContextReport) {
 				BudgetRemaining:   budget,
 				ReservedRemaining: reservations,
 				MatchIndexes:      ctx.MatchIndexes,
+				ActivatedBy:       ctx.ActivatedBy,
+				Subcontext:        ctx.Subcontext,
 				Forced:            *ctx.ContextCfg.Force,
 			})
 		}
-		var before []string
-		var after []string
-		if *ctxInsertion < 0 {
-			*ctxInsertion += 1
-			if len(newContexts)+*ctxInsertion >= 0 {
-				before = newContexts[0 : len(newContexts)+*ctxInsertion]
-				after = newContexts[len(newContexts)+*ctxInsertion:]
-			} else {
-				before = []string{}
-				after = newContexts[0:]
-			}
-		} else {
-			before = newContexts[0:*ctxInsertion]
-			after = newContexts[*ctxInsertion:]
-		}
-		newContexts = make([]string, 0)
-		for bIdx := range before {
-			newContexts = append(newContexts, before[bIdx])
-		}
-		for cIdx := range contextText {
-			newContexts = append(newContexts, contextText[cIdx])
-		}
-		for aIdx := range after {
-			newContexts = append(newContexts, after[aIdx])
+		if ctx.KeyRelative && ctx.KeyLine != "" {
+			// The story may not have been inserted yet, so key-relative
+			// entries are placed once everything else has been.
+			deferred = append(deferred, deferredInsertion{
+				ctx:   &ctx,
+				owner: ctxIdx,
+				text:  contextText,
+			})
+			continue
 		}
+		boundaries := built.boundaries(cb.Encoder, ctx.getInsertionType())
+		built.insertEntry(&ctx, ctxIdx, contextText, boundaries,
+			position(boundaries, ctxInsertion), ctxInsertion < 0)
 		/* fmt.Printf("PRIORITY: %4v RESERVATIONS: %4v, RESERVED: %4v ACTUAL: %4v TRIMMED: %4v LEFT: %4v LABEL: %15v INSERTION_POS: %4v TRIM_TYPE: %8v TRIM_DIRECTION: %10v\n",
 			contexts[ctxIdx].ContextCfg.BudgetPriority,
 			reservations,
@@ -581,11 +760,21 @@ func (cb *ContextBuilder) Realize(budget int) (string, ContextReport) {
 			contexts[ctxIdx].ContextCfg.InsertionPosition,
 			contexts[ctxIdx].ContextCfg.MaximumTrimType,
 			contexts[ctxIdx].ContextCfg.TrimDirection)
-		for ctxTextIdx := range(newContexts) {
-			fmt.Printf("resolvedText: %v\n", newContexts[ctxTextIdx])
-		} */
+		fmt.Printf("resolvedText: %v\n", built) */
 	}
-	return strings.Join(newContexts, "\n"), contextReport
+	for _, insertion := range deferred {
+		ctxInsertion := *insertion.ctx.ContextCfg.InsertionPosition
+		boundaries := built.boundaries(cb.Encoder,
+			insertion.ctx.getInsertionType())
+		at, ok := built.keyRelativePosition(boundaries,
+			insertion.ctx.KeyLine, ctxInsertion)
+		if !ok {
+			at = position(boundaries, ctxInsertion)
+		}
+		built.insertEntry(insertion.ctx, insertion.owner, insertion.text,
+			boundaries, at, ctxInsertion < 0)
+	}
+	return built.String(), contextReport
 }
 
 func (scenario Scenario) GenerateContext(story string, budget int) (
@@ -595,16 +784,23 @@ func (scenario Scenario) GenerateContext(story string, budget int) (
 	cb.Placeholders = &scenario.PlaceholderMap
 	storyEntry := scenario.createStoryContext(story)
 	contexts := ContextEntries{storyEntry}
-	lorebookContexts := scenario.Lorebook.ResolveContexts(cb.Placeholders,
-		&contexts)
+	// Placeholders are replaced before the lorebook's keys are searched for,
+	// so that the key lines of key-relative entries are found in the story
+	// as it is inserted.
 	for ctxIdx := range contexts {
 		resolved := scenario.PlaceholderMap.ReplacePlaceholders(
 			*contexts[ctxIdx].Text)
 		contexts[ctxIdx].Text = &resolved
 	}
+	lorebookContexts := scenario.Lorebook.ResolveContexts(cb.Placeholders,
+		&contexts)
+	lorebookContexts = scenario.Lorebook.buildSubcontexts(scenario.Encoder,
+		lorebookContexts, budget)
 	cb.AppendContexts(&contexts)
 	cb.AppendContexts(&scenario.Context)
 	cb.AppendContexts(&lorebookContexts)
+	ephemeralContexts := scenario.resolveEphemeral(cb.Placeholders)
+	cb.AppendContexts(&ephemeralContexts)
 
 	budget -= int(*scenario.Settings.Parameters.MaxLength)
 	// Reserve 20 tokens if we're using an AI module.
@@ -751,6 +947,39 @@ func (scenario *Scenario) GetPlaceholderDefs() (defs Placeholders) {
 	return defs
 }
 
+// Clone returns a copy of the scenario that shares no mutable state with the
+// original, so that permutations can be performed concurrently.
+func (scenario *Scenario) Clone() Scenario {
+	clone := *scenario
+	clone.Context = make(ContextEntries, 0, len(scenario.Context))
+	for ctxIdx := range scenario.Context {
+		ctx := scenario.Context[ctxIdx].Clone()
+		ctx.Tokens = scenario.Context[ctxIdx].Tokens
+		clone.Context = append(clone.Context, ctx)
+	}
+	clone.Lorebook.Entries = make([]LorebookEntry, 0,
+		len(scenario.Lorebook.Entries))
+	for loreIdx := range scenario.Lorebook.Entries {
+		entry := scenario.Lorebook.Entries[loreIdx]
+		if entry.Keys != nil {
+			keys := append([]string{}, *entry.Keys...)
+			entry.Keys = &keys
+		}
+		entry.KeysRegex = append([]*regexp.Regexp{}, entry.KeysRegex...)
+		clone.Lorebook.Entries = append(clone.Lorebook.Entries, entry)
+	}
+	clone.PlaceholderMap = make(Placeholders, len(scenario.PlaceholderMap))
+	for k, v := range scenario.PlaceholderMap {
+		placeholder := *v
+		clone.PlaceholderMap[k] = &placeholder
+	}
+	if scenario.Settings.Parameters != nil {
+		parameters := *scenario.Settings.Parameters
+		clone.Settings.Parameters = &parameters
+	}
+	return clone
+}
+
 func (scenario *Scenario) SetMemory(memory string) {
 	scenario.Context[0].Text = &memory
 	scenario.Context[0].Tokens = scenario.Encoder.Encode(&memory)
@@ -761,6 +990,10 @@ func (scenario *Scenario) SetAuthorsNote(an string) {
 	scenario.Context[1].Tokens = scenario.Encoder.Encode(&an)
 }
 
+func (scenario *Scenario) SetStep(step int) {
+	scenario.Step = step
+}
+
 func (scenario *Scenario) GetEncoder() *gpt_bpe.GPTEncoder {
 	if scenario.Settings.Model != nil {
 		return novelai_api.GetEncoderByModel(*scenario.Settings.Model)
@@ -824,13 +1057,14 @@ func ScenarioFromFile(path string) (scenario Scenario,
 	scenario.Context[1].Label = "A/N"
 	scenario.Context[1].Index = 2
 	scenario.Context[1].ContextCfg.Force = &ctxCfgForce
+	scenario.Lorebook.RealizeCategoryDefaults()
 	for loreIdx := range scenario.Lorebook.Entries {
 		loreEntry := scenario.Lorebook.Entries[loreIdx]
 		loreEntry.ContextCfg.Force = loreEntry.ForceActivation
 		for keyIdx := range *loreEntry.Keys {
 			key := (*loreEntry.Keys)[keyIdx]
-			keyRegex := createLorebookRegexp(key)
-			loreEntry.KeysRegex = append(loreEntry.KeysRegex, keyRegex)
+			loreEntry.KeysRegex = append(loreEntry.KeysRegex,
+				compileLorebookKey(key))
 		}
 		scenario.Lorebook.Entries[loreIdx] = loreEntry
 	}
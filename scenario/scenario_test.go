@@ -81,6 +81,324 @@ func TestScenario_ResolveLorebook(t *testing.T) {
 	}
 }
 
+func testLorebookEntry(name string, text string, cascading bool,
+	keys ...string) LorebookEntry {
+	cfg := CreateDefaultContextConfig()
+	*cfg.ReservedTokens = 0
+	enabled, force, searchRange := true, false, 1000
+	entry := LorebookEntry{
+		Text:                &text,
+		ContextCfg:          &cfg,
+		DisplayName:         &name,
+		Keys:                &keys,
+		SearchRange:         &searchRange,
+		Enabled:             &enabled,
+		ForceActivation:     &force,
+		NonStoryActivatable: &cascading,
+	}
+	for _, key := range keys {
+		entry.KeysRegex = append(entry.KeysRegex, compileLorebookKey(key))
+	}
+	return entry
+}
+
+func TestLorebook_ResolveContexts_Cascading(t *testing.T) {
+	sc := ScenarioFromSpec("The knights rode up to the castle.", "", "",
+		"euterpe-v2")
+	sc.Settings.Parameters.CoerceDefaults()
+	sc.Lorebook.Entries = []LorebookEntry{
+		testLorebookEntry("Castle", "The castle is home to a dragon.",
+			false, "castle"),
+		testLorebookEntry("Dragon", "The dragon guards its hoard.",
+			true, "dragon"),
+		// The hoard and the dragon activate each other, which must not
+		// cycle.
+		testLorebookEntry("Hoard", "The hoard belongs to the dragon.",
+			true, "hoard"),
+		testLorebookEntry("Wyrm", "A wyrm is a kind of dragon.",
+			false, "dragon"),
+		testLorebookEntry("Gold", "Gold glitters.", true, "gold"),
+	}
+	entries := sc.Lorebook.ResolveContexts(&sc.PlaceholderMap,
+		&ContextEntries{sc.createStoryContext(sc.Prompt)})
+	activatedBy := make(map[string][]string)
+	for _, entry := range entries {
+		activatedBy[entry.Label] = entry.ActivatedBy
+	}
+	AssertEqual(t, activatedBy, map[string][]string{
+		"Castle": nil,
+		"Dragon": {"Castle"},
+		"Hoard":  {"Dragon"},
+	})
+
+	_, report := sc.GenerateContext(sc.Prompt, 2048)
+	reported := make(map[string][]string)
+	for _, entry := range report {
+		reported[entry.Label] = entry.ActivatedBy
+	}
+	AssertEqual(t, reported["Hoard"], []string{"Dragon"})
+	if _, ok := reported["Wyrm"]; ok {
+		t.Errorf("entries without cascading activation should only be " +
+			"activated by the story")
+	}
+}
+
+func TestLorebook_Categories(t *testing.T) {
+	sc := ScenarioFromSpec("The knights rode up to the castle.", "", "",
+		"euterpe-v2")
+	sc.Settings.Parameters.CoerceDefaults()
+	places, characters := "places", "characters"
+	name := "Characters"
+	enabled, disabled := true, false
+	defaults := testLorebookEntry("", "", false)
+	defaults.Keys = nil
+	*defaults.ContextCfg.BudgetPriority = 123
+	subcontextCfg := CreateDefaultContextConfig()
+	*subcontextCfg.TokenBudget = 64
+	*subcontextCfg.ReservedTokens = 0
+	sc.Lorebook.Categories = []Category{
+		{Id: &places, Enabled: &disabled},
+		{Id: &characters, Name: &name, Enabled: &enabled,
+			UseCategoryDefaults: &enabled, CategoryDefaults: &defaults,
+			CreateSubcontext:   &enabled,
+			SubcontextSettings: &LorebookEntry{ContextCfg: &subcontextCfg}},
+	}
+	castle := testLorebookEntry("Castle", "The castle is old.", false,
+		"castle")
+	castle.CategoryId = &places
+	gawain := testLorebookEntry("Gawain", "Gawain is a knight.", false,
+		"knights")
+	gawain.CategoryId = &characters
+	// Lancelot leaves his search range and most of his configuration to
+	// the category's defaults.
+	position := -1
+	lancelot := testLorebookEntry("Lancelot", "Lancelot is a knight.",
+		false, "knights")
+	lancelot.CategoryId = &characters
+	lancelot.SearchRange = nil
+	lancelot.ContextCfg = &ContextConfig{InsertionPosition: &position}
+	sc.Lorebook.Entries = []LorebookEntry{castle, gawain, lancelot}
+
+	sc.Lorebook.RealizeCategoryDefaults()
+	realized := sc.Lorebook.Entries[2]
+	if realized.SearchRange == nil || *realized.SearchRange != 1000 ||
+		*realized.ContextCfg.BudgetPriority != 123 ||
+		*realized.ContextCfg.InsertionPosition != -1 {
+		t.Errorf("category defaults were not applied: %+v",
+			realized.ContextCfg)
+	}
+	if *sc.Lorebook.Entries[1].ContextCfg.BudgetPriority != 0 {
+		t.Errorf("entries' own settings should override the defaults")
+	}
+
+	_, report := sc.GenerateContext(sc.Prompt, 2048)
+	var subcontext *ContextReportEntry
+	for idx := range report {
+		switch report[idx].Label {
+		case "Castle":
+			t.Errorf("entries of disabled categories should not activate")
+		case "Gawain", "Lancelot":
+			t.Errorf("entries of a sub-context should not be inserted " +
+				"separately")
+		case "Characters":
+			subcontext = &report[idx]
+		}
+	}
+	if subcontext == nil {
+		t.Fatalf("expected a Characters sub-context: %s",
+			StringifyContextReport(t, report))
+	}
+	if len(subcontext.Subcontext) != 2 {
+		t.Errorf("expected the sub-context to hold 2 entries: %s",
+			StringifyContextReport(t, subcontext.Subcontext))
+	}
+}
+
+func TestCreateLorebookRegexp(t *testing.T) {
+	tests := []struct {
+		key, text string
+		matches   bool
+	}{
+		{"dragon", "The Dragon roared.", true},
+		{"dragon", "The dragonfly hummed.", false},
+		{"/dra(gon|ke)s?/i", "Two Drakes circled.", true},
+		{"/Dragon/", "The dragon roared.", false},
+		{"/^The/m", "Once.\nThe end.", true},
+		{"/knight.+castle/gs", "A knight\nand a castle.", true},
+	}
+	for _, test := range tests {
+		keyRegex, err := createLorebookRegexp(test.key)
+		if err != nil {
+			t.Errorf("`%s`: %v", test.key, err)
+		} else if keyRegex.MatchString(test.text) != test.matches {
+			t.Errorf("`%s` matching %q: expected %v", test.key, test.text,
+				test.matches)
+		}
+	}
+	// JavaScript syntax that Go doesn't support is an error, and entries
+	// skip the keys that don't compile.
+	for _, key := range []string{"/dragon/x", "/(?<=the )dragon/"} {
+		if _, err := createLorebookRegexp(key); err == nil {
+			t.Errorf("`%s`: expected an error", key)
+		}
+	}
+	entry := testLorebookEntry("Dragon", "Scales glinted.", false,
+		"/(?<=the )dragon/", "dragon")
+	if indexes := entry.matchKeys("The dragon roared.", 1000); len(indexes) != 1 {
+		t.Errorf("expected only the valid key to match, got %v", indexes)
+	}
+}
+
+func TestLorebook_KeyRelative(t *testing.T) {
+	sc := ScenarioFromSpec(
+		"Line one.\nThe dragon appeared.\nLine three.\nLine four.", "",
+		"", "euterpe-v2")
+	sc.Settings.Parameters.CoerceDefaults()
+	below := testLorebookEntry("Below", "Scales glinted.", false, "dragon")
+	above := testLorebookEntry("Above", "The sky darkened.", false,
+		"/DRAGON/i")
+	keyRelative := true
+	for _, entry := range []*LorebookEntry{&below, &above} {
+		entry.KeyRelative = &keyRelative
+		// Placed before the story is, to be inserted relative to it once
+		// it has been.
+		*entry.ContextCfg.BudgetPriority = 400
+	}
+	*below.ContextCfg.InsertionPosition = 0
+	*above.ContextCfg.InsertionPosition = -1
+	sc.Lorebook.Entries = []LorebookEntry{below, above}
+	context, _ := sc.GenerateContext(sc.Prompt, 2048)
+	expected := "Line one.\nThe sky darkened.\nThe dragon appeared.\n" +
+		"Scales glinted.\nLine three.\nLine four."
+	if !strings.Contains(context, expected) {
+		t.Errorf("expected entries around the key's line, got %q", context)
+	}
+	// The key's line is found with the story's placeholders replaced.
+	sc.PlaceholderMap = Placeholders{}
+	sc.PlaceholderMap.UpdateValues(map[string]string{"creature": "dragon"})
+	context, _ = sc.GenerateContext(strings.Replace(sc.Prompt, "dragon",
+		"${creature}", 1), 2048)
+	if !strings.Contains(context, expected) {
+		t.Errorf("expected entries around the replaced key's line, got %q",
+			context)
+	}
+}
+
+func TestLorebook_OrderByKeyLocations(t *testing.T) {
+	sc := ScenarioFromSpec("The castle loomed over the knight.", "", "",
+		"euterpe-v2")
+	sc.Settings.Parameters.CoerceDefaults()
+	sc.Lorebook.Entries = []LorebookEntry{
+		testLorebookEntry("Knight", "Knight entry.", false, "knight"),
+		testLorebookEntry("Castle", "Castle entry.", false, "castle"),
+	}
+	for _, ordered := range []bool{false, true} {
+		sc.Lorebook.Settings.OrderByKeyLocations = ordered
+		context, _ := sc.GenerateContext(sc.Prompt, 2048)
+		knight := strings.Index(context, "Knight entry.")
+		castle := strings.Index(context, "Castle entry.")
+		if knight < 0 || castle < 0 || (castle < knight) != ordered {
+			t.Errorf("orderByKeyLocations %v: unexpected order %q",
+				ordered, context)
+		}
+	}
+}
+
+func TestScenario_GenerateContext_InsertionType(t *testing.T) {
+	tests := []struct {
+		insertionType string
+		position      int
+		allowInside   bool
+		allowInner    bool
+		expected      string
+	}{
+		{"newline", -2, true, true, "One. Two. Three.\nSnow fell.\nFour."},
+		{"sentence", -3, true, true, "One. Two. Snow fell.\nThree.\nFour."},
+		{"sentence", 1, true, true, "One. Snow fell.\nTwo. Three.\nFour."},
+		{"token", -2, true, true, "One. Two. Three.\nFourSnow fell.\n."},
+		// Moved out of the story, away from where it was counted from.
+		{"sentence", -3, false, true, "Snow fell.\nOne. Two. Three.\nFour."},
+		{"sentence", 1, false, true, "One. Two. Three.\nFour.\nSnow fell."},
+		{"sentence", -3, true, false, "Snow fell.\nOne. Two. Three.\nFour."},
+	}
+	for _, test := range tests {
+		sc := ScenarioFromSpec("One. Two. Three.\nFour.", "", "",
+			"euterpe-v2")
+		sc.Settings.Parameters.CoerceDefaults()
+		storyCfg := CreateDefaultContextConfig()
+		storyCfg.AllowInsertionInside = &test.allowInside
+		sc.StoryContextConfig = &storyCfg
+		entry := testLorebookEntry("Snow", "Snow fell.", false, "Four")
+		// Inserted after the story.
+		*entry.ContextCfg.BudgetPriority = -400
+		*entry.ContextCfg.InsertionType = test.insertionType
+		*entry.ContextCfg.InsertionPosition = test.position
+		entry.ContextCfg.AllowInnerInsertion = &test.allowInner
+		sc.Lorebook.Entries = []LorebookEntry{entry}
+		context, _ := sc.GenerateContext(sc.Prompt, 2048)
+		if !strings.HasSuffix(context, test.expected) {
+			t.Errorf("%v at %v, allowInsertionInside %v, "+
+				"allowInnerInsertion %v: expected %q, got %q",
+				test.insertionType, test.position, test.allowInside,
+				test.allowInner, test.expected, context)
+		}
+	}
+}
+
+func TestParseEphemeralEntry(t *testing.T) {
+	tests := []struct {
+		text                             string
+		start, delay, duration, position int
+		body                             string
+	}{
+		{"{+2~3,-4:The storm breaks.}", 5, 2, 3, -4, "The storm breaks."},
+		{"{7~2,0:Absolute}", 0, 7, 2, 0, "Absolute"},
+		{"{+1:Defaults}", 5, 1, 1, -1, "Defaults"},
+		{"{+0~1,2:Text: with a colon}", 5, 0, 1, 2, "Text: with a colon"},
+	}
+	for _, test := range tests {
+		entry, err := ParseEphemeralEntry(test.text, 5)
+		if err != nil {
+			t.Errorf("%s: %v", test.text, err)
+			continue
+		}
+		AssertEqual(t, []int{entry.StartingStep, entry.Delay, entry.Duration,
+			*entry.ContextCfg.InsertionPosition},
+			[]int{test.start, test.delay, test.duration, test.position})
+		AssertEqual(t, *entry.Text, test.body)
+	}
+	for _, invalid := range []string{"The storm breaks.", "{~2:text}",
+		"{+1~2,-3 text}"} {
+		if _, err := ParseEphemeralEntry(invalid, 0); err == nil {
+			t.Errorf("expected an error parsing `%s`", invalid)
+		}
+	}
+}
+
+func TestScenario_GenerateContext_Ephemeral(t *testing.T) {
+	sc := ScenarioFromSpec("The knights rode up to the castle.", "", "",
+		"euterpe-v2")
+	sc.Settings.Parameters.CoerceDefaults()
+	entry, err := ParseEphemeralEntry("{+1~2,-1:The storm breaks.}", 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sc.EphemeralContext = []EphemeralEntry{entry}
+	for step, active := range []bool{false, true, true, false} {
+		sc.SetStep(step)
+		context, report := sc.GenerateContext(sc.Prompt, 2048)
+		reported := false
+		for _, reportEntry := range report {
+			reported = reported || reportEntry.Label == "Ephemeral 1"
+		}
+		if reported != active ||
+			strings.HasSuffix(context, "The storm breaks.") != active {
+			t.Errorf("step %d: expected the entry to be active: %v, got %q",
+				step, active, context)
+		}
+	}
+}
+
 func StringifyContextReport(t *testing.T, ctxReport ContextReport) string {
 	if reprBytes, err := json.MarshalIndent(ctxReport, "", "  "); err != nil {
 		t.Errorf("Failed to unmarshal ContextReport to string")